@@ -3,8 +3,10 @@ module github.com/mat285/tls-proxy
 go 1.21.5
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/blend/go-sdk v1.20240719.1
 	github.com/spf13/cobra v1.8.1
+	golang.org/x/crypto v0.21.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
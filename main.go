@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 
@@ -25,6 +26,56 @@ func run() error {
 		},
 	}
 
+	cmd.AddCommand(&cobra.Command{
+		Use:           "validate",
+		Short:         "Validate the config file and environment without starting the proxy",
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			_, err := proxy.ReadConfigFile(file)
+			if err != nil {
+				return err
+			}
+			fmt.Println("config is valid")
+			return nil
+		},
+	})
+
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the proxy config",
+	}
+	configCmd.AddCommand(&cobra.Command{
+		Use:           "schema",
+		Short:         "Print a JSON Schema for the config file",
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(proxy.JSONSchema())
+		},
+	})
+	configCmd.AddCommand(&cobra.Command{
+		Use:           "print",
+		Short:         "Print the effective config after defaults and environment overlays, with secrets redacted",
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			cfg, err := proxy.ReadConfigFile(file)
+			if err != nil {
+				return err
+			}
+			out, err := proxy.EffectiveConfig(*cfg)
+			if err != nil {
+				return err
+			}
+			fmt.Print(out)
+			return nil
+		},
+	})
+	cmd.AddCommand(configCmd)
+
 	cmd.PersistentFlags().StringVar(
 		&file,
 		"config",
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+// Deny rules win over allow rules, and when any allow rule is set only
+// clients matching one are admitted.
+type AccessConfig struct {
+	Allow          []string `yaml:"allow"`
+	Deny           []string `yaml:"deny"`
+	AllowCountries []string `yaml:"allowCountries"`
+	DenyCountries  []string `yaml:"denyCountries"`
+	Status         int      `yaml:"status"`
+}
+
+func (c AccessConfig) IsEnabled() bool {
+	return len(c.Allow) > 0 || len(c.Deny) > 0 || len(c.AllowCountries) > 0 || len(c.DenyCountries) > 0
+}
+
+func (c AccessConfig) UsesCountries() bool {
+	return len(c.AllowCountries) > 0 || len(c.DenyCountries) > 0
+}
+
+type AccessRules struct {
+	Config         AccessConfig
+	allow, deny    []*net.IPNet
+	allowCountries map[string]bool
+	denyCountries  map[string]bool
+}
+
+func NewAccessRules(cfg AccessConfig) (*AccessRules, error) {
+	allow, err := ParseCIDRs(cfg.Allow)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := ParseCIDRs(cfg.Deny)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Status == 0 {
+		cfg.Status = http.StatusForbidden
+	}
+	return &AccessRules{
+		Config:         cfg,
+		allow:          allow,
+		deny:           deny,
+		allowCountries: countrySet(cfg.AllowCountries),
+		denyCountries:  countrySet(cfg.DenyCountries),
+	}, nil
+}
+
+func countrySet(countries []string) map[string]bool {
+	set := map[string]bool{}
+	for _, country := range countries {
+		set[strings.ToUpper(country)] = true
+	}
+	return set
+}
+
+func (r *AccessRules) Check(ip net.IP, country string) string {
+	if containsIP(r.deny, ip) {
+		return "denied address"
+	}
+	if len(country) > 0 && r.denyCountries[country] {
+		return "denied country " + country
+	}
+	if len(r.allow) == 0 && len(r.allowCountries) == 0 {
+		return ""
+	}
+	if containsIP(r.allow, ip) || len(country) > 0 && r.allowCountries[country] {
+		return ""
+	}
+	return "not in an allowed range or country"
+}
+
+type AccessControl struct {
+	Log logger.Log
+
+	lock   sync.RWMutex
+	global *AccessRules
+	geoIP  *MaxMindDB
+}
+
+func NewAccessControl(log logger.Log, cfg AccessConfig, geoIP GeoIPConfig) (*AccessControl, error) {
+	ac := &AccessControl{Log: log}
+	if err := ac.SetConfig(cfg, geoIP); err != nil {
+		return nil, err
+	}
+	return ac, nil
+}
+
+func (ac *AccessControl) SetConfig(cfg AccessConfig, geoIP GeoIPConfig) error {
+	global, db, err := loadAccess(cfg, geoIP)
+	if err != nil {
+		return err
+	}
+	ac.set(global, db)
+	return nil
+}
+
+// fails before anything is swapped
+func loadAccess(cfg AccessConfig, geoIP GeoIPConfig) (*AccessRules, *MaxMindDB, error) {
+	global, err := NewAccessRules(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(geoIP.Database) == 0 {
+		return global, nil, nil
+	}
+	db, err := OpenMaxMindDB(geoIP.Database)
+	if err != nil {
+		return nil, nil, err
+	}
+	return global, db, nil
+}
+
+func (ac *AccessControl) set(global *AccessRules, db *MaxMindDB) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	ac.global, ac.geoIP = global, db
+}
+
+func (ac *AccessControl) Allow(rw http.ResponseWriter, req *http.Request, route *Route) bool {
+	ac.lock.RLock()
+	global, db := ac.global, ac.geoIP
+	ac.lock.RUnlock()
+
+	rules := []*AccessRules{global}
+	if route != nil && route.Access != nil {
+		rules = append(rules, route.Access)
+	}
+	ip := clientIP(req)
+	country := ""
+	for _, r := range rules {
+		if !r.Config.IsEnabled() {
+			continue
+		}
+		if r.Config.UsesCountries() && len(country) == 0 && db != nil && ip != nil {
+			var err error
+			if country, err = db.Country(ip); err != nil {
+				ac.Log.ErrorfContext(req.Context(), "Looking up country of %s: %v", ip, err)
+			}
+		}
+		if reason := r.Check(ip, country); len(reason) > 0 {
+			scope := "global"
+			if r != global {
+				scope = "route " + routeName(route.Config)
+			}
+			ac.Log.InfofContext(req.Context(), "Denied %s %s%s from %s: %s by %s rules", req.Method, req.Host, req.URL.Path, describeClient(ip, country), reason, scope)
+			http.Error(rw, http.StatusText(r.Config.Status), r.Config.Status)
+			return false
+		}
+	}
+	return true
+}
+
+func describeClient(ip net.IP, country string) string {
+	if len(country) == 0 {
+		return fmt.Sprint(ip)
+	}
+	return fmt.Sprintf("%s (%s)", ip, country)
+}
+
+func clientIP(req *http.Request) net.IP {
+	if info := GetRequestInfo(req.Context()); info != nil && info.ClientIP != nil {
+		return info.ClientIP
+	}
+	return remoteIP(req.RemoteAddr)
+}
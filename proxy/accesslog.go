@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	AccessLogCommon   = "common"
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+	AccessLogTemplate = "template"
+)
+
+type AccessLogConfig struct {
+	// nil means enabled, as every request was always logged
+	Enabled  *bool  `yaml:"enabled"`
+	Format   string `yaml:"format"`
+	Template string `yaml:"template"`
+	Output   string `yaml:"output"`
+	// megabytes
+	MaxSize    int `yaml:"maxSize"`
+	MaxBackups int `yaml:"maxBackups"`
+}
+
+func (c AccessLogConfig) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+type AccessLogEntry struct {
+	Time            time.Time     `json:"time"`
+	Server          string        `json:"server"`
+	ClientIP        string        `json:"client_ip"`
+	User            string        `json:"user,omitempty"`
+	Method          string        `json:"method"`
+	Host            string        `json:"host"`
+	URI             string        `json:"uri"`
+	Proto           string        `json:"proto"`
+	Status          int           `json:"status"`
+	Bytes           int64         `json:"bytes"`
+	Duration        time.Duration `json:"-"`
+	Referer         string        `json:"referer,omitempty"`
+	UserAgent       string        `json:"user_agent,omitempty"`
+	TLSVersion      string        `json:"tls_version,omitempty"`
+	SNI             string        `json:"sni,omitempty"`
+	Route           string        `json:"route,omitempty"`
+	Upstream        string        `json:"upstream,omitempty"`
+	Target          string        `json:"target,omitempty"`
+	UpstreamLatency time.Duration `json:"-"`
+	RequestID       string        `json:"request_id,omitempty"`
+	TraceID         string        `json:"trace_id,omitempty"`
+}
+
+func (e AccessLogEntry) MarshalJSON() ([]byte, error) {
+	type plain AccessLogEntry
+	return json.Marshal(struct {
+		plain
+		DurationMS        float64 `json:"duration_ms"`
+		UpstreamLatencyMS float64 `json:"upstream_latency_ms,omitempty"`
+	}{
+		plain:             plain(e),
+		DurationMS:        milliseconds(e.Duration),
+		UpstreamLatencyMS: milliseconds(e.UpstreamLatency),
+	})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type AccessLog struct {
+	lock     sync.RWMutex
+	config   AccessLogConfig
+	format   func(AccessLogEntry) ([]byte, error)
+	out      io.WriteCloser
+	writeMux sync.Mutex
+}
+
+func NewAccessLog(cfg AccessLogConfig) (*AccessLog, error) {
+	al := &AccessLog{}
+	if err := al.SetConfig(cfg); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+func (al *AccessLog) SetConfig(cfg AccessLogConfig) error {
+	format, err := accessLogFormatter(cfg)
+	if err != nil {
+		return err
+	}
+	var out io.WriteCloser
+	switch cfg.Output {
+	case "", "stdout":
+		out = nopCloser{os.Stdout}
+	case "stderr":
+		out = nopCloser{os.Stderr}
+	default:
+		out, err = OpenRotatingFile(cfg.Output, int64(cfg.MaxSize)<<20, cfg.MaxBackups)
+		if err != nil {
+			return err
+		}
+	}
+
+	// requests being logged hold the read lock, so nothing writes to the
+	// previous output once it is swapped out
+	al.lock.Lock()
+	previous := al.out
+	al.config, al.format, al.out = cfg, format, out
+	al.lock.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+func (al *AccessLog) Close() error {
+	al.lock.RLock()
+	defer al.lock.RUnlock()
+	al.writeMux.Lock()
+	defer al.writeMux.Unlock()
+	return al.out.Close()
+}
+
+func (al *AccessLog) Log(entry AccessLogEntry) error {
+	al.lock.RLock()
+	defer al.lock.RUnlock()
+	line, err := al.format(entry)
+	if err != nil {
+		return err
+	}
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		line = append(line, '\n')
+	}
+	al.writeMux.Lock()
+	defer al.writeMux.Unlock()
+	_, err = al.out.Write(line)
+	return err
+}
+
+func (al *AccessLog) Handler(server string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req, info := withRequestInfo(req, server)
+		rec := &responseRecorder{ResponseWriter: rw}
+		next.ServeHTTP(rec, req)
+		al.Log(NewAccessLogEntry(req, info, rec.Status(), rec.written))
+	})
+}
+
+func NewAccessLogEntry(req *http.Request, info *RequestInfo, status int, written int64) AccessLogEntry {
+	entry := AccessLogEntry{
+		Time:            info.Start,
+		Server:          info.Server,
+		ClientIP:        req.RemoteAddr,
+		Method:          req.Method,
+		Host:            info.Host,
+		URI:             req.RequestURI,
+		Proto:           req.Proto,
+		Status:          status,
+		Bytes:           written,
+		Duration:        time.Since(info.Start),
+		Referer:         req.Referer(),
+		UserAgent:       req.UserAgent(),
+		Route:           info.Route,
+		Upstream:        info.Upstream,
+		Target:          info.Target,
+		UpstreamLatency: info.UpstreamLatency,
+		RequestID:       info.RequestID,
+		User:            info.User,
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		entry.ClientIP = host
+	}
+	if info.ClientIP != nil {
+		entry.ClientIP = info.ClientIP.String()
+	}
+	if user, _, ok := req.BasicAuth(); ok && len(entry.User) == 0 {
+		entry.User = user
+	}
+	if span := SpanFromContext(req.Context()); span != nil {
+		entry.TraceID = span.Context.TraceID.String()
+	}
+	if req.TLS != nil {
+		entry.TLSVersion = tls.VersionName(req.TLS.Version)
+		entry.SNI = req.TLS.ServerName
+	}
+	return entry
+}
+
+func accessLogFormatter(cfg AccessLogConfig) (func(AccessLogEntry) ([]byte, error), error) {
+	switch cfg.Format {
+	case "", AccessLogCommon:
+		return func(e AccessLogEntry) ([]byte, error) {
+			return []byte(commonLogLine(e)), nil
+		}, nil
+	case AccessLogCombined:
+		return func(e AccessLogEntry) ([]byte, error) {
+			return []byte(fmt.Sprintf("%s %s %s", commonLogLine(e), strconv.Quote(e.Referer), strconv.Quote(e.UserAgent))), nil
+		}, nil
+	case AccessLogJSON:
+		return func(e AccessLogEntry) ([]byte, error) {
+			return json.Marshal(e)
+		}, nil
+	case AccessLogTemplate:
+		tmpl, err := ParseAccessLogTemplate(cfg.Template)
+		if err != nil {
+			return nil, err
+		}
+		return func(e AccessLogEntry) ([]byte, error) {
+			var buf bytes.Buffer
+			err := tmpl.Execute(&buf, e)
+			return buf.Bytes(), err
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", cfg.Format)
+	}
+}
+
+func ParseAccessLogTemplate(text string) (*template.Template, error) {
+	if len(text) == 0 {
+		return nil, fmt.Errorf("template format needs a template")
+	}
+	return template.New("accessLog").Option("missingkey=error").Parse(text)
+}
+
+func commonLogLine(e AccessLogEntry) string {
+	user := e.User
+	if len(user) == 0 {
+		user = "-"
+	}
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+		e.ClientIP, user, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, e.URI, e.Proto, e.Status, size)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAccessLogEntry() AccessLogEntry {
+	return AccessLogEntry{
+		Time:            time.Date(2024, time.March, 5, 14, 3, 9, 0, time.UTC),
+		Server:          "tls",
+		ClientIP:        "203.0.113.7",
+		User:            "alice",
+		Method:          http.MethodGet,
+		Host:            "example.com",
+		URI:             "/items?page=2",
+		Proto:           "HTTP/1.1",
+		Status:          http.StatusOK,
+		Bytes:           512,
+		Duration:        1500 * time.Microsecond,
+		Referer:         "https://example.com/",
+		UserAgent:       `curl/8.0 "quoted"`,
+		Route:           "items",
+		Upstream:        "api",
+		UpstreamLatency: time.Millisecond,
+		RequestID:       "req-1",
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	common := `203.0.113.7 - alice [05/Mar/2024:14:03:09 +0000] "GET /items?page=2 HTTP/1.1" 200 512`
+	cases := []struct {
+		cfg  AccessLogConfig
+		want string
+	}{
+		{AccessLogConfig{}, common},
+		{AccessLogConfig{Format: AccessLogCommon}, common},
+		{AccessLogConfig{Format: AccessLogCombined}, common + ` "https://example.com/" "curl/8.0 \"quoted\""`},
+		{AccessLogConfig{Format: AccessLogTemplate, Template: "{{.Server}} {{.Method}} {{.Host}}{{.URI}} -> {{.Upstream}} {{.Status}}"}, "tls GET example.com/items?page=2 -> api 200"},
+	}
+	for _, c := range cases {
+		t.Run(c.cfg.Format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			c.cfg.Output = path
+			al, err := NewAccessLog(c.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := al.Log(testAccessLogEntry()); err != nil {
+				t.Fatal(err)
+			}
+			al.Close()
+			if got := readFile(t, path); got != c.want+"\n" {
+				t.Errorf("logged %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	al, err := NewAccessLog(AccessLogConfig{Format: AccessLogJSON, Output: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := testAccessLogEntry()
+	entry.Referer = ""
+	if err := al.Log(entry); err != nil {
+		t.Fatal(err)
+	}
+	al.Close()
+
+	var logged map[string]interface{}
+	if err := json.Unmarshal([]byte(readFile(t, path)), &logged); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]interface{}{
+		"client_ip":           "203.0.113.7",
+		"status":              float64(200),
+		"duration_ms":         1.5,
+		"upstream_latency_ms": float64(1),
+		"request_id":          "req-1",
+		"time":                "2024-03-05T14:03:09Z",
+	} {
+		if logged[key] != want {
+			t.Errorf("%s = %v, want %v", key, logged[key], want)
+		}
+	}
+	if _, ok := logged["referer"]; ok {
+		t.Error("logged an empty referer")
+	}
+}
+
+func TestAccessLogConfigErrors(t *testing.T) {
+	if _, err := NewAccessLog(AccessLogConfig{Format: "apache"}); err == nil || !strings.Contains(err.Error(), `unknown access log format "apache"`) {
+		t.Errorf("got %v, want the format rejected", err)
+	}
+	if _, err := NewAccessLog(AccessLogConfig{Format: AccessLogTemplate}); err == nil || !strings.Contains(err.Error(), "needs a template") {
+		t.Errorf("got %v, want the missing template rejected", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	al, err := NewAccessLog(AccessLogConfig{Format: AccessLogTemplate, Template: "{{.Missing}}", Output: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+	if err := al.Log(testAccessLogEntry()); err == nil {
+		t.Error("logged a template naming a missing field")
+	}
+}
+
+func TestAccessLogHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	al, err := NewAccessLog(AccessLogConfig{Format: AccessLogCombined, Output: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := al.Handler("http", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusTeapot)
+		rw.Write([]byte("short and stout"))
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/brew", nil)
+	req.RemoteAddr = "192.0.2.1:51234"
+	req.SetBasicAuth("bob", "secret")
+	req.Header.Set("User-Agent", "pot/1.0")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	al.Close()
+
+	got := readFile(t, path)
+	if !strings.HasPrefix(got, "192.0.2.1 - bob [") || !strings.HasSuffix(got, `] "POST /brew HTTP/1.1" 418 15 "" "pot/1.0"`+"\n") {
+		t.Errorf("logged %q", got)
+	}
+}
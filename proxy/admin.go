@@ -0,0 +1,446 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+const AdminUnixPrefix = "unix:"
+
+type AdminConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// addresses other than loopback and unix sockets require a token
+	Address  string             `yaml:"address"`
+	Token    string             `yaml:"token" secret:"true"`
+	Listener string             `yaml:"listener"`
+	Limits   ServerLimitsConfig `yaml:"limits"`
+}
+
+func (c AdminConfig) IsUnix() bool {
+	return strings.HasPrefix(c.Address, AdminUnixPrefix)
+}
+
+func ListenAdmin(cfg AdminConfig) (net.Listener, error) {
+	if !cfg.IsUnix() {
+		return net.Listen("tcp", cfg.Address)
+	}
+	path := strings.TrimPrefix(cfg.Address, AdminUnixPrefix)
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("admin socket %s is in use", path)
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	// the socket is handed to the next process on upgrade, so closing it here
+	// must not remove it
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	return l, nil
+}
+
+type AdminServer struct {
+	Log             logger.Log
+	Config          AdminConfig
+	Proxy           *Proxy
+	Server          *http.Server
+	Listener        net.Listener
+	Conns           *ConnTracker
+	ShutdownTimeout time.Duration
+
+	lock     sync.RWMutex
+	listener rebindableListener
+}
+
+func NewAdminServer(log logger.Log, cfg AdminConfig, p *Proxy) *AdminServer {
+	a := &AdminServer{
+		Log:    log,
+		Config: cfg,
+		Proxy:  p,
+		Conns:  NewConnTracker(),
+	}
+	server := &http.Server{
+		Addr:    cfg.Address,
+		Handler: a,
+	}
+	cfg.Limits.Apply(server)
+	a.Conns.Install(server)
+	a.Server = server
+	return a
+}
+
+func (a *AdminServer) Start() error {
+	if a.Listener == nil {
+		l, err := ListenAdmin(a.Config)
+		if err != nil {
+			return err
+		}
+		a.Listener = l
+	}
+	a.listener.set(a.Listener)
+	a.Log.Infof("Starting Admin Server on %s", a.Listener.Addr())
+	return a.listener.serve(a.Server.Serve)
+}
+
+func (a *AdminServer) SetConfig(cfg AdminConfig) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.Config = cfg
+}
+
+func (a *AdminServer) Rebind(l net.Listener) {
+	a.Log.Infof("Moving Admin Server to %s", l.Addr())
+	a.Listener = l
+	a.listener.rebind(l)
+}
+
+func (a *AdminServer) Stop() error {
+	return shutdownServer(a.Log, "Admin", a.Server, a.Conns, a.ShutdownTimeout)
+}
+
+func (a *AdminServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	a.lock.RLock()
+	cfg := a.Config
+	a.lock.RUnlock()
+
+	// probes need no token, they reveal nothing about the config
+	switch req.URL.Path {
+	case "/healthz":
+		serveLiveness(rw, req)
+		return
+	case "/readyz":
+		a.Proxy.Readiness.ServeHTTP(rw, req)
+		return
+	}
+	// the api is for tools, not browsers: refusing any Origin stops a page
+	// posting to it, and refusing names other than the admin address stops a
+	// rebound domain reading it, which a token already does
+	if len(req.Header.Get("Origin")) > 0 {
+		adminError(rw, http.StatusForbidden, "cross origin requests are not allowed")
+		return
+	}
+	if len(cfg.Token) == 0 && !cfg.IsUnix() && !adminHost(cfg.Address, req.Host) {
+		adminError(rw, http.StatusForbidden, "unexpected host")
+		return
+	}
+	if len(cfg.Token) > 0 {
+		given, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(cfg.Token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			adminError(rw, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+	}
+
+	path := strings.Trim(req.URL.Path, "/")
+	switch {
+	case path == "config":
+		a.get(rw, req, a.config)
+	case path == "upstreams":
+		a.get(rw, req, a.upstreams)
+	case strings.HasPrefix(path, "upstreams/"):
+		a.post(rw, req, a.drain)
+	case path == "certs":
+		a.get(rw, req, a.certs)
+	case path == "conns":
+		a.get(rw, req, a.conns)
+	case path == "build":
+		a.get(rw, req, a.build)
+	case path == "reload":
+		a.post(rw, req, a.reload)
+	case path == "log":
+		if req.Method == http.MethodPost {
+			a.setLog(rw, req)
+			return
+		}
+		a.get(rw, req, a.log)
+	default:
+		adminError(rw, http.StatusNotFound, "not found")
+	}
+}
+
+// adminHost accepts ip literals, localhost and the host the admin address
+// names.
+func adminHost(address, host string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.Trim(host, "[]")
+	if net.ParseIP(host) != nil || strings.EqualFold(host, "localhost") {
+		return true
+	}
+	configured, _, err := net.SplitHostPort(address)
+	return err == nil && len(configured) > 0 && strings.EqualFold(host, configured)
+}
+
+func (a *AdminServer) get(rw http.ResponseWriter, req *http.Request, handle func(http.ResponseWriter, *http.Request)) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		adminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	handle(rw, req)
+}
+
+func (a *AdminServer) post(rw http.ResponseWriter, req *http.Request, handle func(http.ResponseWriter, *http.Request)) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", "POST")
+		adminError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	handle(rw, req)
+}
+
+func (a *AdminServer) config(rw http.ResponseWriter, req *http.Request) {
+	p := a.Proxy
+	p.lock.Lock()
+	cfg := p.Config
+	p.lock.Unlock()
+	rendered, err := EffectiveConfig(cfg)
+	if err != nil {
+		adminError(rw, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rw.Header().Set("Content-Type", "application/yaml")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Write([]byte(rendered))
+}
+
+type adminUpstream struct {
+	Name    string        `json:"name"`
+	Drained bool          `json:"drained"`
+	Targets []adminTarget `json:"targets"`
+}
+
+type adminTarget struct {
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+	Drained bool   `json:"drained"`
+}
+
+func (a *AdminServer) handlers() map[string]*ProxyHandler {
+	handlers := map[string]*ProxyHandler{}
+	if s, ok := a.Proxy.TLSServer.(*TLSServer); ok {
+		handlers["tls"] = s.Handler
+	}
+	if s, ok := a.Proxy.HTTPServer.(*HTTPServer); ok {
+		handlers["http"] = s.Handler
+	}
+	return handlers
+}
+
+func (a *AdminServer) upstreams(rw http.ResponseWriter, req *http.Request) {
+	servers := map[string][]adminUpstream{}
+	for server, handler := range a.handlers() {
+		upstreams := []adminUpstream{}
+		for _, pool := range handler.Router().Pools() {
+			upstream := adminUpstream{Name: pool.Name, Drained: pool.Drains.Drained(pool.Name, "")}
+			for _, target := range pool.Targets {
+				upstream.Targets = append(upstream.Targets, adminTarget{
+					URL:     target.URL.String(),
+					Healthy: target.Healthy(),
+					Drained: pool.Drains.Drained(pool.Name, target.URL.Host),
+				})
+			}
+			upstreams = append(upstreams, upstream)
+		}
+		servers[server] = upstreams
+	}
+	adminJSON(rw, http.StatusOK, servers)
+}
+
+// upstreams named by url are escaped into a single path segment
+func (a *AdminServer) drain(rw http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.Trim(req.URL.EscapedPath(), "/"), "/")
+	if len(parts) != 3 || (parts[2] != "drain" && parts[2] != "undrain") {
+		adminError(rw, http.StatusNotFound, "not found")
+		return
+	}
+	name, err := url.PathUnescape(parts[1])
+	if err != nil {
+		adminError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+	target := req.URL.Query().Get("target")
+	if !a.hasUpstream(name, target) {
+		adminError(rw, http.StatusNotFound, fmt.Sprintf("no upstream %q with target %q", name, target))
+		return
+	}
+	if parts[2] == "drain" {
+		a.Proxy.Drains.Drain(name, target)
+		a.Log.Infof("Admin: drained upstream %s %s", name, target)
+	} else {
+		a.Proxy.Drains.Undrain(name, target)
+		a.Log.Infof("Admin: undrained upstream %s %s", name, target)
+	}
+	a.upstreams(rw, req)
+}
+
+func (a *AdminServer) hasUpstream(name, target string) bool {
+	for _, handler := range a.handlers() {
+		for _, pool := range handler.Router().Pools() {
+			if pool.Name != name {
+				continue
+			}
+			if len(target) == 0 {
+				return true
+			}
+			for _, t := range pool.Targets {
+				if t.URL.Host == target {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+type adminCert struct {
+	Server    string    `json:"server"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	ExpiresIn string    `json:"expiresIn"`
+}
+
+func (a *AdminServer) certs(rw http.ResponseWriter, req *http.Request) {
+	certs := []adminCert{}
+	if s, ok := a.Proxy.TLSServer.(*TLSServer); ok {
+		leaf, err := leafCertificate(s.Certs.Certificate())
+		if err != nil {
+			adminError(rw, http.StatusInternalServerError, err.Error())
+			return
+		}
+		certs = append(certs, adminCert{
+			Server:    "tls",
+			Subject:   leaf.Subject.String(),
+			Issuer:    leaf.Issuer.String(),
+			DNSNames:  leaf.DNSNames,
+			NotBefore: leaf.NotBefore,
+			NotAfter:  leaf.NotAfter,
+			ExpiresIn: time.Until(leaf.NotAfter).Round(time.Second).String(),
+		})
+	}
+	adminJSON(rw, http.StatusOK, certs)
+}
+
+type adminConns struct {
+	Active   int `json:"active"`
+	Inflight int `json:"inflight"`
+}
+
+func (a *AdminServer) conns(rw http.ResponseWriter, req *http.Request) {
+	trackers := map[string]*ConnTracker{}
+	if s, ok := a.Proxy.TLSServer.(*TLSServer); ok {
+		trackers["tls"] = s.Conns
+	}
+	if s, ok := a.Proxy.HTTPServer.(*HTTPServer); ok {
+		trackers["http"] = s.Conns
+	}
+	if s, ok := a.Proxy.RedirectServer.(*HTTPRedirect); ok {
+		trackers["redirect"] = s.Conns
+	}
+	if s, ok := a.Proxy.MetricsServer.(*MetricsServer); ok {
+		trackers["metrics"] = s.Conns
+	}
+	trackers["admin"] = a.Conns
+	conns := map[string]adminConns{}
+	for server, tracker := range trackers {
+		conns[server] = adminConns{Active: tracker.Active(), Inflight: tracker.Inflight()}
+	}
+	adminJSON(rw, http.StatusOK, conns)
+}
+
+func (a *AdminServer) build(rw http.ResponseWriter, req *http.Request) {
+	build := map[string]string{"goVersion": runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		build["path"] = info.Main.Path
+		build["version"] = info.Main.Version
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified":
+				build[strings.TrimPrefix(setting.Key, "vcs.")] = setting.Value
+			}
+		}
+	}
+	adminJSON(rw, http.StatusOK, build)
+}
+
+func (a *AdminServer) reload(rw http.ResponseWriter, req *http.Request) {
+	a.Log.Infof("Admin: reload requested")
+	if err := a.Proxy.Reload(); err != nil {
+		a.Log.Errorf("%v", err)
+		adminError(rw, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	adminJSON(rw, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+func (a *AdminServer) log(rw http.ResponseWriter, req *http.Request) {
+	if a.Proxy.LogFlags == nil {
+		adminError(rw, http.StatusNotImplemented, "logger flags cannot be changed")
+		return
+	}
+	adminJSON(rw, http.StatusOK, map[string]string{"flags": a.Proxy.LogFlags.Flags().String()})
+}
+
+// changes last until a reload that changes log.flags
+func (a *AdminServer) setLog(rw http.ResponseWriter, req *http.Request) {
+	if a.Proxy.LogFlags == nil {
+		adminError(rw, http.StatusNotImplemented, "logger flags cannot be changed")
+		return
+	}
+	query := req.URL.Query()
+	enable, disable := splitFlags(query.Get("enable")), splitFlags(query.Get("disable"))
+	if len(enable) == 0 && len(disable) == 0 {
+		adminError(rw, http.StatusBadRequest, "set enable or disable to comma separated log flags")
+		return
+	}
+	flags := a.Proxy.LogFlags.Update(enable, disable)
+	a.Log.Infof("Admin: log flags now %s", flags.String())
+	a.log(rw, req)
+}
+
+func splitFlags(value string) []string {
+	flags := []string{}
+	for _, flag := range strings.Split(value, ",") {
+		if flag = strings.TrimSpace(flag); len(flag) > 0 {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
+
+func adminJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	encoder := json.NewEncoder(rw)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func adminError(rw http.ResponseWriter, status int, message string) {
+	adminJSON(rw, status, map[string]string{"error": message})
+}
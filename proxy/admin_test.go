@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+func TestAdminToken(t *testing.T) {
+	log := logger.None()
+	admin := NewAdminServer(log, AdminConfig{Token: "secret"}, &Proxy{Log: log})
+	cases := []struct {
+		authorization string
+		code          int
+	}{
+		{"", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/build", nil)
+		if len(c.authorization) > 0 {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Errorf("authorization %q returned %d, want %d", c.authorization, rec.Code, c.code)
+		}
+	}
+}
+
+func TestAdminRefusesBrowsers(t *testing.T) {
+	log := logger.None()
+	p := &Proxy{Log: log, LogFlags: NewLogFlags(log)}
+	cases := []struct {
+		name   string
+		cfg    AdminConfig
+		method string
+		target string
+		origin string
+		code   int
+	}{
+		{"cross site post", AdminConfig{Address: "127.0.0.1:2024"}, http.MethodPost, "http://127.0.0.1:2024/log?enable=debug", "https://evil.example", http.StatusForbidden},
+		{"same origin post", AdminConfig{Address: "127.0.0.1:2024"}, http.MethodPost, "http://127.0.0.1:2024/log?enable=debug", "http://127.0.0.1:2024", http.StatusForbidden},
+		{"rebound domain", AdminConfig{Address: "127.0.0.1:2024"}, http.MethodGet, "http://evil.example:2024/build", "", http.StatusForbidden},
+		{"loopback", AdminConfig{Address: "127.0.0.1:2024"}, http.MethodGet, "http://127.0.0.1:2024/build", "", http.StatusOK},
+		{"localhost", AdminConfig{Address: "127.0.0.1:2024"}, http.MethodGet, "http://localhost:2024/build", "", http.StatusOK},
+		{"ipv6", AdminConfig{Address: "[::1]:2024"}, http.MethodGet, "http://[::1]:2024/build", "", http.StatusOK},
+		{"configured name", AdminConfig{Address: "admin.internal:2024"}, http.MethodGet, "http://admin.internal:2024/build", "", http.StatusOK},
+		{"unix socket", AdminConfig{Address: "unix:/run/proxy.sock"}, http.MethodGet, "http://proxy/build", "", http.StatusOK},
+		{"token", AdminConfig{Address: "0.0.0.0:2024", Token: "secret"}, http.MethodGet, "http://proxy.example:2024/build", "", http.StatusOK},
+		{"token cross site", AdminConfig{Address: "0.0.0.0:2024", Token: "secret"}, http.MethodPost, "http://proxy.example:2024/reload", "https://evil.example", http.StatusForbidden},
+		{"probe", AdminConfig{Address: "127.0.0.1:2024"}, http.MethodGet, "http://evil.example/healthz", "https://evil.example", http.StatusOK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			admin := NewAdminServer(log, c.cfg, p)
+			req := httptest.NewRequest(c.method, c.target, nil)
+			if len(c.origin) > 0 {
+				req.Header.Set("Origin", c.origin)
+			}
+			req.Header.Set("Authorization", "Bearer secret")
+			rec := httptest.NewRecorder()
+			admin.ServeHTTP(rec, req)
+			if rec.Code != c.code {
+				t.Errorf("returned %d, want %d: %s", rec.Code, c.code, rec.Body)
+			}
+		})
+	}
+	if p.LogFlags.Flags().IsEnabled(logger.Debug) {
+		t.Error("a refused request enabled debug logging")
+	}
+}
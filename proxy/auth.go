@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type AuthConfig struct {
+	Basic   *BasicAuthConfig   `yaml:"basic"`
+	JWT     *JWTAuthConfig     `yaml:"jwt"`
+	Forward *ForwardAuthConfig `yaml:"forward"`
+	OIDC    *OIDCAuthConfig    `yaml:"oidc"`
+}
+
+type BasicAuthConfig struct {
+	HtpasswdFile string `yaml:"htpasswdFile"`
+	Realm        string `yaml:"realm"`
+}
+
+type ForwardAuthConfig struct {
+	URL             string   `yaml:"url"`
+	RequestHeaders  []string `yaml:"requestHeaders"`
+	ResponseHeaders []string `yaml:"responseHeaders"`
+	Timeout         Duration `yaml:"timeout"`
+}
+
+const ForwardedUserHeader = "X-Forwarded-User"
+
+// Authenticators answer the requests they reject themselves.
+type Authenticator interface {
+	Authenticate(rw http.ResponseWriter, req *http.Request) (*http.Request, bool)
+}
+
+func NewAuthenticator(cfg AuthConfig, prefix string) (Authenticator, error) {
+	switch {
+	case cfg.Basic != nil:
+		return NewBasicAuth(*cfg.Basic)
+	case cfg.JWT != nil:
+		return NewJWTAuth(*cfg.JWT)
+	case cfg.Forward != nil:
+		return NewForwardAuth(*cfg.Forward), nil
+	case cfg.OIDC != nil:
+		return NewOIDCAuth(*cfg.OIDC, prefix)
+	}
+	return nil, fmt.Errorf("auth needs one of basic, jwt, forward or oidc")
+}
+
+func setUser(req *http.Request, user string) {
+	if info := GetRequestInfo(req.Context()); info != nil {
+		info.User = user
+	}
+}
+
+type BasicAuth struct {
+	Config BasicAuthConfig
+	users  map[string][]byte
+	// unknown users are checked against this hash, at the htpasswd file's
+	// cost, so the time taken does not tell which users exist
+	dummy []byte
+}
+
+func NewBasicAuth(cfg BasicAuthConfig) (*BasicAuth, error) {
+	users, err := ReadHtpasswd(cfg.HtpasswdFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Realm) == 0 {
+		cfg.Realm = "restricted"
+	}
+	cost := bcrypt.MinCost
+	for _, hash := range users {
+		if c, _ := bcrypt.Cost(hash); c > cost {
+			cost = c
+		}
+	}
+	dummy, err := bcrypt.GenerateFromPassword([]byte("unknown user"), cost)
+	if err != nil {
+		return nil, err
+	}
+	return &BasicAuth{Config: cfg, users: users, dummy: dummy}, nil
+}
+
+// only bcrypt hashes, as written by htpasswd -B, are accepted
+func ReadHtpasswd(file string) (map[string][]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || len(user) == 0 {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", file, n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: user %s: only bcrypt hashes are supported", file, n, user)
+		}
+		users[user] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
+
+func (b *BasicAuth) Authenticate(rw http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	user, password, ok := req.BasicAuth()
+	hash, known := b.users[user]
+	if !known {
+		hash = b.dummy
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil || !ok || !known {
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", b.Config.Realm))
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	setUser(req, user)
+	req = req.Clone(req.Context())
+	req.Header.Del("Authorization")
+	req.Header.Set(ForwardedUserHeader, user)
+	return req, true
+}
+
+type ForwardAuth struct {
+	Config ForwardAuthConfig
+	Client *http.Client
+}
+
+func NewForwardAuth(cfg ForwardAuthConfig) *ForwardAuth {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = Duration(10 * time.Second)
+	}
+	return &ForwardAuth{
+		Config: cfg,
+		Client: &http.Client{
+			Timeout: cfg.Timeout.Duration(),
+			// the service's redirects, e.g. to a login page, are for the client
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (f *ForwardAuth) Authenticate(rw http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	res, err := f.check(req.Context(), req)
+	if err != nil {
+		http.Error(rw, "auth service unavailable", http.StatusBadGateway)
+		return nil, false
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		for key, values := range res.Header {
+			rw.Header()[key] = values
+		}
+		rw.WriteHeader(res.StatusCode)
+		io.Copy(rw, res.Body)
+		return nil, false
+	}
+	req = req.Clone(req.Context())
+	for _, key := range f.Config.ResponseHeaders {
+		req.Header.Del(key)
+		for _, value := range res.Header.Values(key) {
+			req.Header.Add(key, value)
+		}
+	}
+	// the user only ever comes from the service, never the client
+	req.Header.Del(ForwardedUserHeader)
+	if user := res.Header.Get(ForwardedUserHeader); len(user) > 0 {
+		setUser(req, user)
+		req.Header.Set(ForwardedUserHeader, user)
+	}
+	return req, true
+}
+
+func (f *ForwardAuth) check(ctx context.Context, req *http.Request) (*http.Response, error) {
+	check, err := http.NewRequestWithContext(ctx, http.MethodGet, f.Config.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.Config.RequestHeaders) == 0 {
+		check.Header = req.Header.Clone()
+	} else {
+		for _, key := range f.Config.RequestHeaders {
+			for _, value := range req.Header.Values(key) {
+				check.Header.Add(key, value)
+			}
+		}
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	check.Header.Set("X-Forwarded-Method", req.Method)
+	check.Header.Set("X-Forwarded-Proto", proto)
+	check.Header.Set("X-Forwarded-Host", req.Host)
+	check.Header.Set("X-Forwarded-Uri", req.URL.RequestURI())
+	if ip := clientIP(req); ip != nil {
+		check.Header.Set("X-Forwarded-For", ip.String())
+	}
+	res, err := f.Client.Do(check)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 == 2 {
+		// only the headers of an allowing response are used
+		io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+		res.Body.Close()
+		res.Body = io.NopCloser(bytes.NewReader(nil))
+	}
+	return res, nil
+}
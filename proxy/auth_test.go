@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// signHS256 signs claims with secret as a compact JWT.
+func signHS256(t *testing.T, secret string, claims map[string]interface{}) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthForwardedUser(t *testing.T) {
+	auth, err := NewJWTAuth(JWTAuthConfig{Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		claims map[string]interface{}
+		want   string
+	}{
+		{"subject", map[string]interface{}{"sub": "alice"}, "alice"},
+		{"no subject", map[string]interface{}{"scope": "read"}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+signHS256(t, "secret", c.claims))
+			req.Header.Set(ForwardedUserHeader, "admin")
+			proxied, ok := auth.Authenticate(httptest.NewRecorder(), req)
+			if !ok {
+				t.Fatal("valid token was rejected")
+			}
+			if got := proxied.Header.Values(ForwardedUserHeader); len(c.want) == 0 && len(got) > 0 || len(c.want) > 0 && (len(got) != 1 || got[0] != c.want) {
+				t.Errorf("upstream got %s %v, want %q", ForwardedUserHeader, got, c.want)
+			}
+		})
+	}
+}
+
+func TestForwardAuthForwardedUser(t *testing.T) {
+	var user string
+	service := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if len(user) > 0 {
+			rw.Header().Set(ForwardedUserHeader, user)
+		}
+	}))
+	defer service.Close()
+	auth := NewForwardAuth(ForwardAuthConfig{URL: service.URL})
+
+	for _, user = range []string{"bob", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(ForwardedUserHeader, "admin")
+		proxied, ok := auth.Authenticate(httptest.NewRecorder(), req)
+		if !ok {
+			t.Fatal("allowed request was rejected")
+		}
+		if got := proxied.Header.Get(ForwardedUserHeader); got != user {
+			t.Errorf("upstream got %s %q, want %q from the service", ForwardedUserHeader, got, user)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswd, []byte("# users\nalice:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewBasicAuth(BasicAuthConfig{HtpasswdFile: htpasswd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost, err := bcrypt.Cost(auth.dummy); err != nil || cost != bcrypt.MinCost+1 {
+		t.Errorf("unknown users are checked at cost %d (%v), want the htpasswd cost", cost, err)
+	}
+
+	cases := []struct {
+		name     string
+		user     string
+		password string
+		ok       bool
+	}{
+		{"known user", "alice", "secret", true},
+		{"wrong password", "alice", "guess", false},
+		{"unknown user", "mallory", "secret", false},
+		{"unknown user with the dummy password", "mallory", "unknown user", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.SetBasicAuth(c.user, c.password)
+			rw := httptest.NewRecorder()
+			proxied, ok := auth.Authenticate(rw, req)
+			if ok != c.ok {
+				t.Fatalf("authenticated %v, want %v", ok, c.ok)
+			}
+			if !ok {
+				if rw.Code != http.StatusUnauthorized || rw.Header().Get("WWW-Authenticate") != `Basic realm="restricted", charset="UTF-8"` {
+					t.Errorf("rejected with %d and challenge %q", rw.Code, rw.Header().Get("WWW-Authenticate"))
+				}
+				return
+			}
+			if proxied.Header.Get("Authorization") != "" || proxied.Header.Get(ForwardedUserHeader) != c.user {
+				t.Errorf("upstream got authorization %q and user %q", proxied.Header.Get("Authorization"), proxied.Header.Get(ForwardedUserHeader))
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type CertStore struct {
+	lock sync.RWMutex
+	cert *tls.Certificate
+}
+
+func LoadCertificate(cfg TLSConfig) (*tls.Certificate, error) {
+	certPEM, err := pemOrFile(cfg.Cert, cfg.CertFile, "cert")
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := pemOrFile(cfg.Key, cfg.KeyFile, "key")
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %w", err)
+	}
+	return &cert, nil
+}
+
+// LoadClientCAs returns nil when no client CA is configured.
+func LoadClientCAs(cfg TLSConfig) (*x509.CertPool, error) {
+	if len(cfg.ClientCA) == 0 && len(cfg.ClientCAFile) == 0 {
+		return nil, nil
+	}
+	data, err := pemOrFile(cfg.ClientCA, cfg.ClientCAFile, "client CA")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("loading client CA: no certificates found")
+	}
+	return pool, nil
+}
+
+func pemOrFile(inline, file, name string) ([]byte, error) {
+	if len(inline) > 0 {
+		return []byte(inline), nil
+	}
+	if len(file) == 0 {
+		return nil, fmt.Errorf("missing TLS %s", name)
+	}
+	return os.ReadFile(file)
+}
+
+func (cs *CertStore) Set(cert *tls.Certificate) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.cert = cert
+}
+
+func (cs *CertStore) Certificate() *tls.Certificate {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	return cs.cert
+}
+
+func (cs *CertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := cs.Certificate()
+	if cert == nil {
+		return nil, fmt.Errorf("no certificate loaded")
+	}
+	return cert, nil
+}
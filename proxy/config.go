@@ -1,53 +1,149 @@
 package proxy
 
 import (
-	"fmt"
-	"net/url"
-	"os"
-	"strconv"
-
-	"gopkg.in/yaml.v2"
+	"context"
+	"time"
 )
 
 type Config struct {
-	TLS      TLSConfig      `yaml:"tls"`
-	Redirect RedirectConfig `yaml:"redirect"`
+	TLS       TLSConfig       `yaml:"tls"`
+	Redirect  RedirectConfig  `yaml:"redirect"`
+	HTTP      HTTPConfig      `yaml:"http"`
+	Shutdown  ShutdownConfig  `yaml:"shutdown"`
+	Health    HealthConfig    `yaml:"health"`
+	Log       LogConfig       `yaml:"log"`
+	Reload    ReloadConfig    `yaml:"reload"`
+	Secrets   SecretsConfig   `yaml:"secrets"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	AccessLog AccessLogConfig `yaml:"accessLog"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	RequestID RequestIDConfig `yaml:"requestID"`
+	Admin     AdminConfig     `yaml:"admin"`
+	RateLimit RateLimitConfig `yaml:"rateLimit"`
+	Access    AccessConfig    `yaml:"access"`
+	GeoIP     GeoIPConfig     `yaml:"geoIP"`
+	Forwarded ForwardedConfig `yaml:"forwarded"`
+
+	// relative to the including file
+	Include   []string         `yaml:"include" env:"-"`
+	Upstreams []UpstreamConfig `yaml:"upstreams"`
+	Routes    []RouteConfig    `yaml:"routes"`
+
+	Sources []string `yaml:"-"`
 }
 
 type TLSConfig struct {
-	Enabled  bool   `yaml:"enabled"`
+	// nil means enabled, as the tls server always ran before it could be turned off
+	Enabled  *bool  `yaml:"enabled"`
 	Port     uint16 `yaml:"port"`
 	Upstream string `yaml:"upstream"`
 	CertFile string `yaml:"certFile"`
 	KeyFile  string `yaml:"keyFile"`
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key" secret:"true"`
+	// clients presenting a certificate must have it signed by a client CA,
+	// but may present none
+	ClientCAFile string             `yaml:"clientCAFile"`
+	ClientCA     string             `yaml:"clientCA"`
+	Listener     string             `yaml:"listener"`
+	Limits       ServerLimitsConfig `yaml:"limits"`
+}
+
+func (c TLSConfig) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
 }
 
 type RedirectConfig struct {
-	Enabled      bool   `yaml:"enabled"`
-	Port         uint16 `yaml:"port"`
-	UpstreamPort uint16 `yaml:"upstreamPort"`
+	Enabled      bool               `yaml:"enabled"`
+	Port         uint16             `yaml:"port"`
+	UpstreamPort uint16             `yaml:"upstreamPort"`
+	Listener     string             `yaml:"listener"`
+	Limits       ServerLimitsConfig `yaml:"limits"`
 }
 
-func ReadConfigFile(file string) (*Config, error) {
-	if len(file) == 0 {
-		return &Config{}, nil
+type HTTPConfig struct {
+	Enabled  bool               `yaml:"enabled"`
+	Port     uint16             `yaml:"port"`
+	Upstream string             `yaml:"upstream"`
+	Listener string             `yaml:"listener"`
+	Limits   ServerLimitsConfig `yaml:"limits"`
+}
+
+type MetricsConfig struct {
+	Enabled  bool               `yaml:"enabled"`
+	Port     uint16             `yaml:"port"`
+	Path     string             `yaml:"path"`
+	Listener string             `yaml:"listener"`
+	Limits   ServerLimitsConfig `yaml:"limits"`
+}
+
+type ShutdownConfig struct {
+	DrainPeriod Duration `yaml:"drainPeriod"`
+	Timeout     Duration `yaml:"timeout"`
+}
+
+type HealthConfig struct {
+	LivenessPath  string `yaml:"livenessPath"`
+	ReadinessPath string `yaml:"readinessPath"`
+}
+
+type LogConfig struct {
+	Flags []string `yaml:"flags"`
+}
+
+type ReloadConfig struct {
+	Watch    bool     `yaml:"watch"`
+	Interval Duration `yaml:"interval"`
+}
+
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw string
+	if err := unmarshal(&raw); err != nil {
+		return err
 	}
-	data, err := os.ReadFile(file)
+	parsed, err := time.ParseDuration(raw)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func ReadConfigFile(file string) (*Config, error) {
 	var cfg Config
-	err = yaml.Unmarshal(data, &cfg)
+	var decodeErrs ValidationErrors
+	var lines map[string]location
+	if len(file) > 0 {
+		loader := newConfigLoader()
+		if err := loader.load(file, &cfg, true); err != nil {
+			return nil, err
+		}
+		decodeErrs, lines = loader.errs, loader.lines
+		cfg.Sources = loader.sources
+	}
+
+	err := ApplyEnv(&cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	upstream := os.Getenv("REDIRECT_UPSTREAM_PORT")
-	if len(upstream) > 0 {
-		uPort64, err := strconv.ParseUint(upstream, 10, 16)
-		if err == nil {
-			cfg.Redirect.UpstreamPort = uint16(uPort64)
-		}
+	err = resolveSecrets(context.Background(), &cfg, lines)
+	if err != nil {
+		return nil, err
 	}
 
 	if cfg.Redirect.UpstreamPort == 0 {
@@ -55,58 +151,23 @@ func ReadConfigFile(file string) (*Config, error) {
 		cfg.Redirect.UpstreamPort = uint16(443)
 	}
 
-	upstreamTLS := os.Getenv("TLS_UPSTREAM")
-	if len(upstreamTLS) > 0 {
-		cfg.TLS.Upstream = upstreamTLS
-	}
-
 	if cfg.Redirect.UpstreamPort == 0 {
 		cfg.Redirect.UpstreamPort = cfg.TLS.Port
 	}
 
-	_, err = url.Parse(cfg.TLS.Upstream)
-	if err != nil {
-		return nil, err
-	}
-
-	err = LoadTLS(&cfg)
+	err = validate(cfg, lines, decodeErrs...)
 	if err != nil {
 		return nil, err
 	}
 	return &cfg, nil
 }
 
-func LoadTLS(cfg *Config) error {
-	if len(cfg.TLS.CertFile) == 0 {
-		return fmt.Errorf("Missing TLS Cert File")
-	}
-	if len(cfg.TLS.KeyFile) == 0 {
-		return fmt.Errorf("Missing TLS Key File")
-	}
-
-	certData, err := os.ReadFile(cfg.TLS.CertFile)
-	if err != nil {
-		return err
-	}
-	certData = certData
-	// _, err = ParsePemEd25519PublicKey(certData)
-	// if err != nil {
-	// 	return err
-	// }
-
-	keyData, err := os.ReadFile(cfg.TLS.KeyFile)
-	if err != nil {
-		return err
+func ConfigOrDefault(cfg Config) Config {
+	if cfg.TLS.Enabled == nil {
+		enabled := true
+		cfg.TLS.Enabled = &enabled
 	}
-	keyData = keyData
-	// _, err = ParsePemEd25519PrivateKey(keyData)
-	// if err != nil {
-	// 	return err
-	// }
-	return nil
-}
 
-func ConfigOrDefault(cfg Config) Config {
 	if cfg.Redirect.Port == 0 && cfg.TLS.Port == 0 {
 		cfg.Redirect.Port = 2021
 		cfg.TLS.Port = 2022
@@ -118,5 +179,89 @@ func ConfigOrDefault(cfg Config) Config {
 	if cfg.TLS.Port == 0 {
 		cfg.TLS.Port = cfg.Redirect.Port + 1
 	}
+
+	if cfg.HTTP.Port == 0 {
+		cfg.HTTP.Port = 2020
+	}
+	if len(cfg.HTTP.Upstream) == 0 {
+		cfg.HTTP.Upstream = cfg.TLS.Upstream
+	}
+
+	if cfg.AccessLog.Enabled == nil {
+		enabled := true
+		cfg.AccessLog.Enabled = &enabled
+	}
+	if len(cfg.AccessLog.Format) == 0 {
+		cfg.AccessLog.Format = AccessLogCommon
+	}
+	if len(cfg.AccessLog.Output) == 0 {
+		cfg.AccessLog.Output = "stdout"
+	}
+
+	if len(cfg.Tracing.ServiceName) == 0 {
+		cfg.Tracing.ServiceName = "tls-proxy"
+	}
+	if len(cfg.Tracing.Sampler) == 0 {
+		cfg.Tracing.Sampler = SamplerParentBasedAlwaysOn
+	}
+	if len(cfg.Tracing.Propagators) == 0 {
+		cfg.Tracing.Propagators = []string{PropagatorTraceContext}
+	}
+	if cfg.Tracing.BatchSize == 0 {
+		cfg.Tracing.BatchSize = 512
+	}
+	if cfg.Tracing.QueueSize == 0 {
+		cfg.Tracing.QueueSize = 2048
+	}
+	if cfg.Tracing.FlushInterval == 0 {
+		cfg.Tracing.FlushInterval = Duration(5 * time.Second)
+	}
+	if cfg.Tracing.Timeout == 0 {
+		cfg.Tracing.Timeout = Duration(10 * time.Second)
+	}
+
+	if len(cfg.RequestID.Header) == 0 {
+		cfg.RequestID.Header = "X-Request-ID"
+	}
+
+	if cfg.Metrics.Port == 0 {
+		cfg.Metrics.Port = 2023
+	}
+	if len(cfg.Metrics.Path) == 0 {
+		cfg.Metrics.Path = "/metrics"
+	}
+
+	if len(cfg.Admin.Address) == 0 {
+		cfg.Admin.Address = "127.0.0.1:2024"
+	}
+
+	if len(cfg.TLS.Listener) == 0 {
+		cfg.TLS.Listener = "tls"
+	}
+	if len(cfg.Redirect.Listener) == 0 {
+		cfg.Redirect.Listener = "redirect"
+	}
+	if len(cfg.HTTP.Listener) == 0 {
+		cfg.HTTP.Listener = "http"
+	}
+	if len(cfg.Metrics.Listener) == 0 {
+		cfg.Metrics.Listener = "metrics"
+	}
+	if len(cfg.Admin.Listener) == 0 {
+		cfg.Admin.Listener = "admin"
+	}
+
+	cfg.TLS.Limits = cfg.TLS.Limits.ProxyOrDefault()
+	cfg.HTTP.Limits = cfg.HTTP.Limits.ProxyOrDefault()
+	cfg.Redirect.Limits = cfg.Redirect.Limits.OrDefault()
+	cfg.Metrics.Limits = cfg.Metrics.Limits.OrDefault()
+	cfg.Admin.Limits = cfg.Admin.Limits.OrDefault()
+
+	if cfg.Shutdown.Timeout == 0 {
+		cfg.Shutdown.Timeout = Duration(25 * time.Second)
+	}
+	if cfg.Reload.Interval == 0 {
+		cfg.Reload.Interval = Duration(5 * time.Second)
+	}
 	return cfg
 }
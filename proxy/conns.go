@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+type connKey struct{}
+
+// ConnTracker also cuts hijacked connections, which the server no longer
+// tracks.
+type ConnTracker struct {
+	lock     sync.Mutex
+	conns    map[net.Conn]http.ConnState
+	inflight int64
+}
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{conns: map[net.Conn]http.ConnState{}}
+}
+
+func (ct *ConnTracker) Install(server *http.Server) {
+	server.ConnState = ct.ConnState
+	server.ConnContext = ct.ConnContext
+	server.Handler = ct.Handler(server.Handler)
+}
+
+func (ct *ConnTracker) ConnState(c net.Conn, state http.ConnState) {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	if state == http.StateClosed {
+		delete(ct.conns, c)
+		return
+	}
+	ct.conns[c] = state
+}
+
+func (ct *ConnTracker) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+func (ct *ConnTracker) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&ct.inflight, 1)
+		defer func() {
+			atomic.AddInt64(&ct.inflight, -1)
+			// hijacked connections are never reported closed, forget them once
+			// the handler that owns them is done
+			if c, ok := req.Context().Value(connKey{}).(net.Conn); ok {
+				ct.lock.Lock()
+				if ct.conns[c] == http.StateHijacked {
+					delete(ct.conns, c)
+				}
+				ct.lock.Unlock()
+			}
+		}()
+		next.ServeHTTP(rw, req)
+	})
+}
+
+func (ct *ConnTracker) Active() int {
+	ct.lock.Lock()
+	defer ct.lock.Unlock()
+	count := 0
+	for _, state := range ct.conns {
+		if state != http.StateIdle {
+			count++
+		}
+	}
+	return count
+}
+
+func (ct *ConnTracker) Inflight() int {
+	return int(atomic.LoadInt64(&ct.inflight))
+}
+
+// A zero timeout waits forever. It returns the number of connections cut.
+func (ct *ConnTracker) Shutdown(server *http.Server, timeout time.Duration) (int, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := server.Shutdown(ctx)
+	if err == nil {
+		// Shutdown does not wait on hijacked connections
+		err = ct.waitInflight(ctx)
+	}
+	if err != context.DeadlineExceeded {
+		return 0, err
+	}
+
+	ct.lock.Lock()
+	cut := 0
+	for c, state := range ct.conns {
+		if state == http.StateIdle {
+			continue
+		}
+		cut++
+		if state == http.StateHijacked {
+			c.Close()
+		}
+	}
+	ct.lock.Unlock()
+	return cut, server.Close()
+}
+
+func (ct *ConnTracker) waitInflight(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for ct.Inflight() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func shutdownServer(log logger.Log, name string, server *http.Server, conns *ConnTracker, timeout time.Duration) error {
+	log.Infof("Stopping %s Server", name)
+	cut, err := conns.Shutdown(server, timeout)
+	if cut > 0 {
+		log.Warningf("%s Server stopped, did not drain within %v and cut %d connections", name, timeout, cut)
+	} else {
+		log.Infof("%s Server stopped, all connections drained", name)
+	}
+	return err
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+// trackedServer serves handler on a local listener with a ConnTracker
+// installed, as the proxy's servers do.
+func trackedServer(t *testing.T, handler http.Handler) (*httptest.Server, *ConnTracker) {
+	t.Helper()
+	conns := NewConnTracker()
+	server := httptest.NewUnstartedServer(handler)
+	conns.Install(server.Config)
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, conns
+}
+
+func TestShutdownDrainsInflightRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	server, conns := trackedServer(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		rw.Write([]byte("finished"))
+	}))
+
+	body := make(chan string, 1)
+	go func() {
+		res, err := http.Get(server.URL)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		body <- string(data)
+	}()
+	<-started
+	if conns.Inflight() != 1 || conns.Active() != 1 {
+		t.Fatalf("tracking %d requests on %d connections, want 1 on 1", conns.Inflight(), conns.Active())
+	}
+
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	cut, err := conns.Shutdown(server.Config, 5*time.Second)
+	if err != nil || cut != 0 {
+		t.Fatalf("shutdown cut %d connections with %v, want a clean drain", cut, err)
+	}
+	if got := <-body; got != "finished" {
+		t.Errorf("in-flight request got %q", got)
+	}
+}
+
+func TestShutdownCutsHijackedConnectionsAfterTimeout(t *testing.T) {
+	hijacked := make(chan struct{})
+	server, conns := trackedServer(t, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, buf, err := http.NewResponseController(rw).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+		buf.Flush()
+		close(hijacked)
+		// held open like a websocket until the proxy cuts it
+		io.Copy(io.Discard, conn)
+	}))
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade got %v %v", res, err)
+	}
+	<-hijacked
+
+	start := time.Now()
+	cut, err := conns.Shutdown(server.Config, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cut != 1 {
+		t.Errorf("cut %d connections, want the hijacked one", cut)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("cut after %v, before the timeout", elapsed)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from the cut connection got %v, want EOF", err)
+	}
+}
+
+func TestStopReportsNotReadyForTheDrainPeriod(t *testing.T) {
+	stopped := make(chan struct{})
+	stoppedAt := make(chan time.Time, 1)
+	p := &Proxy{
+		Log:       logger.None(),
+		Readiness: &Readiness{},
+		running:   true,
+		stopped:   stopped,
+	}
+	p.Config.Shutdown.DrainPeriod = Duration(300 * time.Millisecond)
+	p.Readiness.SetReady(true)
+	p.TLSServer = stopFunc(func() {
+		stoppedAt <- time.Now()
+		close(stopped)
+	})
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- p.Stop() }()
+	time.Sleep(50 * time.Millisecond)
+	if p.Readiness.Ready() {
+		t.Error("still ready while draining")
+	}
+	select {
+	case at := <-stoppedAt:
+		if at.Sub(start) < 300*time.Millisecond {
+			t.Errorf("servers stopped after %v, within the drain period", at.Sub(start))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("servers never stopped")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tls.certFile is read from PROXY_TLS_CERTFILE
+const EnvPrefix = "PROXY"
+
+// applied first, so the derived names take precedence
+var legacyEnv = map[string]string{
+	"REDIRECT_UPSTREAM_PORT": "PROXY_REDIRECT_UPSTREAMPORT",
+	"TLS_UPSTREAM":           "PROXY_TLS_UPSTREAM",
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// Lists are comma separated. Lists of sections can only be set from the
+// config file.
+func ApplyEnv(cfg *Config) error {
+	return applyEnv(cfg, os.LookupEnv)
+}
+
+func applyEnv(cfg *Config, lookup func(string) (string, bool)) error {
+	fields := map[string]reflect.Value{}
+	collectEnvFields(reflect.ValueOf(cfg).Elem(), EnvPrefix, fields)
+
+	var errs []error
+	for legacy, name := range legacyEnv {
+		if raw, ok := lookup(legacy); ok && len(raw) > 0 {
+			if err := setEnvField(fields[name], raw); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", legacy, err))
+			}
+		}
+	}
+	for _, name := range EnvNames() {
+		raw, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setEnvField(fields[name], raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func EnvNames() []string {
+	fields := map[string]reflect.Value{}
+	collectEnvFields(reflect.ValueOf(&Config{}).Elem(), EnvPrefix, fields)
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func collectEnvFields(v reflect.Value, prefix string, fields map[string]reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := yamlKey(field)
+		if !field.IsExported() || key == "-" || field.Tag.Get("env") == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(key)
+		fv := v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			collectEnvFields(fv, name, fields)
+			continue
+		}
+		if field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() != reflect.String {
+			continue
+		}
+		if field.Type.Kind() == reflect.Map {
+			continue
+		}
+		fields[name] = fv
+	}
+}
+
+func yamlKey(field reflect.StructField) string {
+	tag := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if len(tag) == 0 {
+		return strings.ToLower(field.Name)
+	}
+	return tag
+}
+
+func setEnvField(v reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+	if v.Kind() == reflect.Pointer {
+		value := reflect.New(v.Type().Elem())
+		if err := setEnvField(value.Elem(), raw); err != nil {
+			return err
+		}
+		v.Set(value)
+		return nil
+	}
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("invalid bool %q", raw)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", v.Type(), raw)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", v.Type(), raw)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(raw, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", v.Type(), raw)
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		values := []string{}
+		for _, part := range strings.Split(raw, ",") {
+			if part = strings.TrimSpace(part); len(part) > 0 {
+				values = append(values, part)
+			}
+		}
+		v.Set(reflect.ValueOf(values).Convert(v.Type()))
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func envLookup(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestApplyEnvDerivesNames(t *testing.T) {
+	cfg := Config{}
+	cfg.TLS.Upstream = "http://from-file"
+	cfg.Log.Flags = []string{"info"}
+	err := applyEnv(&cfg, envLookup(map[string]string{
+		"PROXY_TLS_UPSTREAM":     "http://from-env",
+		"PROXY_TLS_PORT":         "8443",
+		"PROXY_SHUTDOWN_TIMEOUT": "3s",
+		"PROXY_LOG_FLAGS":        "error, warning,",
+		"PROXY_RELOAD_WATCH":     "true",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TLS.Upstream != "http://from-env" || cfg.TLS.Port != 8443 {
+		t.Errorf("tls section is %+v", cfg.TLS)
+	}
+	if cfg.Shutdown.Timeout.Duration() != 3*time.Second {
+		t.Errorf("shutdown timeout is %v", cfg.Shutdown.Timeout)
+	}
+	if !reflect.DeepEqual(cfg.Log.Flags, []string{"error", "warning"}) {
+		t.Errorf("log flags are %q", cfg.Log.Flags)
+	}
+	if !cfg.Reload.Watch {
+		t.Error("reload.watch was not set")
+	}
+}
+
+func TestApplyEnvLegacyNamesLoseToDerived(t *testing.T) {
+	cfg := Config{}
+	err := applyEnv(&cfg, envLookup(map[string]string{
+		"REDIRECT_UPSTREAM_PORT": "8443",
+		"TLS_UPSTREAM":           "http://legacy",
+		"PROXY_TLS_UPSTREAM":     "http://derived",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Redirect.UpstreamPort != 8443 {
+		t.Errorf("legacy REDIRECT_UPSTREAM_PORT set %d", cfg.Redirect.UpstreamPort)
+	}
+	if cfg.TLS.Upstream != "http://derived" {
+		t.Errorf("tls upstream is %q, want the derived name to win", cfg.TLS.Upstream)
+	}
+}
+
+func TestApplyEnvReportsEveryBadValue(t *testing.T) {
+	cfg := Config{}
+	err := applyEnv(&cfg, envLookup(map[string]string{
+		"PROXY_TLS_PORT":         "70000",
+		"PROXY_SHUTDOWN_TIMEOUT": "soon",
+	}))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, name := range []string{"PROXY_TLS_PORT", "PROXY_SHUTDOWN_TIMEOUT"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error %q does not name %s", err, name)
+		}
+	}
+}
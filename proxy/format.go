@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+	FormatTOML = "toml"
+)
+
+func ConfigFormat(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatYAML
+	}
+}
+
+func decodeConfig(format string, data []byte, cfg *Config) (ValidationErrors, map[string]int, error) {
+	switch format {
+	case FormatYAML:
+		errs, err := decodeStrict(data, cfg)
+		return errs, yamlLines(data), err
+	case FormatJSON:
+		// json is yaml, and decoding it as such keeps the strictness and line
+		// numbers of decode errors
+		errs, err := decodeStrict(data, cfg)
+		return errs, nil, err
+	case FormatTOML:
+		var raw map[string]interface{}
+		if _, err := toml.Decode(string(data), &raw); err != nil {
+			return nil, nil, err
+		}
+		converted, err := yaml.Marshal(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		errs, err := decodeStrict(converted, cfg)
+		// lines refer to the converted document, not the file
+		for i := range errs {
+			errs[i].Line = 0
+		}
+		return errs, nil, err
+	default:
+		return nil, nil, fmt.Errorf("unknown config format %q", format)
+	}
+}
@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+)
+
+type ForwardedConfig struct {
+	// TrustedProxies are the only peers forwarding headers are believed from.
+	// The client is the nearest address in X-Forwarded-For, or Forwarded, that
+	// is not a trusted proxy.
+	TrustedProxies []string `yaml:"trustedProxies"`
+	// Mode is append, the default, or overwrite to send just the client.
+	// Headers sent by untrusted peers are always replaced.
+	Mode string `yaml:"mode"`
+	// PreserveHost keeps the client's Host, otherwise its port is replaced with
+	// the target's
+	PreserveHost bool `yaml:"preserveHost"`
+	// Headers default to the X-Forwarded ones
+	Headers []string `yaml:"headers"`
+}
+
+const (
+	ForwardedModeAppend    = "append"
+	ForwardedModeOverwrite = "overwrite"
+)
+
+var ForwardingHeaders = []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"}
+
+type Forwarding struct {
+	lock    sync.RWMutex
+	config  ForwardedConfig
+	trusted []*net.IPNet
+	headers map[string]bool
+}
+
+func NewForwarding(cfg ForwardedConfig) (*Forwarding, error) {
+	f := &Forwarding{}
+	if err := f.SetConfig(cfg); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *Forwarding) SetConfig(cfg ForwardedConfig) error {
+	trusted, err := ParseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Mode) == 0 {
+		cfg.Mode = ForwardedModeAppend
+	}
+	if len(cfg.Headers) == 0 {
+		cfg.Headers = ForwardingHeaders[:3]
+	}
+	headers := map[string]bool{}
+	for _, header := range cfg.Headers {
+		headers[http.CanonicalHeaderKey(header)] = true
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.config, f.trusted, f.headers = cfg, trusted, headers
+	return nil
+}
+
+func (f *Forwarding) PreserveHost() bool {
+	if f == nil {
+		return false
+	}
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.config.PreserveHost
+}
+
+// Handler resolves the client before any other handler sees the request.
+func (f *Forwarding) Handler(server string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		f.lock.RLock()
+		trusted := f.trusted
+		f.lock.RUnlock()
+
+		req, info := withRequestInfo(req, server)
+		info.ClientIP, info.Proto = resolveClient(req, trusted)
+		next.ServeHTTP(rw, req)
+	})
+}
+
+func resolveClient(req *http.Request, trusted []*net.IPNet) (net.IP, string) {
+	peer := remoteIP(req.RemoteAddr)
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	if !containsIP(trusted, peer) {
+		return peer, proto
+	}
+	chain, forwardedProto := forwardedChain(req.Header)
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		if chain[i] == nil {
+			// an obfuscated or unknown hop, nothing before it can be checked
+			break
+		}
+		client = chain[i]
+		if !containsIP(trusted, client) {
+			break
+		}
+	}
+	if forwardedProto == "http" || forwardedProto == "https" {
+		proto = forwardedProto
+	}
+	return client, proto
+}
+
+// forwardedChain returns the addresses nearest last, preferring
+// X-Forwarded-For and X-Forwarded-Proto over Forwarded.
+func forwardedChain(header http.Header) ([]net.IP, string) {
+	chain := []net.IP{}
+	if values := header.Values("X-Forwarded-For"); len(values) > 0 {
+		for _, value := range values {
+			for _, addr := range strings.Split(value, ",") {
+				chain = append(chain, parseForwardedNode(addr))
+			}
+		}
+		proto, _, _ := strings.Cut(header.Get("X-Forwarded-Proto"), ",")
+		return chain, strings.ToLower(strings.TrimSpace(proto))
+	}
+	proto := ""
+	for i, element := range parseForwarded(header.Values("Forwarded")) {
+		chain = append(chain, parseForwardedNode(element["for"]))
+		if i == 0 {
+			proto = strings.ToLower(element["proto"])
+		}
+	}
+	return chain, proto
+}
+
+func parseForwarded(values []string) []map[string]string {
+	elements := []map[string]string{}
+	for _, value := range values {
+		for _, raw := range strings.Split(value, ",") {
+			element := map[string]string{}
+			for _, pair := range strings.Split(raw, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok {
+					continue
+				}
+				element[strings.ToLower(key)] = strings.Trim(value, `"`)
+			}
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
+
+// parseForwardedNode returns nil for obfuscated and unknown nodes.
+func parseForwardedNode(node string) net.IP {
+	node = strings.TrimSpace(node)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	return net.ParseIP(strings.Trim(node, "[]"))
+}
+
+func formatForwardedNode(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return fmt.Sprintf(`"[%s]"`, ip)
+	}
+	return ip.String()
+}
+
+// SetHeaders relies on the incoming X-Forwarded headers having been removed
+// from pr.Out.
+func (f *Forwarding) SetHeaders(pr *httputil.ProxyRequest) {
+	f.lock.RLock()
+	cfg, trusted, headers := f.config, f.trusted, f.headers
+	f.lock.RUnlock()
+
+	in := pr.In
+	peer := remoteIP(in.RemoteAddr)
+	fromTrusted := containsIP(trusted, peer)
+	appending := fromTrusted && cfg.Mode == ForwardedModeAppend
+	client, proto := clientIP(in), requestProto(in)
+	host := in.Host
+	if forwardedHost, _, _ := strings.Cut(in.Header.Get("X-Forwarded-Host"), ","); fromTrusted && len(forwardedHost) > 0 {
+		host = strings.TrimSpace(forwardedHost)
+	}
+
+	pr.Out.Header.Del("Forwarded")
+	if headers["X-Forwarded-For"] {
+		value := formatIP(client)
+		if appending {
+			value = formatIP(peer)
+			if prior := strings.Join(in.Header.Values("X-Forwarded-For"), ", "); len(prior) > 0 {
+				value = prior + ", " + value
+			}
+		}
+		pr.Out.Header.Set("X-Forwarded-For", value)
+	}
+	if headers["X-Forwarded-Proto"] {
+		pr.Out.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if headers["X-Forwarded-Host"] {
+		pr.Out.Header.Set("X-Forwarded-Host", host)
+	}
+	if headers["Forwarded"] {
+		element := fmt.Sprintf("for=%s;host=%q;proto=%s", formatForwardedNode(client), host, proto)
+		if appending {
+			ownProto := "http"
+			if in.TLS != nil {
+				ownProto = "https"
+			}
+			element = fmt.Sprintf("for=%s;host=%q;proto=%s", formatForwardedNode(peer), in.Host, ownProto)
+			if prior := strings.Join(in.Header.Values("Forwarded"), ", "); len(prior) > 0 {
+				element = prior + ", " + element
+			}
+		}
+		pr.Out.Header.Set("Forwarded", element)
+	}
+}
+
+func formatIP(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	return ip.String()
+}
+
+func requestProto(req *http.Request) string {
+	if info := GetRequestInfo(req.Context()); info != nil && len(info.Proto) > 0 {
+		return info.Proto
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+)
+
+// forward passes a request from peer through the forwarding handler and
+// returns the client it resolved and the headers the upstream would get.
+func forward(t *testing.T, cfg ForwardedConfig, peer string, header http.Header) (*RequestInfo, http.Header) {
+	t.Helper()
+	f, err := NewForwarding(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	req.RemoteAddr = peer
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	var info *RequestInfo
+	var out http.Header
+	f.Handler("http", http.HandlerFunc(func(rw http.ResponseWriter, in *http.Request) {
+		info = GetRequestInfo(in.Context())
+		// as httputil.ReverseProxy does before calling Rewrite
+		pr := &httputil.ProxyRequest{In: in, Out: in.Clone(in.Context())}
+		for _, header := range ForwardingHeaders {
+			pr.Out.Header.Del(header)
+		}
+		f.SetHeaders(pr)
+		out = pr.Out.Header
+	})).ServeHTTP(httptest.NewRecorder(), req)
+	return info, out
+}
+
+func TestForwardingIgnoresUntrustedPeers(t *testing.T) {
+	info, out := forward(t, ForwardedConfig{TrustedProxies: []string{"10.0.0.0/8"}}, "203.0.113.7:4000", http.Header{
+		"X-Forwarded-For":   {"198.51.100.1"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"evil.example.com"},
+		"Forwarded":         {"for=198.51.100.1;proto=https"},
+	})
+	if info.ClientIP.String() != "203.0.113.7" || info.Proto != "http" {
+		t.Errorf("resolved client %s over %s, want the peer over http", info.ClientIP, info.Proto)
+	}
+	want := http.Header{
+		"X-Forwarded-For":   {"203.0.113.7"},
+		"X-Forwarded-Proto": {"http"},
+		"X-Forwarded-Host":  {"app.example.com"},
+	}
+	for _, name := range ForwardingHeaders {
+		if got := out.Values(name); len(got) > 1 || out.Get(name) != want.Get(name) {
+			t.Errorf("upstream got %s %q, want %q", name, got, want.Get(name))
+		}
+	}
+}
+
+func TestForwardingWalksTrustedChain(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "192.168.1.1"}
+	cases := []struct {
+		name   string
+		header http.Header
+		client string
+		proto  string
+	}{
+		{"x-forwarded-for", http.Header{
+			"X-Forwarded-For":   {"198.51.100.9, 203.0.113.7", "192.168.1.1"},
+			"X-Forwarded-Proto": {"https, http"},
+		}, "203.0.113.7", "https"},
+		{"only trusted hops", http.Header{
+			"X-Forwarded-For": {"10.1.1.1, 192.168.1.1"},
+		}, "10.1.1.1", "http"},
+		{"stops at an unknown hop", http.Header{
+			"X-Forwarded-For": {"203.0.113.7, unknown, 10.2.2.2"},
+		}, "10.2.2.2", "http"},
+		{"forwarded", http.Header{
+			"Forwarded": {`for=198.51.100.9;proto=https, for="[2001:db8::1]:443"`, "for=192.168.1.1:80"},
+		}, "2001:db8::1", "https"},
+		{"x-forwarded-for wins over forwarded", http.Header{
+			"X-Forwarded-For": {"203.0.113.7"},
+			"Forwarded":       {"for=198.51.100.9"},
+		}, "203.0.113.7", "http"},
+		{"unsupported proto", http.Header{
+			"X-Forwarded-For":   {"203.0.113.7"},
+			"X-Forwarded-Proto": {"gopher"},
+		}, "203.0.113.7", "http"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			info, _ := forward(t, ForwardedConfig{TrustedProxies: trusted}, "10.0.0.2:4000", c.header)
+			if info.ClientIP.String() != c.client || info.Proto != c.proto {
+				t.Errorf("resolved client %s over %s, want %s over %s", info.ClientIP, info.Proto, c.client, c.proto)
+			}
+		})
+	}
+}
+
+func TestForwardingSetsHeaders(t *testing.T) {
+	header := http.Header{
+		"X-Forwarded-For":   {"203.0.113.7"},
+		"X-Forwarded-Proto": {"https"},
+		"X-Forwarded-Host":  {"www.example.com"},
+		"Forwarded":         {`for=203.0.113.7;host="www.example.com";proto=https`},
+	}
+	all := ForwardingHeaders
+	cases := []struct {
+		name string
+		cfg  ForwardedConfig
+		peer string
+		want map[string]string
+	}{
+		{"append", ForwardedConfig{TrustedProxies: []string{"10.0.0.0/8"}, Headers: all}, "10.0.0.2:4000", map[string]string{
+			"X-Forwarded-For":   "203.0.113.7, 10.0.0.2",
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "www.example.com",
+			"Forwarded":         `for=203.0.113.7;host="www.example.com";proto=https, for=10.0.0.2;host="app.example.com";proto=http`,
+		}},
+		{"overwrite", ForwardedConfig{TrustedProxies: []string{"10.0.0.0/8"}, Mode: ForwardedModeOverwrite, Headers: all}, "10.0.0.2:4000", map[string]string{
+			"X-Forwarded-For":   "203.0.113.7",
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "www.example.com",
+			"Forwarded":         `for=203.0.113.7;host="www.example.com";proto=https`,
+		}},
+		{"untrusted ipv6 peer", ForwardedConfig{Headers: []string{"forwarded"}}, "[2001:db8::7]:4000", map[string]string{
+			"Forwarded": `for="[2001:db8::7]";host="app.example.com";proto=http`,
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, out := forward(t, c.cfg, c.peer, header)
+			for _, name := range ForwardingHeaders {
+				if got := out.Get(name); got != c.want[name] {
+					t.Errorf("upstream got %s %q, want %q", name, got, c.want[name])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+)
+
+type GeoIPConfig struct {
+	Database string `yaml:"database"`
+}
+
+var maxMindMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// https://maxmind.github.io/MaxMind-DB/
+type MaxMindDB struct {
+	Path       string
+	NodeCount  uint
+	RecordSize uint
+	IPVersion  uint
+	Type       string
+
+	tree      []byte
+	data      []byte
+	ipv4Start uint
+}
+
+func OpenMaxMindDB(path string) (*MaxMindDB, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := ParseMaxMindDB(contents)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	db.Path = path
+	return db, nil
+}
+
+func ParseMaxMindDB(contents []byte) (*MaxMindDB, error) {
+	at := bytes.LastIndex(contents, maxMindMetadataMarker)
+	if at < 0 {
+		return nil, fmt.Errorf("not a MaxMind DB, metadata marker missing")
+	}
+	metaSection := contents[at+len(maxMindMetadataMarker):]
+	raw, _, err := (&maxMindDecoder{data: metaSection}).decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata: %w", err)
+	}
+	meta, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("metadata is not a map")
+	}
+	db := &MaxMindDB{
+		NodeCount:  metaUint(meta["node_count"]),
+		RecordSize: metaUint(meta["record_size"]),
+		IPVersion:  metaUint(meta["ip_version"]),
+	}
+	db.Type, _ = meta["database_type"].(string)
+	if db.RecordSize != 24 && db.RecordSize != 28 && db.RecordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.RecordSize)
+	}
+	if db.IPVersion != 4 && db.IPVersion != 6 {
+		return nil, fmt.Errorf("unsupported ip version %d", db.IPVersion)
+	}
+	treeSize := db.NodeCount * db.RecordSize / 4
+	// the tree is followed by 16 zero bytes, then the data section
+	if treeSize+16 > uint(at) {
+		return nil, fmt.Errorf("search tree larger than the file")
+	}
+	db.tree = contents[:treeSize]
+	db.data = contents[treeSize+16 : at]
+
+	if db.IPVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < db.NodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+func metaUint(value interface{}) uint {
+	switch v := value.(type) {
+	case uint64:
+		return uint(v)
+	case uint32:
+		return uint(v)
+	case uint16:
+		return uint(v)
+	}
+	return 0
+}
+
+func (db *MaxMindDB) record(node uint, bit byte) uint {
+	size := db.RecordSize / 4
+	b := db.tree[node*size : (node+1)*size]
+	switch db.RecordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]>>4)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+func (db *MaxMindDB) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	bits := ip.To4()
+	if bits != nil && db.IPVersion == 6 {
+		node = db.ipv4Start
+	} else if bits == nil {
+		if db.IPVersion == 4 {
+			return nil, nil
+		}
+		bits = ip.To16()
+	}
+	for i := 0; i < len(bits)*8 && node < db.NodeCount; i++ {
+		node = db.record(node, bits[i/8]>>(7-uint(i%8))&1)
+	}
+	if node == db.NodeCount {
+		return nil, nil
+	}
+	if node < db.NodeCount {
+		return nil, fmt.Errorf("search tree is deeper than the address")
+	}
+	offset := node - db.NodeCount - 16
+	if offset >= uint(len(db.data)) {
+		return nil, fmt.Errorf("record offset %d outside the data section", offset)
+	}
+	value, _, err := (&maxMindDecoder{data: db.data}).decode(offset)
+	return value, err
+}
+
+// falls back to the registered country
+func (db *MaxMindDB) Country(ip net.IP) (string, error) {
+	value, err := db.Lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	record, _ := value.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := record[key].(map[string]interface{})
+		if code, ok := country["iso_code"].(string); ok {
+			return code, nil
+		}
+	}
+	return "", nil
+}
+
+// pointers that loop back into their own value fail here instead of
+// overflowing the stack
+const maxMindMaxDepth = 64
+
+type maxMindDecoder struct {
+	data  []byte
+	depth int
+}
+
+const (
+	maxMindExtended = iota
+	maxMindPointer
+	maxMindString
+	maxMindDouble
+	maxMindBytes
+	maxMindUint16
+	maxMindUint32
+	maxMindMap
+	maxMindInt32
+	maxMindUint64
+	maxMindUint128
+	maxMindArray
+	maxMindContainer
+	maxMindEndMarker
+	maxMindBool
+	maxMindFloat
+)
+
+func (d *maxMindDecoder) decode(offset uint) (interface{}, uint, error) {
+	if d.depth >= maxMindMaxDepth {
+		return nil, 0, fmt.Errorf("data nested more than %d deep", maxMindMaxDepth)
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+
+	kind, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if kind != maxMindPointer {
+		return d.value(kind, size, offset)
+	}
+	pointer, next, err := d.pointer(size, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	kind, size, at, err := d.control(pointer)
+	if err != nil {
+		return nil, 0, err
+	}
+	if kind == maxMindPointer {
+		return nil, 0, fmt.Errorf("pointer at %d points to another pointer", offset-1)
+	}
+	value, _, err := d.value(kind, size, at)
+	return value, next, err
+}
+
+func (d *maxMindDecoder) control(offset uint) (int, uint, uint, error) {
+	if offset >= uint(len(d.data)) {
+		return 0, 0, 0, fmt.Errorf("unexpected end of data")
+	}
+	ctrl := d.data[offset]
+	offset++
+	kind := int(ctrl >> 5)
+	if kind == maxMindExtended {
+		if offset >= uint(len(d.data)) {
+			return 0, 0, 0, fmt.Errorf("unexpected end of data")
+		}
+		kind = 7 + int(d.data[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if kind == maxMindPointer || size < 29 {
+		return kind, size, offset, nil
+	}
+	extra := size - 28
+	if offset+extra > uint(len(d.data)) {
+		return 0, 0, 0, fmt.Errorf("unexpected end of data")
+	}
+	n := uint(0)
+	for _, b := range d.data[offset : offset+extra] {
+		n = n<<8 | uint(b)
+	}
+	switch extra {
+	case 1:
+		size = 29 + n
+	case 2:
+		size = 285 + n
+	default:
+		size = 65821 + n
+	}
+	return kind, size, offset + extra, nil
+}
+
+func (d *maxMindDecoder) pointer(bits, offset uint) (uint, uint, error) {
+	length := (bits>>3)&0x3 + 1
+	if offset+length > uint(len(d.data)) {
+		return 0, 0, fmt.Errorf("unexpected end of data")
+	}
+	n := uint(0)
+	if length != 4 {
+		n = bits & 0x7
+	}
+	for _, b := range d.data[offset : offset+length] {
+		n = n<<8 | uint(b)
+	}
+	switch length {
+	case 2:
+		n += 2048
+	case 3:
+		n += 526336
+	}
+	return n, offset + length, nil
+}
+
+func (d *maxMindDecoder) value(kind int, size, offset uint) (interface{}, uint, error) {
+	// every entry takes at least a byte, so larger sizes cannot be right
+	if (kind == maxMindMap || kind == maxMindArray) && size > uint(len(d.data))-offset {
+		return nil, 0, fmt.Errorf("%d entries do not fit in the data", size)
+	}
+	switch kind {
+	case maxMindMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key is not a string")
+			}
+			value, next, err := d.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[name] = value
+			offset = next
+		}
+		return m, offset, nil
+	case maxMindArray:
+		items := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			item, next, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			items = append(items, item)
+			offset = next
+		}
+		return items, offset, nil
+	case maxMindBool:
+		return size != 0, offset, nil
+	case maxMindEndMarker, maxMindContainer:
+		return nil, offset, nil
+	}
+
+	if offset+size > uint(len(d.data)) {
+		return nil, 0, fmt.Errorf("unexpected end of data")
+	}
+	b := d.data[offset : offset+size]
+	next := offset + size
+	switch kind {
+	case maxMindString:
+		return string(b), next, nil
+	case maxMindBytes:
+		return append([]byte(nil), b...), next, nil
+	case maxMindDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("double of %d bytes", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case maxMindFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("float of %d bytes", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	case maxMindUint16, maxMindUint32, maxMindUint64:
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		switch kind {
+		case maxMindUint16:
+			return uint16(n), next, nil
+		case maxMindUint32:
+			return uint32(n), next, nil
+		}
+		return n, next, nil
+	case maxMindInt32:
+		n := uint32(0)
+		for _, c := range b {
+			n = n<<8 | uint32(c)
+		}
+		return int32(n), next, nil
+	case maxMindUint128:
+		return new(big.Int).SetBytes(b), next, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", kind)
+}
@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mmdbNode is a search tree node of a database being built, whose records
+// lead to another node, to data at an offset plus one, or to nothing.
+type mmdbNode struct {
+	child [2]*mmdbNode
+	data  [2]int
+}
+
+func (n *mmdbNode) insert(ip net.IP, bits, offset int) {
+	for i := 0; i < bits; i++ {
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+		if i == bits-1 {
+			n.data[bit] = offset + 1
+			return
+		}
+		if n.child[bit] == nil {
+			n.child[bit] = &mmdbNode{}
+		}
+		n = n.child[bit]
+	}
+}
+
+func (n *mmdbNode) nodes() []*mmdbNode {
+	nodes := []*mmdbNode{n}
+	for _, child := range n.child {
+		if child != nil {
+			nodes = append(nodes, child.nodes()...)
+		}
+	}
+	return nodes
+}
+
+// buildMaxMindDB writes a country database mapping each cidr to its country.
+// IPv4 networks go under ::/96 of IPv6 trees, as MaxMind does.
+func buildMaxMindDB(t *testing.T, recordSize, ipVersion uint, countries map[string]string) []byte {
+	t.Helper()
+	root := &mmdbNode{}
+	var data []byte
+	for cidr, country := range countries {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := network.Mask.Size()
+		ip := network.IP
+		if ipVersion == 6 && ip.To4() != nil {
+			ip = append(make(net.IP, 12), ip.To4()...)
+			ones += 96
+		}
+		root.insert(ip, ones, len(data))
+		data = append(data, mmdbMap(mmdbString("country"), mmdbMap(mmdbString("iso_code"), mmdbString(country)))...)
+	}
+
+	nodes := root.nodes()
+	index := map[*mmdbNode]uint{}
+	for i, n := range nodes {
+		index[n] = uint(i)
+	}
+	count := uint(len(nodes))
+	var tree []byte
+	for _, n := range nodes {
+		var records [2]uint
+		for bit := range records {
+			switch {
+			case n.child[bit] != nil:
+				records[bit] = index[n.child[bit]]
+			case n.data[bit] > 0:
+				records[bit] = count + 16 + uint(n.data[bit]-1)
+			default:
+				records[bit] = count
+			}
+		}
+		tree = append(tree, mmdbRecords(recordSize, records[0], records[1])...)
+	}
+
+	contents := append(tree, make([]byte, 16)...)
+	contents = append(contents, data...)
+	contents = append(contents, maxMindMetadataMarker...)
+	return append(contents, mmdbMap(
+		mmdbString("node_count"), mmdbUint(maxMindUint32, uint32(count)),
+		mmdbString("record_size"), mmdbUint(maxMindUint16, uint32(recordSize)),
+		mmdbString("ip_version"), mmdbUint(maxMindUint16, uint32(ipVersion)),
+		mmdbString("database_type"), mmdbString("Test-Country"),
+	)...)
+}
+
+func mmdbRecords(recordSize, left, right uint) []byte {
+	switch recordSize {
+	case 24:
+		return []byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)}
+	case 28:
+		return []byte{byte(left >> 16), byte(left >> 8), byte(left), byte(left>>24)<<4 | byte(right>>24)&0x0f, byte(right >> 16), byte(right >> 8), byte(right)}
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(left))
+	binary.BigEndian.PutUint32(b[4:], uint32(right))
+	return b
+}
+
+func mmdbString(s string) []byte {
+	return append([]byte{maxMindString<<5 | byte(len(s))}, s...)
+}
+
+func mmdbUint(kind int, n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return append([]byte{byte(kind)<<5 | 4}, b...)
+}
+
+func mmdbMap(pairs ...[]byte) []byte {
+	b := []byte{maxMindMap<<5 | byte(len(pairs)/2)}
+	for _, pair := range pairs {
+		b = append(b, pair...)
+	}
+	return b
+}
+
+func TestMaxMindDBCountry(t *testing.T) {
+	countries := map[string]string{
+		"192.0.2.0/24":    "NL",
+		"198.51.100.7/32": "FR",
+		"2001:db8::/32":   "DE",
+	}
+	lookups := []struct {
+		ip      string
+		country string
+	}{
+		{"192.0.2.1", "NL"},
+		{"192.0.2.255", "NL"},
+		{"198.51.100.7", "FR"},
+		{"198.51.100.8", ""},
+		{"203.0.113.1", ""},
+		{"2001:db8::1", "DE"},
+		{"2001:db9::1", ""},
+	}
+	for _, recordSize := range []uint{24, 28, 32} {
+		for _, ipVersion := range []uint{4, 6} {
+			db, err := ParseMaxMindDB(buildMaxMindDB(t, recordSize, ipVersion, countries))
+			if err != nil {
+				t.Fatalf("record size %d, ipv%d: %v", recordSize, ipVersion, err)
+			}
+			if db.Type != "Test-Country" || db.RecordSize != recordSize {
+				t.Errorf("metadata %+v", db)
+			}
+			for _, lookup := range lookups {
+				want := lookup.country
+				if ipVersion == 4 && strings.Contains(lookup.ip, ":") {
+					want = ""
+				}
+				country, err := db.Country(net.ParseIP(lookup.ip))
+				if err != nil {
+					t.Errorf("record size %d, ipv%d: %s: %v", recordSize, ipVersion, lookup.ip, err)
+				}
+				if country != want {
+					t.Errorf("record size %d, ipv%d: %s is in %q, want %q", recordSize, ipVersion, lookup.ip, country, want)
+				}
+			}
+		}
+	}
+}
+
+func TestMaxMindDBRecordSize28HighBits(t *testing.T) {
+	// the fourth byte holds the top bits of both records
+	db := &MaxMindDB{RecordSize: 28, tree: mmdbRecords(28, 0x0abcdef1, 0x05432101)}
+	if left, right := db.record(0, 0), db.record(0, 1); left != 0x0abcdef1 || right != 0x05432101 {
+		t.Errorf("records %x and %x", left, right)
+	}
+}
+
+func TestOpenMaxMindDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buildMaxMindDB(t, 24, 6, map[string]string{"192.0.2.0/24": "NL"}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenMaxMindDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if country, err := db.Country(net.ParseIP("192.0.2.1")); err != nil || country != "NL" {
+		t.Errorf("got %q, %v", country, err)
+	}
+	if _, err := OpenMaxMindDB(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("opened a missing file")
+	}
+}
+
+func TestMaxMindDBMalformed(t *testing.T) {
+	valid := buildMaxMindDB(t, 24, 4, map[string]string{"192.0.2.0/24": "NL"})
+	metadata := func(recordSize, ipVersion, nodeCount uint32) []byte {
+		return append(append([]byte(nil), maxMindMetadataMarker...), mmdbMap(
+			mmdbString("node_count"), mmdbUint(maxMindUint32, nodeCount),
+			mmdbString("record_size"), mmdbUint(maxMindUint16, recordSize),
+			mmdbString("ip_version"), mmdbUint(maxMindUint16, ipVersion),
+		)...)
+	}
+	cases := []struct {
+		name     string
+		contents []byte
+		want     string
+	}{
+		{"empty", nil, "metadata marker missing"},
+		{"truncated metadata", valid[:len(valid)-3], "unexpected end of data"},
+		{"metadata not a map", append(append([]byte(nil), maxMindMetadataMarker...), mmdbString("x")...), "metadata is not a map"},
+		{"record size", metadata(16, 4, 0), "unsupported record size 16"},
+		{"ip version", metadata(24, 5, 0), "unsupported ip version 5"},
+		{"tree too large", metadata(24, 4, 1000), "search tree larger than the file"},
+		{"huge map", append(append([]byte(nil), maxMindMetadataMarker...), maxMindMap<<5|29, 0xff), "entries do not fit"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := ParseMaxMindDB(c.contents)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("got %v, want %q", err, c.want)
+			}
+		})
+	}
+}
+
+func TestMaxMindDBBadData(t *testing.T) {
+	pointer := func(to byte) []byte { return []byte{maxMindPointer << 5, to} }
+	cases := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		// the record points at offset 0, the data starts with a pointer to
+		// itself
+		{"pointer to pointer", pointer(0), "points to another pointer"},
+		{"pointer chain", append(pointer(2), pointer(0)...), "points to another pointer"},
+		{"cycle through a map", append(append([]byte{maxMindMap<<5 | 1}, mmdbString("a")...), pointer(0)...), "nested more than"},
+		{"truncated", []byte{maxMindString<<5 | 10, 'a'}, "unexpected end of data"},
+		{"pointer past the end", pointer(200), "unexpected end of data"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := &MaxMindDB{NodeCount: 1, RecordSize: 24, IPVersion: 4, data: c.data}
+			// every address leads to the data at offset 0
+			db.tree = mmdbRecords(24, 17, 17)
+			_, err := db.Lookup(net.ParseIP("192.0.2.1"))
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("got %v, want %q", err, c.want)
+			}
+		})
+	}
+
+	db := &MaxMindDB{NodeCount: 1, RecordSize: 24, IPVersion: 4, tree: mmdbRecords(24, 100, 100)}
+	if _, err := db.Lookup(net.ParseIP("192.0.2.1")); err == nil || !strings.Contains(err.Error(), "outside the data section") {
+		t.Errorf("got %v for a record past the data", err)
+	}
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+type ProxyHandler struct {
+	Log logger.Log
+
+	lock    sync.RWMutex
+	router  *Router
+	access  *AccessControl
+	limiter *RateLimiter
+	limits  ServerLimitsConfig
+}
+
+func NewProxyHandler(log logger.Log, upstream string) (*ProxyHandler, error) {
+	router, err := NewRouter(upstream, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	router.SetLog(log)
+	h := &ProxyHandler{Log: log}
+	h.SetRouter(router)
+	return h, nil
+}
+
+// Requests already in flight finish against the previous router.
+func (h *ProxyHandler) SetRouter(router *Router) {
+	if router.Default != nil {
+		h.Log.Debugf("proxying to target %s", router.Default.Name)
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.router = router
+}
+
+func (h *ProxyHandler) SetAccessControl(access *AccessControl) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.access = access
+}
+
+func (h *ProxyHandler) SetRateLimiter(limiter *RateLimiter) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.limiter = limiter
+}
+
+func (h *ProxyHandler) SetLimits(limits ServerLimitsConfig) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.limits = limits
+}
+
+func (h *ProxyHandler) Router() *Router {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.router
+}
+
+func (h *ProxyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.lock.RLock()
+	router, access, limiter, limits := h.router, h.access, h.limiter, h.limits
+	h.lock.RUnlock()
+	upstream := router.Default
+	route := router.Match(req)
+	if route != nil {
+		upstream = route.Upstream
+	}
+	if route != nil && route.ResponseHeaders != nil {
+		out := rw
+		rw = &headerRulesWriter{ResponseWriter: out, apply: func(status int) {
+			if err := route.ResponseHeaders.Apply(out.Header(), newHeaderTemplateData(req, route, status)); err != nil {
+				h.Log.ErrorfContext(req.Context(), "Applying response header rules of route %s: %v", routeName(route.Config), err)
+			}
+		}}
+	}
+	if upstream == nil {
+		h.Log.DebugfContext(req.Context(), "No route for %s%s", req.Host, req.URL.Path)
+		http.NotFound(rw, req)
+		return
+	}
+	maxBody, timeout := requestLimits(limits, route)
+	limited, cancel, ok := limitRequest(rw, req, maxBody, timeout, route != nil && route.Config.Stream)
+	if !ok {
+		h.Log.DebugfContext(req.Context(), "Request body for %s%s is over %d bytes", req.Host, req.URL.Path, maxBody)
+		return
+	}
+	defer cancel()
+	req = limited
+	if access != nil && !access.Allow(rw, req, route) {
+		return
+	}
+	if limiter != nil && !limiter.Allow(rw, req, route) {
+		h.Log.DebugfContext(req.Context(), "Rate limited request for %s%s", req.Host, req.URL.Path)
+		return
+	}
+	if route != nil && route.Auth != nil {
+		authed, ok := route.Auth.Authenticate(rw, req)
+		if !ok {
+			h.Log.DebugfContext(req.Context(), "Unauthenticated request for %s%s", req.Host, req.URL.Path)
+			return
+		}
+		req = authed
+	}
+	target := upstream.Pick()
+	if target == nil {
+		h.Log.DebugfContext(req.Context(), "Upstream %s is drained", upstream.Name)
+		http.Error(rw, "upstream drained", http.StatusServiceUnavailable)
+		return
+	}
+	if info := GetRequestInfo(req.Context()); info != nil {
+		if route != nil {
+			info.Route = routeName(route.Config)
+		}
+		info.Upstream = upstream.Name
+		info.Target = target.URL.Host
+	}
+	if route != nil && route.RequestHeaders != nil {
+		req = req.Clone(req.Context())
+		if err := route.RequestHeaders.Apply(req.Header, newHeaderTemplateData(req, route, 0)); err != nil {
+			h.Log.ErrorfContext(req.Context(), "Applying request header rules of route %s: %v", routeName(route.Config), err)
+		}
+	}
+	req = withRouteMatch(req, route)
+	h.Log.DebugfContext(req.Context(), "Proxying request for %s to %s", req.URL.String(), upstream.Name)
+	target.ServeHTTP(rw, req)
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+type HeadersConfig struct {
+	Request  HeaderRulesConfig `yaml:"request"`
+	Response HeaderRulesConfig `yaml:"response"`
+}
+
+// HeaderRulesConfig are applied in order: remove, rename, set and add.
+type HeaderRulesConfig struct {
+	Remove []string `yaml:"remove"`
+	// keyed by the old name
+	Rename map[string]string `yaml:"rename"`
+	Set    map[string]string `yaml:"set"`
+	Add    map[string]string `yaml:"add"`
+}
+
+func (c HeaderRulesConfig) IsEmpty() bool {
+	return len(c.Remove) == 0 && len(c.Rename) == 0 && len(c.Set) == 0 && len(c.Add) == 0
+}
+
+type HeaderTemplateData struct {
+	ClientIP  string
+	Host      string
+	Method    string
+	Path      string
+	Scheme    string
+	Route     string
+	Upstream  string
+	RequestID string
+	User      string
+	Params    map[string]string
+	TLS       HeaderTemplateTLS
+	// 0 for request headers
+	Status int
+
+	req *http.Request
+}
+
+type HeaderTemplateTLS struct {
+	Version    string
+	Cipher     string
+	ServerName string
+	// only set for verified client certificates
+	ClientSubject     string
+	ClientIssuer      string
+	ClientSerial      string
+	ClientFingerprint string
+}
+
+func (d HeaderTemplateData) Header(name string) string {
+	return d.req.Header.Get(name)
+}
+
+func newHeaderTemplateData(req *http.Request, route *Route, status int) HeaderTemplateData {
+	data := HeaderTemplateData{
+		ClientIP: formatIP(clientIP(req)),
+		Host:     req.Host,
+		Method:   req.Method,
+		Path:     req.URL.Path,
+		Scheme:   requestProto(req),
+		Route:    routeName(route.Config),
+		Params:   route.Params(req.URL.Path),
+		Status:   status,
+		req:      req,
+	}
+	if info := GetRequestInfo(req.Context()); info != nil {
+		data.Host = info.Host
+		data.Upstream = info.Upstream
+		data.RequestID = info.RequestID
+		data.User = info.User
+	}
+	if state := req.TLS; state != nil {
+		data.TLS = HeaderTemplateTLS{
+			Version:    tls.VersionName(state.Version),
+			Cipher:     tls.CipherSuiteName(state.CipherSuite),
+			ServerName: state.ServerName,
+		}
+		if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+			cert := state.VerifiedChains[0][0]
+			sum := sha256.Sum256(cert.Raw)
+			data.TLS.ClientSubject = cert.Subject.String()
+			data.TLS.ClientIssuer = cert.Issuer.String()
+			data.TLS.ClientSerial = cert.SerialNumber.String()
+			data.TLS.ClientFingerprint = hex.EncodeToString(sum[:])
+		}
+	}
+	return data
+}
+
+type HeaderRules struct {
+	remove []string
+	rename [][2]string
+	set    []headerValue
+	add    []headerValue
+}
+
+type headerValue struct {
+	name     string
+	template *template.Template
+}
+
+func NewHeaderRules(cfg HeaderRulesConfig) (*HeaderRules, error) {
+	if cfg.IsEmpty() {
+		return nil, nil
+	}
+	rules := &HeaderRules{}
+	for _, name := range cfg.Remove {
+		rules.remove = append(rules.remove, http.CanonicalHeaderKey(name))
+	}
+	for _, from := range sortedKeys(cfg.Rename) {
+		rules.rename = append(rules.rename, [2]string{http.CanonicalHeaderKey(from), http.CanonicalHeaderKey(cfg.Rename[from])})
+	}
+	var err error
+	if rules.set, err = parseHeaderValues(cfg.Set); err != nil {
+		return nil, err
+	}
+	if rules.add, err = parseHeaderValues(cfg.Add); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func parseHeaderValues(values map[string]string) ([]headerValue, error) {
+	parsed := make([]headerValue, 0, len(values))
+	for _, name := range sortedKeys(values) {
+		tmpl, err := ParseHeaderTemplate(name, values[name])
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, headerValue{name: http.CanonicalHeaderKey(name), template: tmpl})
+	}
+	return parsed, nil
+}
+
+func ParseHeaderTemplate(name, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// execute once so references to unknown fields fail now, not per request
+	if err := tmpl.Execute(&strings.Builder{}, HeaderTemplateData{req: &http.Request{Header: http.Header{}}}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func (r *HeaderRules) Apply(header http.Header, data HeaderTemplateData) error {
+	for _, name := range r.remove {
+		header.Del(name)
+	}
+	for _, rename := range r.rename {
+		if values := header.Values(rename[0]); len(values) > 0 {
+			header.Del(rename[0])
+			header[rename[1]] = values
+		}
+	}
+	for _, value := range r.set {
+		v, err := value.execute(data)
+		if err != nil {
+			return err
+		}
+		header.Set(value.name, v)
+	}
+	for _, value := range r.add {
+		v, err := value.execute(data)
+		if err != nil {
+			return err
+		}
+		header.Add(value.name, v)
+	}
+	return nil
+}
+
+func (v headerValue) execute(data HeaderTemplateData) (string, error) {
+	var sb strings.Builder
+	if err := v.template.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	// a value must not end the header or start another
+	value := strings.NewReplacer("\r", " ", "\n", " ").Replace(sb.String())
+	if len(value) > 8<<10 {
+		return "", fmt.Errorf("header %s value longer than 8KiB", v.name)
+	}
+	return value, nil
+}
+
+// applied as the headers are written, so proxy responses are covered too
+type headerRulesWriter struct {
+	http.ResponseWriter
+	apply       func(status int)
+	wroteHeader bool
+}
+
+func (hw *headerRulesWriter) WriteHeader(status int) {
+	// informational responses are followed by the real headers
+	if !hw.wroteHeader && status >= 200 {
+		hw.wroteHeader = true
+		hw.apply(status)
+	}
+	hw.ResponseWriter.WriteHeader(status)
+}
+
+func (hw *headerRulesWriter) Write(p []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(p)
+}
+
+func (hw *headerRulesWriter) Flush() {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := hw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (hw *headerRulesWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ReadinessCheck func() error
+
+// Readiness turns not ready as soon as shutdown begins, so load balancers
+// stop routing here while in-flight requests drain.
+type Readiness struct {
+	ready int32
+
+	lock   sync.RWMutex
+	checks map[string]ReadinessCheck
+}
+
+func (r *Readiness) SetReady(ready bool) {
+	if r == nil {
+		return
+	}
+	value := int32(0)
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&r.ready, value)
+}
+
+func (r *Readiness) Ready() bool {
+	return r != nil && atomic.LoadInt32(&r.ready) == 1
+}
+
+func (r *Readiness) AddCheck(name string, check ReadinessCheck) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.checks == nil {
+		r.checks = map[string]ReadinessCheck{}
+	}
+	r.checks[name] = check
+}
+
+func (r *Readiness) Check() []string {
+	if !r.Ready() {
+		return []string{"listeners: not started or shutting down"}
+	}
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	problems := []string{}
+	for _, name := range sortedKeys(r.checks) {
+		if err := r.checks[name](); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	return problems
+}
+
+func (r *Readiness) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	if problems := r.Check(); len(problems) > 0 {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		rw.Write([]byte("not ready\n"))
+		for _, problem := range problems {
+			fmt.Fprintf(rw, "%s\n", problem)
+		}
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("ok\n"))
+}
+
+func serveLiveness(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("ok\n"))
+}
+
+func certificateCheck(certs *CertStore) ReadinessCheck {
+	return func() error {
+		leaf, err := leafCertificate(certs.Certificate())
+		if err != nil {
+			return err
+		}
+		if time.Now().After(leaf.NotAfter) {
+			return fmt.Errorf("certificate %s expired at %s", leaf.Subject, leaf.NotAfter)
+		}
+		return nil
+	}
+}
+
+func upstreamCheck(handler *ProxyHandler) ReadinessCheck {
+	return func() error {
+		pools := handler.Router().Pools()
+		names := make([]string, 0, len(pools))
+		for _, pool := range pools {
+			if pool.Healthy() {
+				return nil
+			}
+			names = append(names, pool.Name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("no healthy upstream among %v", names)
+	}
+}
+
+func withHealth(cfg HealthConfig, readiness *Readiness, next http.Handler) http.Handler {
+	if len(cfg.LivenessPath) == 0 && (len(cfg.ReadinessPath) == 0 || readiness == nil) {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case len(cfg.LivenessPath) > 0 && req.URL.Path == cfg.LivenessPath:
+			serveLiveness(rw, req)
+		case len(cfg.ReadinessPath) > 0 && req.URL.Path == cfg.ReadinessPath && readiness != nil:
+			readiness.ServeHTTP(rw, req)
+		default:
+			next.ServeHTTP(rw, req)
+		}
+	})
+}
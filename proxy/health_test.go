@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+func probe(handler http.Handler, path string) (int, string) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code, rec.Body.String()
+}
+
+func TestHealthProbes(t *testing.T) {
+	readiness := &Readiness{}
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusTeapot)
+	})
+	handler := withHealth(HealthConfig{LivenessPath: "/livez", ReadinessPath: "/readyz"}, readiness, next)
+
+	if code, body := probe(handler, "/livez"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("liveness before starting returned %d %q", code, body)
+	}
+	if code, body := probe(handler, "/readyz"); code != http.StatusServiceUnavailable || body != "not ready\nlisteners: not started or shutting down\n" {
+		t.Errorf("readiness before starting returned %d %q", code, body)
+	}
+	readiness.SetReady(true)
+	if code, body := probe(handler, "/readyz"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("readiness once started returned %d %q", code, body)
+	}
+	if code, _ := probe(handler, "/readyz/more"); code != http.StatusTeapot {
+		t.Errorf("other paths returned %d, want them proxied", code)
+	}
+
+	// probes pass straight through when no paths are configured
+	if code, _ := probe(withHealth(HealthConfig{}, readiness, next), "/readyz"); code != http.StatusTeapot {
+		t.Errorf("unconfigured readiness path returned %d", code)
+	}
+}
+
+func TestReadinessChecks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+	handler, err := NewProxyHandler(logger.None(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter("", []UpstreamConfig{{Name: "web", Targets: []string{upstream.URL}}, {Name: "api", Targets: []string{upstream.URL}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drains := NewDrains()
+	router.SetDrains(drains)
+	handler.SetRouter(router)
+
+	certs := &CertStore{}
+	certs.Set(&tls.Certificate{
+		Certificate: [][]byte{{0}},
+		Leaf:        &x509.Certificate{Subject: pkix.Name{CommonName: "example.com"}, NotAfter: time.Now().Add(time.Hour)},
+	})
+	readiness := &Readiness{}
+	readiness.AddCheck("upstreams", upstreamCheck(handler))
+	readiness.AddCheck("certificate", certificateCheck(certs))
+	readiness.SetReady(true)
+	if problems := readiness.Check(); len(problems) != 0 {
+		t.Fatalf("healthy proxy has problems %q", problems)
+	}
+
+	// one healthy upstream is enough
+	drains.Drain("web", "")
+	if problems := readiness.Check(); len(problems) != 0 {
+		t.Errorf("one drained upstream made the proxy not ready: %q", problems)
+	}
+	drains.Drain("api", "")
+	certs.Set(&tls.Certificate{
+		Certificate: [][]byte{{0}},
+		Leaf:        &x509.Certificate{Subject: pkix.Name{CommonName: "example.com"}, NotAfter: time.Now().Add(-time.Hour)},
+	})
+	code, body := probe(readiness, "/")
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("readiness returned %d", code)
+	}
+	want := "not ready\ncertificate: certificate CN=example.com expired at "
+	if len(body) < len(want) || body[:len(want)] != want {
+		t.Errorf("readiness reported %q", body)
+	}
+	if problems := readiness.Check(); len(problems) != 2 || problems[1] != "upstreams: no healthy upstream among [api web]" {
+		t.Errorf("problems are %q", problems)
+	}
+
+	readiness.SetReady(false)
+	if problems := readiness.Check(); len(problems) != 1 {
+		t.Errorf("shutting down reported %q, want only the listeners", problems)
+	}
+}
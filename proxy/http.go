@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+type HTTPServer struct {
+	Log             logger.Log
+	Config          HTTPConfig
+	Server          *http.Server
+	Handler         *ProxyHandler
+	Listener        net.Listener
+	Conns           *ConnTracker
+	ShutdownTimeout time.Duration
+
+	listener rebindableListener
+}
+
+func NewHTTPServer(log logger.Log, cfg HTTPConfig) (*HTTPServer, error) {
+	handler, err := NewProxyHandler(log, cfg.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	h := &HTTPServer{
+		Config:  cfg,
+		Log:     log,
+		Handler: handler,
+		Conns:   NewConnTracker(),
+	}
+	serv := &http.Server{
+		Addr:    BindAddr(cfg.Port),
+		Handler: handler,
+	}
+	cfg.Limits.Apply(serv)
+	handler.SetLimits(cfg.Limits)
+	h.Conns.Install(serv)
+	h.Server = serv
+	return h, nil
+}
+
+func (h *HTTPServer) Rebind(l net.Listener) {
+	h.Log.Infof("Moving HTTP Server to %s", l.Addr())
+	h.Listener = l
+	h.listener.rebind(l)
+}
+
+func (h *HTTPServer) Start() error {
+	if h.Listener == nil {
+		l, err := net.Listen("tcp", h.Server.Addr)
+		if err != nil {
+			return err
+		}
+		h.Listener = l
+	}
+	h.listener.set(h.Listener)
+	h.Log.Infof("Starting HTTP Server on %s", h.Listener.Addr())
+	return h.listener.serve(h.Server.Serve)
+}
+
+func (h *HTTPServer) Stop() error {
+	return shutdownServer(h.Log, "HTTP", h.Server, h.Conns, h.ShutdownTimeout)
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+func TestPlainHTTPWithoutTLS(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("upstream " + req.URL.Path))
+	}))
+	defer upstream.Close()
+
+	disabled := false
+	cfg := ConfigOrDefault(Config{
+		TLS:  TLSConfig{Enabled: &disabled},
+		HTTP: HTTPConfig{Enabled: true, Upstream: upstream.URL},
+	})
+	cfg.HTTP.Port = 0
+	p := &Proxy{Config: cfg, Log: logger.None(), Readiness: &Readiness{}}
+	toRun, err := p.buildServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeListeners(p.Listeners)
+	if len(toRun) != 1 || p.TLSServer != nil || p.RedirectServer != nil {
+		t.Fatalf("built %d servers, tls %v and redirect %v, want only http", len(toRun), p.TLSServer, p.RedirectServer)
+	}
+	httpServer, ok := p.HTTPServer.(*HTTPServer)
+	if !ok || httpServer.Listener == nil {
+		t.Fatalf("http server %v is not listening", p.HTTPServer)
+	}
+
+	rec := httptest.NewRecorder()
+	httpServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/items", nil))
+	if body, _ := io.ReadAll(rec.Body); string(body) != "upstream /items" {
+		t.Errorf("plain http proxied %d %q", rec.Code, body)
+	}
+}
+
+func TestNoServersEnabled(t *testing.T) {
+	disabled := false
+	p := &Proxy{Config: ConfigOrDefault(Config{TLS: TLSConfig{Enabled: &disabled}}), Log: logger.None(), Readiness: &Readiness{}}
+	if _, err := p.buildServers(); err == nil || !strings.Contains(err.Error(), "no servers enabled") {
+		t.Fatalf("got %v, want no servers enabled", err)
+	}
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var fragmentKeys = map[string]bool{
+	"include":   true,
+	"upstreams": true,
+	"routes":    true,
+}
+
+type configLoader struct {
+	sources []string
+	loading map[string]bool
+	loaded  map[string]bool
+	lines   map[string]location
+	errs    ValidationErrors
+}
+
+func newConfigLoader() *configLoader {
+	return &configLoader{
+		loading: map[string]bool{},
+		loaded:  map[string]bool{},
+		lines:   map[string]location{},
+	}
+}
+
+func (l *configLoader) load(file string, cfg *Config, main bool) error {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	if l.loaded[abs] {
+		return nil
+	}
+	l.loaded[abs] = true
+	l.sources = append(l.sources, file)
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var fragment Config
+	decodeErrs, keyLines, err := decodeConfig(ConfigFormat(file), data, &fragment)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	for _, ve := range decodeErrs {
+		ve.File = file
+		l.errs = append(l.errs, ve)
+	}
+	lines := fileLines(file, keyLines)
+	// formats without line numbers still locate list items by file
+	for i := range fragment.Upstreams {
+		if _, ok := lines[fmt.Sprintf("upstreams[%d]", i)]; !ok {
+			lines[fmt.Sprintf("upstreams[%d]", i)] = location{File: file}
+		}
+	}
+	for i := range fragment.Routes {
+		if _, ok := lines[fmt.Sprintf("routes[%d]", i)]; !ok {
+			lines[fmt.Sprintf("routes[%d]", i)] = location{File: file}
+		}
+	}
+
+	if main {
+		*cfg = fragment
+		for key, loc := range lines {
+			l.lines[key] = loc
+		}
+	} else {
+		l.merge(file, cfg, fragment, lines)
+	}
+
+	l.loading[abs] = true
+	defer delete(l.loading, abs)
+	dir := filepath.Dir(file)
+	for i, pattern := range fragment.Include {
+		field := fmt.Sprintf("include[%d]", i)
+		loc := locate(lines, field)
+		files, err := l.expand(dir, pattern)
+		if err != nil {
+			l.errs = append(l.errs, ValidationError{File: file, Line: loc.Line, Field: field, Message: err.Error()})
+			continue
+		}
+		for _, included := range files {
+			includedAbs, err := filepath.Abs(included)
+			if err != nil {
+				return err
+			}
+			if l.loading[includedAbs] {
+				l.errs = append(l.errs, ValidationError{File: file, Line: loc.Line, Field: field, Message: fmt.Sprintf("%s is already being included, include cycle", included)})
+				continue
+			}
+			if err := l.load(included, cfg, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// conflicts between files are left to validation, which reports where each
+// entry was declared
+func (l *configLoader) merge(file string, cfg *Config, fragment Config, lines map[string]location) {
+	v := reflect.ValueOf(fragment)
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := yamlKey(t.Field(i))
+		if !t.Field(i).IsExported() || key == "-" || fragmentKeys[key] || v.Field(i).IsZero() {
+			continue
+		}
+		loc := locate(lines, key)
+		l.errs = append(l.errs, ValidationError{
+			File:    file,
+			Line:    loc.Line,
+			Field:   key,
+			Message: "can only be set in the main config file, included files may only set include, upstreams and routes",
+		})
+	}
+
+	upstreamOffset, routeOffset := len(cfg.Upstreams), len(cfg.Routes)
+	cfg.Upstreams = append(cfg.Upstreams, fragment.Upstreams...)
+	cfg.Routes = append(cfg.Routes, fragment.Routes...)
+	for key, loc := range lines {
+		if rebased, ok := rebaseIndex(key, "upstreams", upstreamOffset); ok {
+			l.lines[rebased] = loc
+		} else if rebased, ok := rebaseIndex(key, "routes", routeOffset); ok {
+			l.lines[rebased] = loc
+		}
+	}
+}
+
+// directories and globs may match nothing, so an empty conf.d is fine
+func (l *configLoader) expand(dir, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	info, err := os.Stat(pattern)
+	if err == nil && info.IsDir() {
+		l.sources = append(l.sources, pattern)
+		entries, err := os.ReadDir(pattern)
+		if err != nil {
+			return nil, err
+		}
+		files := []string{}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || strings.HasPrefix(name, ".") || !isConfigFile(name) {
+				continue
+			}
+			files = append(files, filepath.Join(pattern, name))
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		if err != nil {
+			return nil, err
+		}
+		return []string{pattern}, nil
+	}
+	l.sources = append(l.sources, filepath.Dir(pattern))
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern %q: %w", pattern, err)
+	}
+	return files, nil
+}
+
+func isConfigFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json", ".toml":
+		return true
+	default:
+		return false
+	}
+}
+
+func rebaseIndex(key, section string, offset int) (string, bool) {
+	prefix := section + "["
+	if !strings.HasPrefix(key, prefix) {
+		return "", false
+	}
+	end := strings.Index(key, "]")
+	index, err := strconv.Atoi(key[len(prefix):end])
+	if err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%s[%d]%s", section, index+offset, key[end+1:]), true
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Metrics reads the servers, trackers and handlers registered with it on
+// every scrape.
+type Metrics struct {
+	Registry *Registry
+
+	requests          *CounterVec
+	duration          *HistogramVec
+	bytesIn           *CounterVec
+	bytesOut          *CounterVec
+	handshakes        *CounterVec
+	handshakeFailures *CounterVec
+	redirects         *CounterVec
+
+	lock     sync.Mutex
+	conns    map[string]*ConnTracker
+	handlers map[string]*ProxyHandler
+	certs    map[string]*CertStore
+	// hellos holds the highest version offered by each connection still
+	// handshaking, keyed by its underlying net.Conn
+	hellos sync.Map
+}
+
+func NewMetrics() *Metrics {
+	r := NewRegistry()
+	m := &Metrics{
+		Registry: r,
+		conns:    map[string]*ConnTracker{},
+		handlers: map[string]*ProxyHandler{},
+		certs:    map[string]*CertStore{},
+	}
+	m.requests = r.NewCounterVec("proxy_requests_total", "Requests handled, by server, route, upstream and status code.", "server", "route", "upstream", "code")
+	m.duration = r.NewHistogramVec("proxy_request_duration_seconds", "Time to handle requests, including the upstream.", DefaultBuckets, "server", "route", "upstream")
+	m.bytesIn = r.NewCounterVec("proxy_request_bytes_total", "Bytes read from request bodies.", "server")
+	m.bytesOut = r.NewCounterVec("proxy_response_bytes_total", "Bytes written to response bodies.", "server")
+	m.redirects = r.NewCounterVec("proxy_redirects_total", "Redirects answered by the proxy itself, by server and status code.", "server", "code")
+	r.NewGaugeFunc("proxy_active_connections", "Open client connections.", m.collectConns, "server")
+	m.handshakes = r.NewCounterVec("proxy_tls_handshakes_total", "Completed TLS handshakes, by negotiated version and cipher suite.", "server", "version", "cipher")
+	m.handshakeFailures = r.NewCounterVec("proxy_tls_handshake_failures_total", "Connections closed before completing a TLS handshake, by the highest version the client offered.", "server", "version")
+	r.NewGaugeFunc("proxy_tls_certificate_expiry_timestamp_seconds", "Unix time the serving certificate expires.", m.collectCerts, "server", "subject")
+	r.NewGaugeFunc("proxy_upstream_healthy", "Whether the last request to an upstream target got a response.", m.collectUpstreams, "server", "upstream", "target")
+	return m
+}
+
+// Handler leaves the route and upstream labels to the ProxyHandler.
+func (m *Metrics) Handler(server string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req, info := withRequestInfo(req, server)
+		body := &bodyCounter{ReadCloser: req.Body}
+		req.Body = body
+		rec := &responseRecorder{ResponseWriter: rw}
+		next.ServeHTTP(rec, req)
+
+		status := rec.Status()
+		code := strconv.Itoa(status)
+		m.requests.Inc(server, info.Route, info.Upstream, code)
+		m.duration.Observe(time.Since(info.Start).Seconds(), server, info.Route, info.Upstream)
+		m.bytesIn.Add(float64(body.read), server)
+		m.bytesOut.Add(float64(rec.written), server)
+		if len(info.Upstream) == 0 && status >= 300 && status < 400 {
+			m.redirects.Inc(server, code)
+		}
+	})
+}
+
+func (m *Metrics) TrackConns(server string, conns *ConnTracker) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.conns[server] = conns
+}
+
+func (m *Metrics) TrackUpstreams(server string, handler *ProxyHandler) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.handlers[server] = handler
+}
+
+// InstrumentTLS chains onto the server's hooks, so it is installed after the
+// ConnTracker.
+func (m *Metrics) InstrumentTLS(server string, s *http.Server, certs *CertStore) {
+	m.lock.Lock()
+	m.certs[server] = certs
+	m.lock.Unlock()
+
+	cfg := s.TLSConfig
+	getConfig, verify := cfg.GetConfigForClient, cfg.VerifyConnection
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		offered := uint16(0)
+		for _, version := range hello.SupportedVersions {
+			if version > offered {
+				offered = version
+			}
+		}
+		m.hellos.Store(hello.Conn, offered)
+		if getConfig != nil {
+			return getConfig(hello)
+		}
+		return nil, nil
+	}
+	cfg.VerifyConnection = func(state tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(state); err != nil {
+				return err
+			}
+		}
+		m.handshakes.Inc(server, tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+		return nil
+	}
+
+	connState := s.ConnState
+	s.ConnState = func(c net.Conn, state http.ConnState) {
+		if tc, ok := c.(*tls.Conn); ok && state == http.StateClosed {
+			offered, seen := m.hellos.LoadAndDelete(tc.NetConn())
+			if !tc.ConnectionState().HandshakeComplete {
+				version := "none"
+				if seen {
+					version = tls.VersionName(offered.(uint16))
+				}
+				m.handshakeFailures.Inc(server, version)
+			}
+		}
+		if connState != nil {
+			connState(c, state)
+		}
+	}
+}
+
+func (m *Metrics) collectConns(set func(float64, ...string)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for server, conns := range m.conns {
+		set(float64(conns.Active()), server)
+	}
+}
+
+func (m *Metrics) collectUpstreams(set func(float64, ...string)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for server, handler := range m.handlers {
+		for _, pool := range handler.Router().Pools() {
+			for _, target := range pool.Targets {
+				healthy := 0.0
+				if target.Healthy() {
+					healthy = 1
+				}
+				set(healthy, server, pool.Name, target.URL.Host)
+			}
+		}
+	}
+}
+
+func (m *Metrics) collectCerts(set func(float64, ...string)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for server, certs := range m.certs {
+		leaf, err := leafCertificate(certs.Certificate())
+		if err != nil {
+			continue
+		}
+		set(float64(leaf.NotAfter.Unix()), server, leaf.Subject.String())
+	}
+}
+
+func leafCertificate(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil, fmt.Errorf("no certificate loaded")
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
@@ -0,0 +1,403 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JWTAuthConfig struct {
+	JWKSURL       string            `yaml:"jwksURL"`
+	KeyFiles      []string          `yaml:"keyFiles"`
+	Secret        string            `yaml:"secret" secret:"true"`
+	Issuer        string            `yaml:"issuer"`
+	Audience      []string          `yaml:"audience"`
+	Claims        map[string]string `yaml:"claims"`
+	ForwardClaims map[string]string `yaml:"forwardClaims"`
+	ClockSkew     Duration          `yaml:"clockSkew"`
+	// tokens signed by an unknown key id refetch the set sooner
+	JWKSRefresh Duration `yaml:"jwksRefresh"`
+}
+
+const jwksMinRefresh = 30 * time.Second
+
+type JWTAuth struct {
+	Config JWTAuthConfig
+	Client *http.Client
+
+	static []jwtKey
+
+	lock    sync.Mutex
+	jwks    []jwtKey
+	fetched time.Time
+}
+
+type jwtKey struct {
+	id  string
+	key interface{}
+}
+
+func NewJWTAuth(cfg JWTAuthConfig) (*JWTAuth, error) {
+	if cfg.ClockSkew == 0 {
+		cfg.ClockSkew = Duration(time.Minute)
+	}
+	if cfg.JWKSRefresh == 0 {
+		cfg.JWKSRefresh = Duration(time.Hour)
+	}
+	j := &JWTAuth{Config: cfg, Client: &http.Client{Timeout: 10 * time.Second}}
+	for _, file := range cfg.KeyFiles {
+		key, err := readPublicKey(file)
+		if err != nil {
+			return nil, err
+		}
+		j.static = append(j.static, jwtKey{key: key})
+	}
+	if len(cfg.Secret) > 0 {
+		j.static = append(j.static, jwtKey{key: []byte(cfg.Secret)})
+	}
+	return j, nil
+}
+
+func readPublicKey(file string) (interface{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", file)
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		return cert.PublicKey, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return key, nil
+}
+
+func (j *JWTAuth) Authenticate(rw http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		rw.Header().Set("WWW-Authenticate", `Bearer`)
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	claims, err := j.Verify(strings.TrimSpace(token), time.Now())
+	if err != nil {
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=\"invalid_token\", error_description=%q", err.Error()))
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	req = req.Clone(req.Context())
+	req.Header.Del(ForwardedUserHeader)
+	if sub, ok := claims["sub"].(string); ok {
+		setUser(req, sub)
+		req.Header.Set(ForwardedUserHeader, sub)
+	}
+	for _, claim := range sortedKeys(j.Config.ForwardClaims) {
+		header := j.Config.ForwardClaims[claim]
+		req.Header.Del(header)
+		if value, ok := claims[claim]; ok {
+			req.Header.Set(header, claimString(value))
+		}
+	}
+	return req, true
+}
+
+func (j *JWTAuth) Verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature")
+	}
+	if !j.verifySignature(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims")
+	}
+	return claims, j.checkClaims(claims, now)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+func (j *JWTAuth) verifySignature(alg, kid string, signed, signature []byte) bool {
+	keys := j.keys(kid)
+	for _, key := range keys {
+		if (len(kid) == 0 || len(key.id) == 0 || key.id == kid) && verifyJWS(alg, key.key, signed, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *JWTAuth) keys(kid string) []jwtKey {
+	if len(j.Config.JWKSURL) == 0 {
+		return j.static
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	since := time.Since(j.fetched)
+	stale := since > j.Config.JWKSRefresh.Duration()
+	if !stale && len(kid) > 0 && since > jwksMinRefresh {
+		stale = true
+		for _, key := range j.jwks {
+			if key.id == kid {
+				stale = false
+			}
+		}
+	}
+	if stale {
+		// on failure the previous keys are kept until the next attempt
+		j.fetched = time.Now()
+		if keys, err := j.fetchJWKS(); err == nil {
+			j.jwks = keys
+		}
+	}
+	return append(append([]jwtKey{}, j.static...), j.jwks...)
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (j *JWTAuth) fetchJWKS() ([]jwtKey, error) {
+	res, err := j.Client.Get(j.Config.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", j.Config.JWKSURL, res.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := []jwtKey{}
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		// keys of unsupported types are skipped, others in the set still work
+		if key, err := k.publicKey(); err == nil {
+			keys = append(keys, jwtKey{id: k.Kid, key: key})
+		}
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// the algorithm must suit the key type, so a public key is never used as an
+// HMAC secret
+func verifyJWS(alg string, key interface{}, signed, signature []byte) bool {
+	hashes := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}
+	if alg == "EdDSA" {
+		k, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(k, signed, signature)
+	}
+	if len(alg) != 5 {
+		return false
+	}
+	hash, ok := hashes[alg[2:]]
+	if !ok {
+		return false
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS":
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+	case "PS":
+		k, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(k, hash, digest, signature, nil) == nil
+	case "ES":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	}
+	return false
+}
+
+func (j *JWTAuth) checkClaims(claims map[string]interface{}, now time.Time) error {
+	skew := j.Config.ClockSkew.Duration()
+	if exp, ok := claimTime(claims["exp"]); ok && now.After(exp.Add(skew)) {
+		return fmt.Errorf("token expired")
+	}
+	if nbf, ok := claimTime(claims["nbf"]); ok && now.Add(skew).Before(nbf) {
+		return fmt.Errorf("token not valid yet")
+	}
+	if len(j.Config.Issuer) > 0 && claims["iss"] != j.Config.Issuer {
+		return fmt.Errorf("unexpected issuer")
+	}
+	if len(j.Config.Audience) > 0 && !claimIncludesAny(claims["aud"], j.Config.Audience) {
+		return fmt.Errorf("unexpected audience")
+	}
+	for _, name := range sortedKeys(j.Config.Claims) {
+		if !claimIncludesAny(claims[name], []string{j.Config.Claims[name]}) {
+			return fmt.Errorf("claim %s does not match", name)
+		}
+	}
+	return nil
+}
+
+func claimTime(value interface{}) (time.Time, bool) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second))), true
+}
+
+func claimIncludesAny(claim interface{}, wanted []string) bool {
+	values := []interface{}{claim}
+	if list, ok := claim.([]interface{}); ok {
+		values = list
+	}
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		for _, w := range wanted {
+			if claimString(value) == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			parts = append(parts, claimString(item))
+		}
+		return strings.Join(parts, ",")
+	case map[string]interface{}:
+		data, _ := json.Marshal(v)
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
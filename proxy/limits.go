@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+type ServerLimitsConfig struct {
+	ReadHeaderTimeout Duration `yaml:"readHeaderTimeout"`
+	// upgraded connections and streaming routes are not bound by ReadTimeout
+	ReadTimeout Duration `yaml:"readTimeout"`
+	// off by default as it would cut off streams and websockets
+	WriteTimeout   Duration `yaml:"writeTimeout"`
+	IdleTimeout    Duration `yaml:"idleTimeout"`
+	MaxHeaderBytes int      `yaml:"maxHeaderBytes"`
+
+	// only the tls and http servers apply MaxBodyBytes and RequestTimeout,
+	// a negative value turns a limit off
+	MaxBodyBytes   int64    `yaml:"maxBodyBytes"`
+	RequestTimeout Duration `yaml:"requestTimeout"`
+}
+
+var DefaultServerLimits = ServerLimitsConfig{
+	ReadHeaderTimeout: Duration(10 * time.Second),
+	ReadTimeout:       Duration(time.Minute),
+	IdleTimeout:       Duration(2 * time.Minute),
+	MaxHeaderBytes:    64 << 10,
+	MaxBodyBytes:      64 << 20,
+	RequestTimeout:    Duration(5 * time.Minute),
+}
+
+const DefaultResponseHeaderTimeout = time.Minute
+
+func (c ServerLimitsConfig) OrDefault() ServerLimitsConfig {
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = DefaultServerLimits.ReadHeaderTimeout
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = DefaultServerLimits.ReadTimeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = DefaultServerLimits.IdleTimeout
+	}
+	if c.MaxHeaderBytes == 0 {
+		c.MaxHeaderBytes = DefaultServerLimits.MaxHeaderBytes
+	}
+	return c
+}
+
+func (c ServerLimitsConfig) ProxyOrDefault() ServerLimitsConfig {
+	c = c.OrDefault()
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = DefaultServerLimits.MaxBodyBytes
+	}
+	if c.RequestTimeout == 0 {
+		c.RequestTimeout = DefaultServerLimits.RequestTimeout
+	}
+	return c
+}
+
+func (c ServerLimitsConfig) ServerOnly() ServerLimitsConfig {
+	c.MaxBodyBytes, c.RequestTimeout = 0, 0
+	return c
+}
+
+// the http.Server's limits cannot change while it serves, only the request
+// limits apply on reload
+func mergeServerLimits(running, next ServerLimitsConfig) ServerLimitsConfig {
+	running.MaxBodyBytes, running.RequestTimeout = next.MaxBodyBytes, next.RequestTimeout
+	return running
+}
+
+func (c ServerLimitsConfig) Apply(server *http.Server) {
+	server.ReadHeaderTimeout = c.ReadHeaderTimeout.Duration()
+	server.ReadTimeout = c.ReadTimeout.Duration()
+	server.WriteTimeout = c.WriteTimeout.Duration()
+	server.IdleTimeout = c.IdleTimeout.Duration()
+	server.MaxHeaderBytes = c.MaxHeaderBytes
+}
+
+// a negative route body limit or a streaming route lifts the server's
+func requestLimits(limits ServerLimitsConfig, route *Route) (int64, time.Duration) {
+	maxBody, timeout := limits.MaxBodyBytes, limits.RequestTimeout.Duration()
+	if route != nil {
+		if route.Config.Stream {
+			maxBody, timeout = 0, 0
+		}
+		if route.Config.MaxBodyBytes != 0 {
+			maxBody = route.Config.MaxBodyBytes
+		}
+		if route.Config.Timeout != 0 {
+			timeout = route.Config.Timeout.Duration()
+		}
+	}
+	return maxBody, timeout
+}
+
+// Upgrade requests get no deadline as it would end the upgraded connection.
+func limitRequest(rw http.ResponseWriter, req *http.Request, maxBody int64, timeout time.Duration, stream bool) (*http.Request, context.CancelFunc, bool) {
+	if maxBody > 0 && req.Body != http.NoBody {
+		if req.ContentLength > maxBody {
+			http.Error(rw, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return nil, nil, false
+		}
+		req = req.Clone(req.Context())
+		req.Body = http.MaxBytesReader(rw, req.Body, maxBody)
+	}
+	upgrade := len(req.Header.Get("Upgrade")) > 0
+	if upgrade || stream {
+		// not every writer supports it, the server's timeout applies then
+		http.NewResponseController(rw).SetReadDeadline(time.Time{})
+	}
+	if timeout > 0 && !upgrade {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		return req.WithContext(ctx), cancel, true
+	}
+	return req, func() {}, true
+}
+
+func upstreamErrorStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
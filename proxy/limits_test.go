@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+func TestServerLimitsDefaults(t *testing.T) {
+	cfg := ConfigOrDefault(Config{})
+	for name, limits := range map[string]ServerLimitsConfig{"tls": cfg.TLS.Limits, "http": cfg.HTTP.Limits} {
+		if limits.ReadTimeout <= 0 || limits.MaxBodyBytes <= 0 || limits.RequestTimeout <= 0 {
+			t.Errorf("%s limits %+v are not all finite", name, limits)
+		}
+	}
+	if limits := cfg.Admin.Limits; limits.ReadTimeout <= 0 || limits.MaxBodyBytes != 0 || limits.RequestTimeout != 0 {
+		t.Errorf("admin limits %+v", limits)
+	}
+	if err := Validate(Config{TLS: TLSConfig{Limits: ServerLimitsConfig{MaxBodyBytes: -1, RequestTimeout: -1, ReadTimeout: -1}}}); err != nil && strings.Contains(err.Error(), "limits") {
+		t.Errorf("turning limits off was rejected: %v", err)
+	}
+
+	limits := cfg.TLS.Limits
+	cases := []struct {
+		name    string
+		route   *Route
+		maxBody int64
+		timeout time.Duration
+	}{
+		{"no route", nil, limits.MaxBodyBytes, limits.RequestTimeout.Duration()},
+		{"route", &Route{Config: RouteConfig{MaxBodyBytes: 10, Timeout: Duration(time.Second)}}, 10, time.Second},
+		{"stream", &Route{Config: RouteConfig{Stream: true}}, 0, 0},
+		{"stream with its own limits", &Route{Config: RouteConfig{Stream: true, MaxBodyBytes: 10, Timeout: Duration(time.Second)}}, 10, time.Second},
+	}
+	for _, c := range cases {
+		if maxBody, timeout := requestLimits(limits, c.route); maxBody != c.maxBody || timeout != c.timeout {
+			t.Errorf("%s: got %d and %v, want %d and %v", c.name, maxBody, timeout, c.maxBody, c.timeout)
+		}
+	}
+}
+
+// slowBody sends its chunks with a pause before each.
+type slowBody struct {
+	chunks int
+	pause  time.Duration
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if b.chunks == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(b.pause)
+	b.chunks--
+	return copy(p, "chunk"), nil
+}
+
+func TestStreamRouteReadTimeout(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		n, err := io.Copy(io.Discard, req.Body)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rw.Write([]byte(strconv.FormatInt(n, 10)))
+	}))
+	defer upstream.Close()
+
+	handler, err := NewProxyHandler(logger.None(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter("", []UpstreamConfig{{Name: "api", Targets: []string{upstream.URL}}}, []RouteConfig{
+		{Name: "upload", Path: "/upload", Upstream: "api"},
+		{Name: "stream", Path: "/stream", Upstream: "api", Stream: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.SetRouter(router)
+	limits := ServerLimitsConfig{ReadTimeout: Duration(100 * time.Millisecond)}.ProxyOrDefault()
+	handler.SetLimits(limits)
+	server := httptest.NewUnstartedServer(handler)
+	limits.Apply(server.Config)
+	server.Start()
+	defer server.Close()
+
+	post := func(path string) (int, string) {
+		res, err := http.Post(server.URL+path, "text/plain", &slowBody{chunks: 5, pause: 50 * time.Millisecond})
+		if err != nil {
+			return 0, err.Error()
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	if code, body := post("/stream"); code != http.StatusOK || body != "25" {
+		t.Errorf("streaming route returned %d %q", code, body)
+	}
+	if code, body := post("/upload"); code == http.StatusOK {
+		t.Errorf("slow upload outlived the read timeout: %q", body)
+	}
+}
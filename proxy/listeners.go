@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// ListenFdsStart is the first file descriptor passed by systemd socket activation
+	ListenFdsStart = 3
+
+	EnvListenPID     = "LISTEN_PID"
+	EnvListenFDs     = "LISTEN_FDS"
+	EnvListenFDNames = "LISTEN_FDNAMES"
+)
+
+// Unnamed sockets are keyed by their fd number. The activation environment is
+// cleared so it does not leak into child processes.
+func InheritedListeners() (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv(EnvListenPID)
+		os.Unsetenv(EnvListenFDs)
+		os.Unsetenv(EnvListenFDNames)
+	}()
+
+	listeners := map[string]net.Listener{}
+	pid := os.Getenv(EnvListenPID)
+	if len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		// meant for another process
+		return listeners, nil
+	}
+	fds := os.Getenv(EnvListenFDs)
+	if len(fds) == 0 {
+		return listeners, nil
+	}
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid %s %q", EnvListenFDs, fds)
+	}
+
+	var names []string
+	if raw := os.Getenv(EnvListenFDNames); len(raw) > 0 {
+		names = strings.Split(raw, ":")
+	}
+
+	for i := 0; i < count; i++ {
+		fd := ListenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := strconv.Itoa(fd)
+		if i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+		if _, ok := listeners[name]; ok {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("duplicate inherited listener name %q", name)
+		}
+		file := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("inherited fd %d (%s): %w", fd, name, err)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
+
+func Listen(inherited map[string]net.Listener, name string, port uint16) (net.Listener, error) {
+	if l, ok := inherited[name]; ok && l != nil {
+		return l, nil
+	}
+	return net.Listen("tcp", BindAddr(port))
+}
+
+func closeListeners(listeners map[string]net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
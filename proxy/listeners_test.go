@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+const envListenersChild = "TLS_PROXY_TEST_LISTENERS_CHILD"
+
+// TestInheritedListeners passes two sockets to a copy of the test binary as
+// systemd would, which checks it finds them by name.
+func TestInheritedListeners(t *testing.T) {
+	if os.Getenv(envListenersChild) == "1" {
+		inheritedListenersChild(t)
+		return
+	}
+
+	files := []*os.File{}
+	addrs := []string{}
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		file, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		files = append(files, file)
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestInheritedListeners$", "-test.v")
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		envListenersChild+"=1",
+		EnvListenFDs+"=2",
+		EnvListenFDNames+"=tls:redirect",
+		"TLS_PROXY_TEST_TLS_ADDR="+addrs[0],
+		"TLS_PROXY_TEST_REDIRECT_ADDR="+addrs[1],
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("child failed: %v\n%s", err, out)
+	}
+}
+
+func inheritedListenersChild(t *testing.T) {
+	want := map[string]string{
+		"tls":      os.Getenv("TLS_PROXY_TEST_TLS_ADDR"),
+		"redirect": os.Getenv("TLS_PROXY_TEST_REDIRECT_ADDR"),
+	}
+	listeners, err := InheritedListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeListeners(listeners)
+	if len(listeners) != len(want) {
+		t.Fatalf("got %d listeners, want %d", len(listeners), len(want))
+	}
+	for name, addr := range want {
+		l, err := Listen(listeners, name, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Addr().String() != addr {
+			t.Errorf("%s listener is on %s, want %s", name, l.Addr(), addr)
+		}
+	}
+	if len(os.Getenv(EnvListenFDs)) > 0 || len(os.Getenv(EnvListenFDNames)) > 0 {
+		t.Errorf("activation environment was not cleared")
+	}
+
+	fresh, err := Listen(listeners, "http", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	for _, l := range listeners {
+		if l.Addr().String() == fresh.Addr().String() {
+			t.Errorf("unnamed listener reused inherited %s", l.Addr())
+		}
+	}
+}
+
+func TestInheritedListenersOtherPID(t *testing.T) {
+	t.Setenv(EnvListenPID, "1")
+	t.Setenv(EnvListenFDs, "2")
+	listeners, err := InheritedListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 0 {
+		t.Fatalf("took %d listeners meant for another process", len(listeners))
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+var logFilterFlags = []string{logger.Info, logger.Debug, logger.Warning, logger.Error, logger.Fatal}
+
+// LogFlags switches log flags while requests are logging. The logger reads
+// its own flags without locking, so they are left enabled and events are
+// filtered against a set that is replaced rather than changed.
+type LogFlags struct {
+	lock  sync.RWMutex
+	flags *logger.Flags
+}
+
+func NewLogFlags(log logger.Log) *LogFlags {
+	flagged, ok := log.(logger.Flagged)
+	if !ok {
+		return nil
+	}
+	filterable, ok := log.(logger.Filterable)
+	if !ok {
+		return nil
+	}
+	flags := flagged.GetFlags()
+	lf := &LogFlags{flags: logger.NewFlags(flags.Flags()...)}
+	*flags = *logger.FlagsAll()
+	for _, flag := range logFilterFlags {
+		filterable.Filter(flag, "log-flags", lf.filter)
+	}
+	return lf
+}
+
+func (lf *LogFlags) filter(_ context.Context, e logger.Event) (logger.Event, bool) {
+	return e, !lf.Flags().IsEnabled(e.GetFlag())
+}
+
+// The returned set is shared and must not be changed.
+func (lf *LogFlags) Flags() *logger.Flags {
+	lf.lock.RLock()
+	defer lf.lock.RUnlock()
+	return lf.flags
+}
+
+func (lf *LogFlags) Set(flags ...string) {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	lf.flags = logger.NewFlags(flags...)
+}
+
+func (lf *LogFlags) Update(enable, disable []string) *logger.Flags {
+	lf.lock.Lock()
+	defer lf.lock.Unlock()
+	flags := logger.NewFlags(lf.flags.Flags()...)
+	flags.Enable(enable...)
+	flags.Disable(disable...)
+	lf.flags = flags
+	return flags
+}
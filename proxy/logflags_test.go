@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+func TestLogFlags(t *testing.T) {
+	output := &bytes.Buffer{}
+	log := logger.MustNew(logger.OptFlags(logger.NewFlags("info", "-debug")), logger.OptOutput(output), logger.OptText(logger.OptTextNoColor()))
+	p := &Proxy{Log: log, LogFlags: NewLogFlags(log)}
+	admin := NewAdminServer(log, AdminConfig{}, p)
+
+	if !log.GetFlags().IsEnabled(logger.Debug) {
+		t.Fatal("the logger's own flags still disable debug")
+	}
+	setLog := func(query string) string {
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://127.0.0.1:2024/log?"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("setting %s returned %d: %s", query, rec.Code, rec.Body)
+		}
+		return rec.Body.String()
+	}
+
+	// requests keep logging while the flags are switched
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					log.Debugf("request")
+				}
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		setLog("enable=debug")
+		setLog("disable=debug")
+		p.applyLogConfig(LogConfig{Flags: []string{"info", "-debug"}})
+	}
+	close(done)
+	wg.Wait()
+
+	log.Drain()
+	output.Reset()
+	log.Debugf("hidden")
+	log.Infof("shown")
+	if body := setLog("enable=debug"); !strings.Contains(body, "debug") {
+		t.Errorf("flags after enabling debug are %s", body)
+	}
+	log.Debugf("enabled")
+	log.Drain()
+	if got := output.String(); strings.Contains(got, "hidden") || !strings.Contains(got, "shown") || !strings.Contains(got, "enabled") {
+		t.Errorf("logged %q", got)
+	}
+}
@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the latency histogram buckets in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metricFamily interface {
+	write(w io.Writer)
+}
+
+type Registry struct {
+	lock     sync.Mutex
+	families []metricFamily
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(family metricFamily) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.families = append(r.families, family)
+}
+
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	families := append([]metricFamily{}, r.families...)
+	r.lock.Unlock()
+
+	buffered := bufio.NewWriter(w)
+	counted := &countingWriter{w: buffered}
+	for _, family := range families {
+		family.write(counted)
+	}
+	return counted.n, buffered.Flush()
+}
+
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(rw)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+type metricDesc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d metricDesc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.ReplaceAll(strings.ReplaceAll(d.help, `\`, `\\`), "\n", `\n`))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+func (d metricDesc) series(w io.Writer, suffix string, values []string, value float64, extra ...string) {
+	io.WriteString(w, d.name+suffix)
+	if len(values) > 0 || len(extra) > 0 {
+		io.WriteString(w, "{")
+		first := true
+		pair := func(name, value string) {
+			if !first {
+				io.WriteString(w, ",")
+			}
+			first = false
+			io.WriteString(w, name+`="`+escapeLabel(value)+`"`)
+		}
+		for i, name := range d.labels {
+			pair(name, values[i])
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			pair(extra[i], extra[i+1])
+		}
+		io.WriteString(w, "}")
+	}
+	io.WriteString(w, " "+formatFloat(value)+"\n")
+}
+
+func (d metricDesc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s takes %d labels, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+func sortedKeys[T any](series map[string]T) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type CounterVec struct {
+	metricDesc
+	lock        sync.Mutex
+	values      map[string]float64
+	labelValues map[string][]string
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		metricDesc:  metricDesc{name: name, help: help, kind: "counter", labels: labels},
+		values:      map[string]float64{},
+		labelValues: map[string][]string{},
+	}
+	r.register(c)
+	return c
+}
+
+func (c *CounterVec) Add(delta float64, labels ...string) {
+	key := c.key(labels)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.labelValues[key]; !ok {
+		c.labelValues[key] = append([]string{}, labels...)
+	}
+	c.values[key] += delta
+}
+
+func (c *CounterVec) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.header(w)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		c.series(w, "", c.labelValues[key], c.values[key])
+	}
+}
+
+type HistogramVec struct {
+	metricDesc
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		metricDesc: metricDesc{name: name, help: help, kind: "histogram", labels: labels},
+		buckets:    buckets,
+		values:     map[string]*histogram{},
+	}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labels ...string) {
+	key := h.key(labels)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s, ok := h.values[key]
+	if !ok {
+		s = &histogram{labels: append([]string{}, labels...), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.header(w)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, key := range sortedKeys(h.values) {
+		s := h.values[key]
+		for i, bound := range h.buckets {
+			h.series(w, "_bucket", s.labels, float64(s.counts[i]), "le", formatFloat(bound))
+		}
+		h.series(w, "_bucket", s.labels, float64(s.count), "le", "+Inf")
+		h.series(w, "_sum", s.labels, s.sum)
+		h.series(w, "_count", s.labels, float64(s.count))
+	}
+}
+
+// GaugeFunc is a gauge whose series are read when scraped.
+type GaugeFunc struct {
+	metricDesc
+	collect func(set func(value float64, labels ...string))
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, collect func(set func(value float64, labels ...string)), labels ...string) *GaugeFunc {
+	g := &GaugeFunc{
+		metricDesc: metricDesc{name: name, help: help, kind: "gauge", labels: labels},
+		collect:    collect,
+	}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	values := map[string]float64{}
+	labels := map[string][]string{}
+	g.collect(func(value float64, labelValues ...string) {
+		key := g.key(labelValues)
+		values[key] = value
+		labels[key] = labelValues
+	})
+	g.header(w)
+	for _, key := range sortedKeys(values) {
+		g.series(w, "", labels[key], values[key])
+	}
+}
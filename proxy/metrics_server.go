@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+type MetricsServer struct {
+	Log             logger.Log
+	Config          MetricsConfig
+	Metrics         *Metrics
+	Server          *http.Server
+	Listener        net.Listener
+	Conns           *ConnTracker
+	ShutdownTimeout time.Duration
+
+	lock     sync.RWMutex
+	listener rebindableListener
+}
+
+func NewMetricsServer(log logger.Log, cfg MetricsConfig, metrics *Metrics) *MetricsServer {
+	m := &MetricsServer{
+		Log:     log,
+		Config:  cfg,
+		Metrics: metrics,
+		Conns:   NewConnTracker(),
+	}
+	server := &http.Server{
+		Addr:    BindAddr(cfg.Port),
+		Handler: m,
+	}
+	cfg.Limits.Apply(server)
+	m.Conns.Install(server)
+	m.Server = server
+	return m
+}
+
+func (m *MetricsServer) Start() error {
+	if m.Listener == nil {
+		l, err := net.Listen("tcp", m.Server.Addr)
+		if err != nil {
+			return err
+		}
+		m.Listener = l
+	}
+	m.listener.set(m.Listener)
+	m.Log.Infof("Starting Metrics Server on %s", m.Listener.Addr())
+	return m.listener.serve(m.Server.Serve)
+}
+
+func (m *MetricsServer) SetConfig(cfg MetricsConfig) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.Config = cfg
+}
+
+func (m *MetricsServer) Rebind(l net.Listener) {
+	m.Log.Infof("Moving Metrics Server to %s", l.Addr())
+	m.Listener = l
+	m.listener.rebind(l)
+}
+
+func (m *MetricsServer) Stop() error {
+	return shutdownServer(m.Log, "Metrics", m.Server, m.Conns, m.ShutdownTimeout)
+}
+
+func (m *MetricsServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	m.lock.RLock()
+	path := m.Config.Path
+	m.lock.RUnlock()
+
+	if req.URL.Path != path {
+		http.NotFound(rw, req)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	m.Metrics.Registry.ServeHTTP(rw, req)
+}
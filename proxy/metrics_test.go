@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+func TestRegistryExposition(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounterVec("test_total", "A counter\nwith a newline.", "a", "b")
+	histogram := r.NewHistogramVec("test_seconds", "A histogram.", []float64{.1, 1}, "a")
+	r.NewGaugeFunc("test_gauge", "A gauge.", func(set func(float64, ...string)) {
+		set(2, "y")
+		set(1, "x")
+	}, "name")
+	r.NewCounterVec("test_empty_total", "No series yet.")
+
+	counter.Inc("z", `quote " and \ slash`)
+	counter.Add(2.5, "a", "b")
+	counter.Inc("a", "b")
+	histogram.Observe(.05, "a")
+	histogram.Observe(.5, "a")
+	histogram.Observe(5, "a")
+
+	var sb strings.Builder
+	n, err := r.WriteTo(&sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_total A counter\nwith a newline.
+# TYPE test_total counter
+test_total{a="a",b="b"} 3.5
+test_total{a="z",b="quote \" and \\ slash"} 1
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{a="a",le="0.1"} 1
+test_seconds_bucket{a="a",le="1"} 2
+test_seconds_bucket{a="a",le="+Inf"} 3
+test_seconds_sum{a="a"} 5.55
+test_seconds_count{a="a"} 3
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge{name="x"} 1
+test_gauge{name="y"} 2
+# HELP test_empty_total No series yet.
+# TYPE test_empty_total counter
+`
+	if sb.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", sb.String(), want)
+	}
+	if n != int64(len(want)) {
+		t.Errorf("WriteTo returned %d, wrote %d bytes", n, len(want))
+	}
+}
+
+func TestRegistryLabelMismatchPanics(t *testing.T) {
+	counter := NewRegistry().NewCounterVec("test_total", "A counter.", "a", "b")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic for the wrong number of labels")
+		}
+	}()
+	counter.Inc("a")
+}
+
+func TestMetricsScrape(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/missing" {
+			http.NotFound(rw, req)
+			return
+		}
+		io.Copy(io.Discard, req.Body)
+		rw.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	log := logger.None()
+	handler, err := NewProxyHandler(log, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter("", []UpstreamConfig{{Name: "api", Targets: []string{upstream.URL}}}, []RouteConfig{{Name: "api", Path: "/api", Upstream: "api"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.SetRouter(router)
+
+	metrics := NewMetrics()
+	metrics.TrackUpstreams("tls", handler)
+	conns := NewConnTracker()
+	metrics.TrackConns("tls", conns)
+	proxied := metrics.Handler("tls", handler)
+	redirects := metrics.Handler("redirect", http.RedirectHandler("https://example.com/", http.StatusMovedPermanently))
+	server := NewMetricsServer(log, MetricsConfig{Path: "/metrics"}, metrics)
+
+	serve := func(h http.Handler, method, path, body string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec.Code
+	}
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("scrape returned %d", rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+			t.Fatalf("scrape content type %q", ct)
+		}
+		return rec.Body.String()
+	}
+	expect := func(exposition string, lines ...string) {
+		t.Helper()
+		for _, line := range lines {
+			if !strings.Contains(exposition, "\n"+line+"\n") {
+				t.Errorf("missing %q in\n%s", line, exposition)
+			}
+		}
+	}
+
+	serve(proxied, http.MethodPost, "/api/items", "12345")
+	serve(proxied, http.MethodGet, "/api/items", "")
+	serve(proxied, http.MethodGet, "/api/missing", "")
+	serve(proxied, http.MethodGet, "/other", "")
+	serve(redirects, http.MethodGet, "/", "")
+
+	first := scrape()
+	expect(first,
+		"# TYPE proxy_requests_total counter",
+		`proxy_requests_total{server="tls",route="api",upstream="api",code="200"} 2`,
+		`proxy_requests_total{server="tls",route="api",upstream="api",code="404"} 1`,
+		`proxy_requests_total{server="tls",route="",upstream="",code="404"} 1`,
+		`proxy_requests_total{server="redirect",route="",upstream="",code="301"} 1`,
+		`proxy_request_duration_seconds_count{server="tls",route="api",upstream="api"} 3`,
+		`proxy_request_bytes_total{server="tls"} 5`,
+		`proxy_response_bytes_total{server="tls"} 48`,
+		`proxy_redirects_total{server="redirect",code="301"} 1`,
+		`proxy_active_connections{server="tls"} 0`,
+		`proxy_upstream_healthy{server="tls",upstream="api",target="`+strings.TrimPrefix(upstream.URL, "http://")+`"} 1`,
+	)
+
+	serve(proxied, http.MethodGet, "/api/items", "")
+	expect(scrape(),
+		`proxy_requests_total{server="tls",route="api",upstream="api",code="200"} 3`,
+		`proxy_request_duration_seconds_count{server="tls",route="api",upstream="api"} 4`,
+	)
+
+	if code := serve(server, http.MethodGet, "/other", ""); code != http.StatusNotFound {
+		t.Errorf("scraping another path returned %d", code)
+	}
+	if code := serve(server, http.MethodPost, "/metrics", ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("posting to the metrics path returned %d", code)
+	}
+}
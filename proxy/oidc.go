@@ -0,0 +1,591 @@
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCAuthConfig logs browsers in with the authorization code flow. The
+// provider must allow https://<host><route path><callbackPath> as a redirect.
+type OIDCAuthConfig struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"clientID"`
+	ClientSecret string   `yaml:"clientSecret" secret:"true"`
+	Scopes       []string `yaml:"scopes"`
+	// CallbackPath and LogoutPath are under the route's path
+	CallbackPath string `yaml:"callbackPath"`
+	LogoutPath   string `yaml:"logoutPath"`
+	CookieName   string `yaml:"cookieName"`
+	CookieSecret string `yaml:"cookieSecret" secret:"true"`
+	CookieDomain string `yaml:"cookieDomain"`
+	// tokens expiring before SessionTTL are refreshed
+	SessionTTL          Duration `yaml:"sessionTTL"`
+	GroupsClaim         string   `yaml:"groupsClaim"`
+	AllowedGroups       []string `yaml:"allowedGroups"`
+	AllowedEmailDomains []string `yaml:"allowedEmailDomains"`
+	// the access token is kept in the cookie, large ones can outgrow it
+	ForwardAccessToken bool `yaml:"forwardAccessToken"`
+}
+
+const (
+	ForwardedEmailHeader  = "X-Forwarded-Email"
+	ForwardedGroupsHeader = "X-Forwarded-Groups"
+)
+
+const oidcRetry = 5 * time.Second
+
+const maxCookieSize = 4000
+
+type OIDCAuth struct {
+	Config OIDCAuthConfig
+	Client *http.Client
+	Prefix string
+
+	aead cipher.AEAD
+
+	lock      sync.Mutex
+	provider  *oidcProvider
+	verifier  *JWTAuth
+	lastError error
+	lastTry   time.Time
+}
+
+type oidcProvider struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	EndSessionEndpoint    string   `json:"end_session_endpoint"`
+	TokenAuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+type oidcLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Redirect string `json:"redirect"`
+	Expires  int64  `json:"exp"`
+}
+
+type oidcSession struct {
+	Subject      string   `json:"sub"`
+	Email        string   `json:"email,omitempty"`
+	Groups       []string `json:"groups,omitempty"`
+	LoginExpires int64    `json:"loginExp"`
+	TokenExpires int64    `json:"tokenExp"`
+	RefreshToken string   `json:"refresh,omitempty"`
+	AccessToken  string   `json:"access,omitempty"`
+}
+
+type oidcTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IDToken      string `json:"id_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+func NewOIDCAuth(cfg OIDCAuthConfig, prefix string) (*OIDCAuth, error) {
+	if len(cfg.CookieSecret) < 32 {
+		return nil, fmt.Errorf("oidc cookieSecret must be at least 32 characters")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if len(cfg.CallbackPath) == 0 {
+		cfg.CallbackPath = "/oauth2/callback"
+	}
+	if len(cfg.LogoutPath) == 0 {
+		cfg.LogoutPath = "/oauth2/logout"
+	}
+	if len(cfg.CookieName) == 0 {
+		cfg.CookieName = "_tls_proxy_oidc"
+	}
+	if cfg.SessionTTL == 0 {
+		cfg.SessionTTL = Duration(24 * time.Hour)
+	}
+	if len(cfg.GroupsClaim) == 0 {
+		cfg.GroupsClaim = "groups"
+	}
+	if len(prefix) == 0 {
+		prefix = "/"
+	}
+	key := sha256.Sum256([]byte(cfg.CookieSecret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCAuth{
+		Config: cfg,
+		Client: &http.Client{Timeout: 10 * time.Second},
+		Prefix: prefix,
+		aead:   aead,
+	}, nil
+}
+
+func (o *OIDCAuth) Authenticate(rw http.ResponseWriter, req *http.Request) (*http.Request, bool) {
+	switch req.URL.Path {
+	case o.path(o.Config.CallbackPath):
+		o.callback(rw, req)
+		return nil, false
+	case o.path(o.Config.LogoutPath):
+		o.logout(rw, req)
+		return nil, false
+	}
+
+	var session oidcSession
+	if !o.readCookie(req, o.Config.CookieName, &session) || time.Now().Unix() >= session.LoginExpires {
+		o.login(rw, req)
+		return nil, false
+	}
+	if time.Now().Unix() >= session.TokenExpires {
+		if err := o.refresh(req, &session); err != nil {
+			o.login(rw, req)
+			return nil, false
+		}
+		if err := o.setCookie(rw, req, o.Config.CookieName, session, time.Unix(session.LoginExpires, 0)); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+	}
+	if reason := o.check(session); len(reason) > 0 {
+		http.Error(rw, "forbidden: "+reason, http.StatusForbidden)
+		return nil, false
+	}
+
+	setUser(req, session.Subject)
+	req = req.Clone(req.Context())
+	for _, header := range []string{ForwardedUserHeader, ForwardedEmailHeader, ForwardedGroupsHeader} {
+		req.Header.Del(header)
+	}
+	req.Header.Set(ForwardedUserHeader, session.Subject)
+	if len(session.Email) > 0 {
+		req.Header.Set(ForwardedEmailHeader, session.Email)
+	}
+	if len(session.Groups) > 0 {
+		req.Header.Set(ForwardedGroupsHeader, strings.Join(session.Groups, ","))
+	}
+	if o.Config.ForwardAccessToken && len(session.AccessToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+session.AccessToken)
+	}
+	o.stripCookies(req)
+	return req, true
+}
+
+func (o *OIDCAuth) path(p string) string {
+	return path.Join(o.Prefix, p)
+}
+
+func (o *OIDCAuth) origin(req *http.Request) string {
+	return requestProto(req) + "://" + req.Host
+}
+
+func (o *OIDCAuth) discover() (*oidcProvider, *JWTAuth, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.provider != nil {
+		return o.provider, o.verifier, nil
+	}
+	if o.lastError != nil && time.Since(o.lastTry) < oidcRetry {
+		return nil, nil, o.lastError
+	}
+	o.lastTry = time.Now()
+	provider, err := o.fetchProvider()
+	if err != nil {
+		o.lastError = err
+		return nil, nil, err
+	}
+	verifier, err := NewJWTAuth(JWTAuthConfig{
+		JWKSURL:  provider.JWKSURI,
+		Secret:   o.Config.ClientSecret,
+		Issuer:   provider.Issuer,
+		Audience: []string{o.Config.ClientID},
+	})
+	if err != nil {
+		o.lastError = err
+		return nil, nil, err
+	}
+	o.provider, o.verifier, o.lastError = provider, verifier, nil
+	return provider, verifier, nil
+}
+
+func (o *OIDCAuth) fetchProvider() (*oidcProvider, error) {
+	discovery := strings.TrimSuffix(o.Config.Issuer, "/") + "/.well-known/openid-configuration"
+	res, err := o.Client.Get(discovery)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", discovery, res.Status)
+	}
+	var provider oidcProvider
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&provider); err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", discovery, err)
+	}
+	if provider.Issuer != o.Config.Issuer {
+		return nil, fmt.Errorf("provider issuer %q does not match %q", provider.Issuer, o.Config.Issuer)
+	}
+	if len(provider.AuthorizationEndpoint) == 0 || len(provider.TokenEndpoint) == 0 || len(provider.JWKSURI) == 0 {
+		return nil, fmt.Errorf("provider configuration is missing endpoints")
+	}
+	return &provider, nil
+}
+
+func (o *OIDCAuth) login(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	provider, _, err := o.discover()
+	if err != nil {
+		http.Error(rw, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	login := oidcLogin{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken(),
+		Redirect: localRedirect(req.URL),
+		Expires:  time.Now().Add(10 * time.Minute).Unix(),
+	}
+	if err := o.setCookie(rw, req, o.loginCookie(), login, time.Unix(login.Expires, 0)); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.Config.ClientID},
+		"redirect_uri":          {o.origin(req) + o.path(o.Config.CallbackPath)},
+		"scope":                 {strings.Join(o.Config.Scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(rw, req, withQuery(provider.AuthorizationEndpoint, query), http.StatusFound)
+}
+
+func (o *OIDCAuth) callback(rw http.ResponseWriter, req *http.Request) {
+	var login oidcLogin
+	query := req.URL.Query()
+	if !o.readCookie(req, o.loginCookie(), &login) || time.Now().Unix() >= login.Expires || query.Get("state") != login.State {
+		http.Error(rw, "login expired or invalid, try again", http.StatusBadRequest)
+		return
+	}
+	o.clearCookie(rw, req, o.loginCookie())
+	if e := query.Get("error"); len(e) > 0 {
+		http.Error(rw, fmt.Sprintf("login failed: %s %s", e, query.Get("error_description")), http.StatusForbidden)
+		return
+	}
+	tokens, err := o.exchange(req, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {o.origin(req) + o.path(o.Config.CallbackPath)},
+		"code_verifier": {login.Verifier},
+	})
+	if err != nil {
+		http.Error(rw, "login failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	session := oidcSession{LoginExpires: time.Now().Add(o.Config.SessionTTL.Duration()).Unix()}
+	if err := o.update(&session, tokens, login.Nonce); err != nil {
+		http.Error(rw, "login failed: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if reason := o.check(session); len(reason) > 0 {
+		http.Error(rw, "forbidden: "+reason, http.StatusForbidden)
+		return
+	}
+	if err := o.setCookie(rw, req, o.Config.CookieName, session, time.Unix(session.LoginExpires, 0)); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	redirect := login.Redirect
+	if !isLocalPath(redirect) {
+		redirect = o.Prefix
+	}
+	http.Redirect(rw, req, redirect, http.StatusFound)
+}
+
+func (o *OIDCAuth) logout(rw http.ResponseWriter, req *http.Request) {
+	o.clearCookie(rw, req, o.Config.CookieName)
+	home := o.origin(req) + o.Prefix
+	provider, _, err := o.discover()
+	if err != nil || len(provider.EndSessionEndpoint) == 0 {
+		http.Redirect(rw, req, home, http.StatusFound)
+		return
+	}
+	query := url.Values{
+		"client_id":                {o.Config.ClientID},
+		"post_logout_redirect_uri": {home},
+	}
+	http.Redirect(rw, req, withQuery(provider.EndSessionEndpoint, query), http.StatusFound)
+}
+
+func (o *OIDCAuth) refresh(req *http.Request, session *oidcSession) error {
+	if len(session.RefreshToken) == 0 {
+		return fmt.Errorf("no refresh token")
+	}
+	tokens, err := o.exchange(req, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {session.RefreshToken},
+	})
+	if err != nil {
+		return err
+	}
+	return o.update(session, tokens, "")
+}
+
+func (o *OIDCAuth) exchange(req *http.Request, form url.Values) (*oidcTokens, error) {
+	provider, _, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	// client_secret_post only when it is all the provider supports
+	methods := provider.TokenAuthMethods
+	post := containsString(methods, "client_secret_post") && !containsString(methods, "client_secret_basic")
+	basic := len(o.Config.ClientSecret) > 0 && !post
+	form.Set("client_id", o.Config.ClientID)
+	if len(o.Config.ClientSecret) > 0 && post {
+		form.Set("client_secret", o.Config.ClientSecret)
+	}
+	tokenReq, err := http.NewRequestWithContext(req.Context(), http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.Header.Set("Accept", "application/json")
+	if basic {
+		tokenReq.SetBasicAuth(url.QueryEscape(o.Config.ClientID), url.QueryEscape(o.Config.ClientSecret))
+	}
+	res, err := o.Client.Do(tokenReq)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var tokens oidcTokens
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("token endpoint: %s", res.Status)
+	}
+	if len(tokens.Error) > 0 {
+		return nil, fmt.Errorf("token endpoint: %s %s", tokens.Error, tokens.Description)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s", res.Status)
+	}
+	return &tokens, nil
+}
+
+// a refresh response may omit the ID token, keeping the identity
+func (o *OIDCAuth) update(session *oidcSession, tokens *oidcTokens, nonce string) error {
+	_, verifier, err := o.discover()
+	if err != nil {
+		return err
+	}
+	expires := time.Time{}
+	if len(tokens.IDToken) > 0 {
+		claims, err := verifier.Verify(tokens.IDToken, time.Now())
+		if err != nil {
+			return fmt.Errorf("id token: %w", err)
+		}
+		if len(nonce) > 0 && claims["nonce"] != nonce {
+			return fmt.Errorf("id token: nonce does not match")
+		}
+		sub, _ := claims["sub"].(string)
+		if len(sub) == 0 || len(session.Subject) > 0 && sub != session.Subject {
+			return fmt.Errorf("id token: unexpected subject")
+		}
+		session.Subject = sub
+		session.Email = ""
+		if email, _ := claims["email"].(string); len(email) > 0 && claims["email_verified"] != false {
+			session.Email = email
+		}
+		session.Groups = claimStrings(claims[o.Config.GroupsClaim])
+		expires, _ = claimTime(claims["exp"])
+	} else if len(session.Subject) == 0 {
+		return fmt.Errorf("no id token")
+	}
+	if tokens.ExpiresIn > 0 {
+		expires = time.Now().Add(time.Duration(tokens.ExpiresIn) * time.Second)
+	}
+	if expires.IsZero() {
+		expires = time.Unix(session.LoginExpires, 0)
+	}
+	session.TokenExpires = expires.Unix()
+	if len(tokens.RefreshToken) > 0 {
+		session.RefreshToken = tokens.RefreshToken
+	}
+	session.AccessToken = ""
+	if o.Config.ForwardAccessToken {
+		session.AccessToken = tokens.AccessToken
+	}
+	return nil
+}
+
+func (o *OIDCAuth) check(session oidcSession) string {
+	if len(o.Config.AllowedEmailDomains) > 0 {
+		_, domain, _ := strings.Cut(session.Email, "@")
+		if len(domain) == 0 || !containsFold(o.Config.AllowedEmailDomains, domain) {
+			return "email domain not allowed"
+		}
+	}
+	if len(o.Config.AllowedGroups) > 0 {
+		allowed := false
+		for _, group := range session.Groups {
+			allowed = allowed || containsString(o.Config.AllowedGroups, group)
+		}
+		if !allowed {
+			return "not in an allowed group"
+		}
+	}
+	return ""
+}
+
+func (o *OIDCAuth) loginCookie() string {
+	return o.Config.CookieName + "_login"
+}
+
+// the name is bound into the ciphertext so one cookie cannot stand in for another
+func (o *OIDCAuth) setCookie(rw http.ResponseWriter, req *http.Request, name string, value interface{}, expires time.Time) error {
+	plain, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, o.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := o.aead.Seal(nonce, nonce, plain, []byte(name))
+	cookie := o.cookie(req, name, base64.RawURLEncoding.EncodeToString(sealed))
+	cookie.Expires = expires
+	if encoded := cookie.String(); len(encoded) > maxCookieSize {
+		return fmt.Errorf("session cookie of %d bytes is too large", len(encoded))
+	}
+	http.SetCookie(rw, cookie)
+	return nil
+}
+
+func (o *OIDCAuth) readCookie(req *http.Request, name string, value interface{}) bool {
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		return false
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(sealed) < o.aead.NonceSize() {
+		return false
+	}
+	nonce, sealed := sealed[:o.aead.NonceSize()], sealed[o.aead.NonceSize():]
+	plain, err := o.aead.Open(nil, nonce, sealed, []byte(name))
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(plain, value) == nil
+}
+
+func (o *OIDCAuth) clearCookie(rw http.ResponseWriter, req *http.Request, name string) {
+	cookie := o.cookie(req, name, "")
+	cookie.MaxAge = -1
+	http.SetCookie(rw, cookie)
+}
+
+func (o *OIDCAuth) cookie(req *http.Request, name, value string) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     o.Prefix,
+		Domain:   o.Config.CookieDomain,
+		Secure:   requestProto(req) == "https",
+		HttpOnly: true,
+		// lax so the cookies are sent on the provider's redirect back
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (o *OIDCAuth) stripCookies(req *http.Request) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != o.Config.CookieName && cookie.Name != o.loginCookie() {
+			req.AddCookie(cookie)
+		}
+	}
+}
+
+func localRedirect(u *url.URL) string {
+	cleaned := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return (&url.URL{Path: cleaned, RawQuery: u.RawQuery}).RequestURI()
+}
+
+// browsers read //host and /\host as another host
+func isLocalPath(redirect string) bool {
+	return strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//") && !strings.HasPrefix(redirect, "/\\")
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func withQuery(endpoint string, query url.Values) string {
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + query.Encode()
+	}
+	return endpoint + "?" + query.Encode()
+}
+
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,399 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOIDCLocalRedirect(t *testing.T) {
+	cases := map[string]string{
+		"/app/page?x=1":          "/app/page?x=1",
+		"//evil.example/x":       "/evil.example/x",
+		"/\\evil.example/x":      "/%5Cevil.example/x",
+		"/a/../..//evil.example": "/evil.example",
+		"/app/":                  "/app/",
+		"/":                      "/",
+	}
+	for requested, want := range cases {
+		u, err := url.ParseRequestURI(requested)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := localRedirect(u)
+		if got != want {
+			t.Errorf("%s redirects back to %s, want %s", requested, got, want)
+		}
+		if !isLocalPath(got) {
+			t.Errorf("%s is not local", got)
+		}
+	}
+	for _, redirect := range []string{"//evil.example", "/\\evil.example", "https://evil.example/", "evil"} {
+		if isLocalPath(redirect) {
+			t.Errorf("%s is local", redirect)
+		}
+	}
+}
+
+// openIDProvider checks the PKCE verifier and redirect uri of each code it
+// issued, then signs ID tokens with EdDSA for whatever claims it is set to.
+type openIDProvider struct {
+	*httptest.Server
+	key ed25519.PrivateKey
+
+	lock   sync.Mutex
+	claims map[string]interface{}
+	// exp is how long ID tokens are valid for, nonce replaces the login's
+	nonce     string
+	exp       time.Duration
+	codes     map[string]issuedCode
+	refreshes int
+	// refreshError fails refresh grants
+	refreshError bool
+}
+
+type issuedCode struct {
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+func startOIDCProvider(t *testing.T) *openIDProvider {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := &openIDProvider{key: key, exp: time.Hour, codes: map[string]issuedCode{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]interface{}{
+			"issuer":                 op.URL,
+			"authorization_endpoint": op.URL + "/authorize",
+			"token_endpoint":         op.URL + "/token",
+			"jwks_uri":               op.URL + "/jwks",
+			"end_session_endpoint":   op.URL + "/logout",
+		})
+	})
+	mux.HandleFunc("/jwks", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"kid": "test",
+			"x":   base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		}}})
+	})
+	mux.HandleFunc("/token", op.token)
+	op.Server = httptest.NewServer(mux)
+	t.Cleanup(op.Close)
+	return op
+}
+
+// authorize does what the provider's login page would, returning the code the
+// browser is sent back with.
+func (op *openIDProvider) authorize(t *testing.T, location string) (code, state string) {
+	t.Helper()
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("client_id") != "proxy" || query.Get("code_challenge_method") != "S256" || query.Get("response_type") != "code" {
+		t.Fatalf("redirected to %s", location)
+	}
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	code = randomToken()
+	op.codes[code] = issuedCode{
+		nonce:       query.Get("nonce"),
+		challenge:   query.Get("code_challenge"),
+		redirectURI: query.Get("redirect_uri"),
+	}
+	return code, query.Get("state")
+}
+
+func (op *openIDProvider) token(rw http.ResponseWriter, req *http.Request) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	fail := func(e string) {
+		rw.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(rw).Encode(map[string]string{"error": e})
+	}
+	if id, secret, ok := req.BasicAuth(); !ok || id != "proxy" || secret != "client-secret" {
+		fail("invalid_client")
+		return
+	}
+	var nonce string
+	switch req.PostFormValue("grant_type") {
+	case "authorization_code":
+		code, ok := op.codes[req.PostFormValue("code")]
+		delete(op.codes, req.PostFormValue("code"))
+		challenge := sha256.Sum256([]byte(req.PostFormValue("code_verifier")))
+		if !ok || code.challenge != base64.RawURLEncoding.EncodeToString(challenge[:]) || code.redirectURI != req.PostFormValue("redirect_uri") {
+			fail("invalid_grant")
+			return
+		}
+		nonce = code.nonce
+		if len(op.nonce) > 0 {
+			nonce = op.nonce
+		}
+	case "refresh_token":
+		op.refreshes++
+		if op.refreshError || req.PostFormValue("refresh_token") != "refresh-token" {
+			fail("invalid_grant")
+			return
+		}
+	default:
+		fail("unsupported_grant_type")
+		return
+	}
+	claims := map[string]interface{}{
+		"iss": op.URL,
+		"aud": "proxy",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(op.exp).Unix(),
+	}
+	if len(nonce) > 0 {
+		claims["nonce"] = nonce
+	}
+	for key, value := range op.claims {
+		claims[key] = value
+	}
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"access_token":  "access-token",
+		"refresh_token": "refresh-token",
+		"id_token":      op.sign(claims),
+		"token_type":    "Bearer",
+	})
+}
+
+func (op *openIDProvider) sign(claims map[string]interface{}) string {
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","kid":"test"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(op.key, []byte(signed)))
+}
+
+func (op *openIDProvider) set(claims map[string]interface{}) {
+	op.lock.Lock()
+	defer op.lock.Unlock()
+	op.claims = claims
+}
+
+func oidcAuthFor(t *testing.T, op *openIDProvider, prefix string, configure func(*OIDCAuthConfig)) *OIDCAuth {
+	t.Helper()
+	cfg := OIDCAuthConfig{
+		Issuer:             op.URL,
+		ClientID:           "proxy",
+		ClientSecret:       "client-secret",
+		CookieSecret:       strings.Repeat("s", 32),
+		ForwardAccessToken: true,
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	auth, err := NewOIDCAuth(cfg, prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+// oidcRequest runs a GET through auth with cookies, returning the response
+// and the request sent on to the upstream, if any.
+func oidcRequest(auth *OIDCAuth, target string, cookies ...*http.Cookie) (*http.Response, *http.Request) {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	proxied, ok := auth.Authenticate(rec, req)
+	if !ok {
+		proxied = nil
+	}
+	return rec.Result(), proxied
+}
+
+func responseCookie(res *http.Response, name string) *http.Cookie {
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == name && cookie.MaxAge >= 0 {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// loginThroughProvider follows the redirects of a login from target,
+// returning the callback's response.
+func loginThroughProvider(t *testing.T, op *openIDProvider, auth *OIDCAuth, target string) *http.Response {
+	t.Helper()
+	res, _ := oidcRequest(auth, target)
+	if res.StatusCode != http.StatusFound || !strings.HasPrefix(res.Header.Get("Location"), op.URL+"/authorize?") {
+		t.Fatalf("%s returned %d to %s, want a redirect to the provider", target, res.StatusCode, res.Header.Get("Location"))
+	}
+	loginCookie := responseCookie(res, auth.loginCookie())
+	if loginCookie == nil {
+		t.Fatal("no login cookie set")
+	}
+	code, state := op.authorize(t, res.Header.Get("Location"))
+	res, _ = oidcRequest(auth, auth.path(auth.Config.CallbackPath)+"?"+url.Values{"code": {code}, "state": {state}}.Encode(), loginCookie)
+	return res
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	op := startOIDCProvider(t)
+	op.set(map[string]interface{}{"sub": "alice", "email": "alice@example.com", "groups": []string{"admins", "users"}})
+	auth := oidcAuthFor(t, op, "/app", nil)
+
+	res := loginThroughProvider(t, op, auth, "/app/page?x=1")
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/app/page?x=1" {
+		t.Fatalf("callback returned %d to %s", res.StatusCode, res.Header.Get("Location"))
+	}
+	session := responseCookie(res, auth.Config.CookieName)
+	if session == nil || session.Path != "/app" || !session.HttpOnly {
+		t.Fatalf("session cookie %v", session)
+	}
+
+	res, proxied := oidcRequest(auth, "/app/page", session, &http.Cookie{Name: "other", Value: "kept"})
+	if proxied == nil {
+		t.Fatalf("logged in request returned %d", res.StatusCode)
+	}
+	headers := map[string]string{
+		ForwardedUserHeader:   "alice",
+		ForwardedEmailHeader:  "alice@example.com",
+		ForwardedGroupsHeader: "admins,users",
+		"Authorization":       "Bearer access-token",
+	}
+	for header, want := range headers {
+		if got := proxied.Header.Get(header); got != want {
+			t.Errorf("upstream got %s %q, want %q", header, got, want)
+		}
+	}
+	if cookies := proxied.Header.Get("Cookie"); strings.Contains(cookies, auth.Config.CookieName) || !strings.Contains(cookies, "other=kept") {
+		t.Errorf("upstream got cookies %q", cookies)
+	}
+
+	res, _ = oidcRequest(auth, "/app/oauth2/logout", session)
+	if res.StatusCode != http.StatusFound || !strings.HasPrefix(res.Header.Get("Location"), op.URL+"/logout?") {
+		t.Errorf("logout returned %d to %s", res.StatusCode, res.Header.Get("Location"))
+	}
+}
+
+func TestOIDCLoginRedirectStaysLocal(t *testing.T) {
+	op := startOIDCProvider(t)
+	op.set(map[string]interface{}{"sub": "alice"})
+	auth := oidcAuthFor(t, op, "/", nil)
+	res := loginThroughProvider(t, op, auth, "//evil.example/x")
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/evil.example/x" {
+		t.Errorf("callback returned %d to %s", res.StatusCode, res.Header.Get("Location"))
+	}
+}
+
+func TestOIDCCallbackChecks(t *testing.T) {
+	op := startOIDCProvider(t)
+	op.set(map[string]interface{}{"sub": "alice"})
+	auth := oidcAuthFor(t, op, "/app", nil)
+
+	res, _ := oidcRequest(auth, "/app/page")
+	loginCookie := responseCookie(res, auth.loginCookie())
+	code, _ := op.authorize(t, res.Header.Get("Location"))
+	res, _ = oidcRequest(auth, "/app/oauth2/callback?code="+code+"&state=forged", loginCookie)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback with the wrong state returned %d", res.StatusCode)
+	}
+	res, _ = oidcRequest(auth, "/app/oauth2/callback?code="+code+"&state=x")
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback without the login cookie returned %d", res.StatusCode)
+	}
+
+	op.lock.Lock()
+	op.nonce = "replayed"
+	op.lock.Unlock()
+	res = loginThroughProvider(t, op, auth, "/app/page")
+	if res.StatusCode != http.StatusForbidden || responseCookie(res, auth.Config.CookieName) != nil {
+		t.Errorf("callback with the wrong nonce returned %d", res.StatusCode)
+	}
+}
+
+func TestOIDCRefresh(t *testing.T) {
+	op := startOIDCProvider(t)
+	op.set(map[string]interface{}{"sub": "alice"})
+	auth := oidcAuthFor(t, op, "/app", nil)
+
+	// the ID token expired within the clock skew, so the login succeeds but
+	// the next request refreshes
+	op.exp = -10 * time.Second
+	session := responseCookie(loginThroughProvider(t, op, auth, "/app/"), auth.Config.CookieName)
+	op.lock.Lock()
+	op.exp = time.Hour
+	op.lock.Unlock()
+
+	res, proxied := oidcRequest(auth, "/app/", session)
+	if proxied == nil || proxied.Header.Get(ForwardedUserHeader) != "alice" {
+		t.Fatalf("refreshing request returned %d", res.StatusCode)
+	}
+	refreshed := responseCookie(res, auth.Config.CookieName)
+	if refreshed == nil || op.refreshes != 1 {
+		t.Fatalf("refreshed %d times, set cookie %v", op.refreshes, refreshed)
+	}
+	if _, proxied := oidcRequest(auth, "/app/", refreshed); proxied == nil || op.refreshes != 1 {
+		t.Errorf("refreshed session was refreshed again")
+	}
+
+	// a subject change on refresh or a failed refresh ends the session
+	op.set(map[string]interface{}{"sub": "mallory"})
+	if res, proxied := oidcRequest(auth, "/app/", session); proxied != nil || res.StatusCode != http.StatusFound {
+		t.Errorf("refresh to another subject returned %d", res.StatusCode)
+	}
+	op.lock.Lock()
+	op.refreshError = true
+	op.lock.Unlock()
+	if res, proxied := oidcRequest(auth, "/app/", session); proxied != nil || res.StatusCode != http.StatusFound {
+		t.Errorf("failed refresh returned %d", res.StatusCode)
+	}
+}
+
+func TestOIDCAllowRules(t *testing.T) {
+	cases := []struct {
+		name   string
+		claims map[string]interface{}
+		groups []string
+		domain []string
+		code   int
+	}{
+		{"in group", map[string]interface{}{"sub": "a", "groups": []string{"users", "admins"}}, []string{"admins"}, nil, http.StatusFound},
+		{"group as string", map[string]interface{}{"sub": "a", "groups": "admins"}, []string{"admins"}, nil, http.StatusFound},
+		{"not in group", map[string]interface{}{"sub": "a", "groups": []string{"users"}}, []string{"admins"}, nil, http.StatusForbidden},
+		{"no groups", map[string]interface{}{"sub": "a"}, []string{"admins"}, nil, http.StatusForbidden},
+		{"domain", map[string]interface{}{"sub": "a", "email": "a@Example.com"}, nil, []string{"example.com"}, http.StatusFound},
+		{"other domain", map[string]interface{}{"sub": "a", "email": "a@example.org"}, nil, []string{"example.com"}, http.StatusForbidden},
+		{"unverified email", map[string]interface{}{"sub": "a", "email": "a@example.com", "email_verified": false}, nil, []string{"example.com"}, http.StatusForbidden},
+		{"both", map[string]interface{}{"sub": "a", "email": "a@example.com", "groups": []string{"admins"}}, []string{"admins"}, []string{"example.com"}, http.StatusFound},
+		{"only one of both", map[string]interface{}{"sub": "a", "email": "a@example.com"}, []string{"admins"}, []string{"example.com"}, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			op := startOIDCProvider(t)
+			op.set(c.claims)
+			auth := oidcAuthFor(t, op, "/app", func(cfg *OIDCAuthConfig) {
+				cfg.AllowedGroups = c.groups
+				cfg.AllowedEmailDomains = c.domain
+			})
+			res := loginThroughProvider(t, op, auth, "/app/")
+			if res.StatusCode != c.code {
+				t.Errorf("callback returned %d, want %d", res.StatusCode, c.code)
+			}
+			if session := responseCookie(res, auth.Config.CookieName); (session != nil) != (c.code == http.StatusFound) {
+				t.Errorf("session cookie %v", session)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Spans are dropped rather than blocking requests when the queue is full or
+// the collector is down.
+type OTLPExporter struct {
+	Config  TracingConfig
+	Client  *http.Client
+	Dropped uint64
+
+	queue   chan *Span
+	flushes chan chan struct{}
+	done    chan struct{}
+	closed  sync.Once
+	stopped chan struct{}
+}
+
+func NewOTLPExporter(cfg TracingConfig) *OTLPExporter {
+	e := &OTLPExporter{
+		Config:  cfg,
+		Client:  &http.Client{Timeout: cfg.Timeout.Duration()},
+		queue:   make(chan *Span, cfg.QueueSize),
+		flushes: make(chan chan struct{}),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *OTLPExporter) Export(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		atomic.AddUint64(&e.Dropped, 1)
+	}
+}
+
+func (e *OTLPExporter) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case e.flushes <- flushed:
+	case <-e.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *OTLPExporter) Close(ctx context.Context) error {
+	e.closed.Do(func() { close(e.done) })
+	select {
+	case <-e.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *OTLPExporter) run() {
+	defer close(e.stopped)
+	ticker := time.NewTicker(e.Config.FlushInterval.Duration())
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, e.Config.BatchSize)
+	send := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			atomic.AddUint64(&e.Dropped, uint64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+	drain := func() {
+		for {
+			select {
+			case span := <-e.queue:
+				batch = append(batch, span)
+				if len(batch) >= e.Config.BatchSize {
+					send()
+				}
+			default:
+				send()
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= e.Config.BatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case flushed := <-e.flushes:
+			drain()
+			close(flushed)
+		case <-e.done:
+			drain()
+			return
+		}
+	}
+}
+
+func (e *OTLPExporter) send(spans []*Span) error {
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.Config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.Config.Headers {
+		req.Header.Set(key, value)
+	}
+	res, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", res.Status)
+	}
+	return nil
+}
+
+// the OTLP JSON encoding, see opentelemetry-proto's trace service
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func (e *OTLPExporter) encode(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		span.lock.Lock()
+		s := otlpSpan{
+			TraceID:           span.Context.TraceID.String(),
+			SpanID:            span.Context.SpanID.String(),
+			TraceState:        span.Context.TraceState,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: span.StatusCode, Message: span.StatusDetail},
+		}
+		if span.Parent.IsValid() {
+			s.ParentSpanID = span.Parent.String()
+		}
+		for _, attr := range span.attributes {
+			s.Attributes = append(s.Attributes, otlpAttribute{Key: attr.key, Value: otlpValue(attr.value)})
+		}
+		span.lock.Unlock()
+		encoded = append(encoded, s)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpValue(e.Config.ServiceName)},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "tls-proxy"},
+			Spans: encoded,
+		}},
+	}}}
+}
@@ -1,18 +1,38 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/blend/go-sdk/logger"
 )
 
 type Proxy struct {
+	File           string
 	Config         Config
 	Log            logger.Log
+	LogFlags       *LogFlags
 	TLSServer      Runnable
+	HTTPServer     Runnable
 	RedirectServer Runnable
+	MetricsServer  Runnable
+	AdminServer    Runnable
+	Metrics        *Metrics
+	AccessLog      *AccessLog
+	Tracer         *Tracer
+	RequestIDs     *RequestIDs
+	Forwarding     *Forwarding
+	Drains         *Drains
+	RateLimiter    *RateLimiter
+	AccessControl  *AccessControl
+	Listeners      map[string]net.Listener
+	UpgradeTimeout time.Duration
+	Readiness      *Readiness
 
 	lock    sync.Mutex
 	running bool
@@ -29,11 +49,22 @@ func NewProxyFromFile(file string) (*Proxy, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Proxy{
-		Config:  ConfigOrDefault(*cfg),
-		Log:     logger.All(),
-		running: false,
-	}, nil
+	listeners, err := InheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{
+		File:      file,
+		Config:    ConfigOrDefault(*cfg),
+		Log:       logger.All(),
+		Listeners: listeners,
+		Readiness: &Readiness{},
+		Drains:    NewDrains(),
+		running:   false,
+	}
+	p.LogFlags = NewLogFlags(p.Log)
+	p.applyLogConfig(p.Config.Log)
+	return p, nil
 }
 
 func (p *Proxy) Start() error {
@@ -46,18 +77,11 @@ func (p *Proxy) Start() error {
 		return fmt.Errorf("already running")
 	}
 
-	var err error
-	toRun := []Runnable{}
-	p.TLSServer, err = NewTLSServer(p.Log, p.Config.TLS)
+	toRun, err := p.buildServers()
 	if err != nil {
 		p.lock.Unlock()
 		return err
 	}
-	toRun = append(toRun, p.TLSServer)
-	if p.Config.Redirect.Enabled {
-		p.RedirectServer = NewRedirect(p.Log, p.Config.Redirect)
-		toRun = append(toRun, p.RedirectServer)
-	}
 
 	p.stopped = make(chan struct{})
 	p.running = true
@@ -68,6 +92,10 @@ func (p *Proxy) Start() error {
 		}(run)
 	}
 
+	p.handleUpgrades(p.stopped)
+	p.handleReloads(p.stopped)
+	p.Readiness.SetReady(true)
+	p.notifyReady()
 	p.lock.Unlock()
 
 	errStrings := make([]string, 0)
@@ -89,9 +117,23 @@ func (p *Proxy) Start() error {
 	close(errs)
 
 	p.lock.Lock()
+	p.Readiness.SetReady(false)
 	p.running = false
 	close(p.stopped)
+	if p.AccessLog != nil {
+		p.AccessLog.Close()
+	}
+	if p.RateLimiter != nil {
+		p.RateLimiter.Close()
+	}
 	p.lock.Unlock()
+	if p.Tracer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), p.Config.Tracing.Timeout.Duration())
+		if err := p.Tracer.Close(ctx); err != nil {
+			p.Log.Warningf("Exporting remaining spans: %v", err)
+		}
+		cancel()
+	}
 
 	if len(errStrings) > 0 {
 		return fmt.Errorf(strings.Join(errStrings, "\n"))
@@ -103,23 +145,25 @@ func (p *Proxy) Stop() error {
 	if !p.running {
 		return nil
 	}
-	errs := make(chan error, 2)
-	tlsServer := p.TLSServer
-	redirServer := p.RedirectServer
-	var wg sync.WaitGroup
-	if tlsServer != nil {
-		wg.Add(1)
-		go func(wg *sync.WaitGroup) {
-			defer wg.Done()
-			errs <- tlsServer.Stop()
-		}(&wg)
+	wasReady := p.Readiness.Ready()
+	p.Readiness.SetReady(false)
+	if drain := p.Config.Shutdown.DrainPeriod.Duration(); drain > 0 && wasReady {
+		p.Log.Infof("Reporting not ready for %v before stopping servers", drain)
+		select {
+		case <-time.After(drain):
+		case <-p.stopped:
+		}
 	}
-	if redirServer != nil {
+
+	servers := p.servers()
+	errs := make(chan error, len(servers))
+	var wg sync.WaitGroup
+	for _, server := range servers {
 		wg.Add(1)
-		go func(wg *sync.WaitGroup) {
+		go func(server Runnable) {
 			defer wg.Done()
-			errs <- redirServer.Stop()
-		}(&wg)
+			errs <- server.Stop()
+		}(server)
 	}
 
 	<-p.stopped
@@ -137,6 +181,215 @@ func (p *Proxy) Stop() error {
 	return nil
 }
 
+func (p *Proxy) servers() []Runnable {
+	servers := []Runnable{}
+	for _, server := range []Runnable{p.TLSServer, p.HTTPServer, p.RedirectServer, p.MetricsServer, p.AdminServer} {
+		if server != nil {
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
+
+func (p *Proxy) buildServers() (toRun []Runnable, err error) {
+	if p.Listeners == nil {
+		p.Listeners = map[string]net.Listener{}
+	}
+	bound := map[string]net.Listener{}
+	defer func() {
+		if err == nil {
+			return
+		}
+		for name, l := range bound {
+			l.Close()
+			delete(p.Listeners, name)
+		}
+		if p.AccessLog != nil {
+			p.AccessLog.Close()
+		}
+		if p.RateLimiter != nil {
+			p.RateLimiter.Close()
+		}
+		if p.Tracer != nil {
+			p.Tracer.Close(context.Background())
+		}
+	}()
+	listen := func(name string, port uint16) (net.Listener, error) {
+		l, err := Listen(p.Listeners, name, port)
+		if err != nil {
+			return nil, err
+		}
+		bound[name] = l
+		p.Listeners[name] = l
+		return l, nil
+	}
+	shutdownTimeout := p.Config.Shutdown.Timeout.Duration()
+	health := p.Config.Health
+	if p.Config.Metrics.Enabled {
+		p.Metrics = NewMetrics()
+	}
+	if p.Config.AccessLog.IsEnabled() {
+		accessLog, err := NewAccessLog(p.Config.AccessLog)
+		if err != nil {
+			return nil, err
+		}
+		p.AccessLog = accessLog
+	}
+	if p.Config.Tracing.Enabled {
+		p.Tracer = NewTracer(p.Config.Tracing)
+	}
+	if p.Config.RequestID.Enabled {
+		requestIDs, err := NewRequestIDs(p.Config.RequestID)
+		if err != nil {
+			return nil, err
+		}
+		p.RequestIDs = requestIDs
+	}
+	forwarding, err := NewForwarding(p.Config.Forwarded)
+	if err != nil {
+		return nil, err
+	}
+	p.Forwarding = forwarding
+	p.RateLimiter = NewRateLimiter(p.Log, p.Config.RateLimit)
+	accessControl, err := NewAccessControl(p.Log, p.Config.Access, p.Config.GeoIP)
+	if err != nil {
+		return nil, err
+	}
+	p.AccessControl = accessControl
+	instrument := func(name string, server *http.Server, conns *ConnTracker) {
+		if p.AccessLog != nil {
+			server.Handler = p.AccessLog.Handler(name, server.Handler)
+		}
+		if p.Metrics != nil {
+			p.Metrics.TrackConns(name, conns)
+			server.Handler = p.Metrics.Handler(name, server.Handler)
+		}
+		if p.Tracer != nil {
+			server.Handler = p.Tracer.Handler(name, server.Handler)
+		}
+		server.Handler = p.Forwarding.Handler(name, server.Handler)
+		if p.RequestIDs != nil {
+			server.Handler = p.RequestIDs.Handler(name, server.Handler)
+		}
+		server.Handler = withHealth(health, p.Readiness, server.Handler)
+	}
+
+	if p.Config.TLS.IsEnabled() {
+		tlsServer, err := NewTLSServer(p.Log, p.Config.TLS)
+		if err != nil {
+			return nil, err
+		}
+		router, err := p.newRouter(p.Config.TLS.Upstream, p.Config)
+		if err != nil {
+			return nil, err
+		}
+		tlsServer.Handler.SetRouter(router)
+		tlsServer.Handler.SetAccessControl(p.AccessControl)
+		tlsServer.Handler.SetRateLimiter(p.RateLimiter)
+		tlsServer.Listener, err = listen(p.Config.TLS.Listener, p.Config.TLS.Port)
+		if err != nil {
+			return nil, err
+		}
+		tlsServer.ShutdownTimeout = shutdownTimeout
+		if p.Metrics != nil {
+			p.Metrics.TrackUpstreams("tls", tlsServer.Handler)
+			p.Metrics.InstrumentTLS("tls", tlsServer.Server, tlsServer.Certs)
+		}
+		instrument("tls", tlsServer.Server, tlsServer.Conns)
+		p.Readiness.AddCheck("tls certificate", certificateCheck(tlsServer.Certs))
+		p.Readiness.AddCheck("tls upstreams", upstreamCheck(tlsServer.Handler))
+		p.TLSServer = tlsServer
+		toRun = append(toRun, tlsServer)
+	}
+
+	if p.Config.HTTP.Enabled {
+		httpServer, err := NewHTTPServer(p.Log, p.Config.HTTP)
+		if err != nil {
+			return nil, err
+		}
+		router, err := p.newRouter(p.Config.HTTP.Upstream, p.Config)
+		if err != nil {
+			return nil, err
+		}
+		httpServer.Handler.SetRouter(router)
+		httpServer.Handler.SetAccessControl(p.AccessControl)
+		httpServer.Handler.SetRateLimiter(p.RateLimiter)
+		httpServer.Listener, err = listen(p.Config.HTTP.Listener, p.Config.HTTP.Port)
+		if err != nil {
+			return nil, err
+		}
+		httpServer.ShutdownTimeout = shutdownTimeout
+		if p.Metrics != nil {
+			p.Metrics.TrackUpstreams("http", httpServer.Handler)
+		}
+		instrument("http", httpServer.Server, httpServer.Conns)
+		p.Readiness.AddCheck("http upstreams", upstreamCheck(httpServer.Handler))
+		p.HTTPServer = httpServer
+		toRun = append(toRun, httpServer)
+	}
+
+	if p.Config.Redirect.Enabled {
+		redirect := NewRedirect(p.Log, p.Config.Redirect)
+		var err error
+		redirect.Listener, err = listen(p.Config.Redirect.Listener, p.Config.Redirect.Port)
+		if err != nil {
+			return nil, err
+		}
+		redirect.ShutdownTimeout = shutdownTimeout
+		instrument("redirect", redirect.Server, redirect.Conns)
+		p.RedirectServer = redirect
+		toRun = append(toRun, redirect)
+	}
+
+	if len(toRun) > 0 && p.Metrics != nil {
+		metrics := NewMetricsServer(p.Log, p.Config.Metrics, p.Metrics)
+		var err error
+		metrics.Listener, err = listen(p.Config.Metrics.Listener, p.Config.Metrics.Port)
+		if err != nil {
+			return nil, err
+		}
+		metrics.ShutdownTimeout = shutdownTimeout
+		p.MetricsServer = metrics
+		toRun = append(toRun, metrics)
+	}
+
+	if len(toRun) > 0 && p.Config.Admin.Enabled {
+		admin := NewAdminServer(p.Log, p.Config.Admin, p)
+		if l, ok := p.Listeners[p.Config.Admin.Listener]; ok && l != nil {
+			admin.Listener = l
+		} else {
+			l, err := ListenAdmin(p.Config.Admin)
+			if err != nil {
+				return nil, err
+			}
+			admin.Listener = l
+			bound[p.Config.Admin.Listener] = l
+			p.Listeners[p.Config.Admin.Listener] = l
+		}
+		admin.ShutdownTimeout = shutdownTimeout
+		p.AdminServer = admin
+		toRun = append(toRun, admin)
+	}
+
+	if len(toRun) == 0 {
+		return nil, fmt.Errorf("no servers enabled")
+	}
+	return toRun, nil
+}
+
+// newRouter builds the router for a server, with upstreams drained through the
+// admin api staying drained.
+func (p *Proxy) newRouter(upstream string, cfg Config) (*Router, error) {
+	router, err := NewRouter(upstream, cfg.Upstreams, cfg.Routes)
+	if err != nil {
+		return nil, err
+	}
+	router.SetDrains(p.Drains)
+	router.SetLog(p.Log)
+	router.SetForwarding(p.Forwarding)
+	return router, nil
+}
+
 func BindAddr(port uint16) string {
 	return fmt.Sprintf("0.0.0.0:%d", port)
 }
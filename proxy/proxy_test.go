@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+func TestBuildServersReleasesEverythingOnError(t *testing.T) {
+	busy, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	disabled := false
+	cfg := ConfigOrDefault(Config{
+		TLS:       TLSConfig{Enabled: &disabled},
+		HTTP:      HTTPConfig{Enabled: true, Upstream: "http://localhost:8080"},
+		Redirect:  RedirectConfig{Enabled: true, Port: uint16(busy.Addr().(*net.TCPAddr).Port)},
+		AccessLog: AccessLogConfig{Output: filepath.Join(t.TempDir(), "access.log")},
+	})
+	cfg.HTTP.Port = 0
+	p := &Proxy{Config: cfg, Log: logger.None(), Readiness: &Readiness{}}
+	if _, err := p.buildServers(); err == nil {
+		t.Fatal("redirect bound a busy port")
+	}
+
+	if len(p.Listeners) != 0 {
+		t.Errorf("kept listeners %v after failing", p.Listeners)
+	}
+	httpListener := p.HTTPServer.(*HTTPServer).Listener
+	if _, err := httpListener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("http listener accept got %v, want it closed", err)
+	}
+	if err := p.AccessLog.Log(AccessLogEntry{}); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("access log write got %v, want it closed", err)
+	}
+}
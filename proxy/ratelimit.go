@@ -0,0 +1,376 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+const (
+	RateLimitKeyIP     = "ip"
+	RateLimitKeyMTLS   = "mtls"
+	RateLimitKeyHeader = "header:"
+
+	RateLimitOnErrorLocal  = "local"
+	RateLimitOnErrorOpen   = "open"
+	RateLimitOnErrorClosed = "closed"
+)
+
+// RateLimitConfig allows Requests every Period per client, in bursts of up to
+// Burst.
+type RateLimitConfig struct {
+	Requests int      `yaml:"requests"`
+	Period   Duration `yaml:"period"`
+	// Burst defaults to Requests
+	Burst int `yaml:"burst"`
+	// Key is ip, header:<name> or mtls for the subject of a verified client
+	// certificate, falling back to the ip. Header values are not verified, so
+	// their requests are limited by ip as well.
+	Key string `yaml:"key"`
+	// MaxKeys, Redis and OnError are only read from the global limit
+	MaxKeys int         `yaml:"maxKeys"`
+	Redis   RedisConfig `yaml:"redis"`
+	// OnError is local, open or closed while redis is unreachable
+	OnError string `yaml:"onError"`
+}
+
+func (c RateLimitConfig) IsEnabled() bool {
+	return c.Requests > 0
+}
+
+func rateLimitOrDefault(cfg RateLimitConfig) RateLimitConfig {
+	if cfg.Period == 0 {
+		cfg.Period = Duration(time.Second)
+	}
+	if cfg.Burst == 0 {
+		cfg.Burst = cfg.Requests
+	}
+	if len(cfg.Key) == 0 {
+		cfg.Key = RateLimitKeyIP
+	}
+	if len(cfg.OnError) == 0 {
+		cfg.OnError = RateLimitOnErrorLocal
+	}
+	return cfg
+}
+
+func validRateLimitKey(key string) bool {
+	switch {
+	case key == RateLimitKeyIP, key == RateLimitKeyMTLS:
+		return true
+	case strings.HasPrefix(key, RateLimitKeyHeader):
+		return validHeaderName(strings.TrimPrefix(key, RateLimitKeyHeader))
+	}
+	return false
+}
+
+type RateLimitDecision struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimitConfig) (RateLimitDecision, error)
+	// Refund returns a request another limit rejected
+	Refund(ctx context.Context, key string, limit RateLimitConfig) error
+}
+
+// RateLimiter keeps buckets across reloads, so a reload does not reset
+// clients' limits.
+type RateLimiter struct {
+	Log logger.Log
+
+	lock   sync.RWMutex
+	global RateLimitConfig
+	memory *MemoryRateLimitStore
+	redis  *RedisRateLimitStore
+	// redisConfig is before defaults
+	redisConfig RedisConfig
+	failing     int32
+}
+
+func NewRateLimiter(log logger.Log, cfg RateLimitConfig) *RateLimiter {
+	rl := &RateLimiter{Log: log, memory: NewMemoryRateLimitStore(cfg.MaxKeys)}
+	rl.SetConfig(cfg)
+	return rl
+}
+
+// SetConfig reconnects to redis only when its settings changed.
+func (rl *RateLimiter) SetConfig(cfg RateLimitConfig) {
+	cfg = rateLimitOrDefault(cfg)
+	rl.memory.Resize(cfg.MaxKeys)
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.redis != nil && (len(cfg.Redis.Address) == 0 || rl.redisConfig != cfg.Redis) {
+		rl.redis.Client.Close()
+		rl.redis = nil
+	}
+	if rl.redis == nil && len(cfg.Redis.Address) > 0 {
+		rl.redis = NewRedisRateLimitStore(NewRedisClient(cfg.Redis))
+		rl.redisConfig = cfg.Redis
+	}
+	rl.global = cfg
+}
+
+func (rl *RateLimiter) Close() error {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if rl.redis == nil {
+		return nil
+	}
+	return rl.redis.Client.Close()
+}
+
+// Allow answers 429 itself when the global or route bucket is empty, returning
+// the request to the buckets it was taken from. The headers describe the
+// bucket closest to running out.
+func (rl *RateLimiter) Allow(rw http.ResponseWriter, req *http.Request, route *Route) bool {
+	rl.lock.RLock()
+	global := rl.global
+	var store RateLimitStore = rl.memory
+	if rl.redis != nil {
+		store = rl.redis
+	}
+	rl.lock.RUnlock()
+
+	limits := map[string]RateLimitConfig{}
+	if global.IsEnabled() {
+		limits["global"] = global
+	}
+	if route != nil && route.Config.RateLimit != nil && route.Config.RateLimit.IsEnabled() {
+		limits["route:"+routeName(route.Config)] = rateLimitOrDefault(*route.Config.RateLimit)
+	}
+	if len(limits) == 0 {
+		return true
+	}
+
+	var buckets []rateLimitTake
+	for _, scope := range sortedKeys(limits) {
+		for _, client := range rateLimitKeys(limits[scope].Key, req) {
+			buckets = append(buckets, rateLimitTake{key: scope + "|" + client, limit: limits[scope]})
+		}
+	}
+
+	var shown *RateLimitDecision
+	var taken []rateLimitTake
+	for _, b := range buckets {
+		decision, used, err := rl.take(req.Context(), store, global, b.key, b.limit)
+		if err != nil {
+			rl.refund(req.Context(), taken)
+			rw.Header().Set("Retry-After", "1")
+			http.Error(rw, "rate limit unavailable", http.StatusServiceUnavailable)
+			return false
+		}
+		if shown == nil || !decision.Allowed || decision.Remaining < shown.Remaining {
+			shown = &decision
+		}
+		if !decision.Allowed {
+			rl.refund(req.Context(), taken)
+			break
+		}
+		if used != nil {
+			b.store = used
+			taken = append(taken, b)
+		}
+	}
+	header := rw.Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(shown.Limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(shown.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(shown.Reset)))
+	if shown.Allowed {
+		return true
+	}
+	header.Set("Retry-After", strconv.Itoa(ceilSeconds(shown.RetryAfter)))
+	http.Error(rw, "rate limit exceeded", http.StatusTooManyRequests)
+	return false
+}
+
+type rateLimitTake struct {
+	store RateLimitStore
+	key   string
+	limit RateLimitConfig
+}
+
+func (rl *RateLimiter) refund(ctx context.Context, taken []rateLimitTake) {
+	for _, t := range taken {
+		if err := t.store.Refund(ctx, t.key, t.limit); err != nil {
+			rl.Log.Warningf("Rate limit refund of %s failed: %v", t.key, err)
+		}
+	}
+}
+
+// take applies the onError policy when redis cannot be reached, returning the
+// store the request was taken from, nil when failing open.
+func (rl *RateLimiter) take(ctx context.Context, store RateLimitStore, global RateLimitConfig, key string, limit RateLimitConfig) (RateLimitDecision, RateLimitStore, error) {
+	decision, err := store.Take(ctx, key, limit)
+	if store == RateLimitStore(rl.memory) {
+		return decision, store, err
+	}
+	if err == nil {
+		if atomic.CompareAndSwapInt32(&rl.failing, 1, 0) {
+			rl.Log.Infof("Rate limit store redis %s reachable again", global.Redis.Address)
+		}
+		return decision, store, nil
+	}
+	if atomic.CompareAndSwapInt32(&rl.failing, 0, 1) {
+		rl.Log.Warningf("Rate limit store redis %s failed, falling back to %s: %v", global.Redis.Address, global.OnError, err)
+	}
+	switch global.OnError {
+	case RateLimitOnErrorOpen:
+		return RateLimitDecision{Allowed: true, Limit: limit.Burst, Remaining: limit.Burst}, nil, nil
+	case RateLimitOnErrorClosed:
+		return RateLimitDecision{}, nil, err
+	default:
+		decision, err := rl.memory.Take(ctx, key, limit)
+		return decision, rl.memory, err
+	}
+}
+
+type MemoryRateLimitStore struct {
+	lock    sync.Mutex
+	buckets *bucketCache
+}
+
+func NewMemoryRateLimitStore(maxKeys int) *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: newBucketCache(maxKeys)}
+}
+
+func (m *MemoryRateLimitStore) Resize(maxKeys int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.buckets.resize(maxKeys)
+}
+
+func (m *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimitConfig) (RateLimitDecision, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	perSecond := float64(limit.Requests) / limit.Period.Duration().Seconds()
+	burst := float64(limit.Burst)
+	b := m.buckets.get(key, func() *bucket {
+		return &bucket{tokens: burst, last: now}
+	})
+
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	decision := RateLimitDecision{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = seconds((1 - b.tokens) / perSecond)
+	}
+	decision.Remaining = int(b.tokens)
+	decision.Reset = seconds((burst - b.tokens) / perSecond)
+	return decision, nil
+}
+
+func (m *MemoryRateLimitStore) Refund(ctx context.Context, key string, limit RateLimitConfig) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if b := m.buckets.peek(key); b != nil {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+1)
+	}
+	return nil
+}
+
+// rateLimitKeys puts the ip before a header, so clients sending a new value
+// with every request only add buckets while their ip is allowed.
+func rateLimitKeys(key string, req *http.Request) []string {
+	ip := "ip=" + req.RemoteAddr
+	if clientIP := clientIP(req); clientIP != nil {
+		ip = "ip=" + clientIP.String()
+	}
+	switch {
+	case strings.HasPrefix(key, RateLimitKeyHeader):
+		if value := req.Header.Get(strings.TrimPrefix(key, RateLimitKeyHeader)); len(value) > 0 {
+			return []string{ip, key + "=" + value}
+		}
+	case key == RateLimitKeyMTLS:
+		if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+			return []string{"mtls=" + req.TLS.VerifiedChains[0][0].Subject.String()}
+		}
+	}
+	return []string{ip}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// bucketCache evicts the least recently seen clients.
+type bucketCache struct {
+	max     int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type bucketEntry struct {
+	key    string
+	bucket *bucket
+}
+
+const DefaultRateLimitMaxKeys = 100000
+
+func newBucketCache(max int) *bucketCache {
+	c := &bucketCache{order: list.New(), entries: map[string]*list.Element{}}
+	c.resize(max)
+	return c
+}
+
+func (c *bucketCache) resize(max int) {
+	if max <= 0 {
+		max = DefaultRateLimitMaxKeys
+	}
+	c.max = max
+	c.evict()
+}
+
+func (c *bucketCache) get(key string, create func() *bucket) *bucket {
+	if element, ok := c.entries[key]; ok {
+		c.order.MoveToFront(element)
+		return element.Value.(*bucketEntry).bucket
+	}
+	entry := &bucketEntry{key: key, bucket: create()}
+	c.entries[key] = c.order.PushFront(entry)
+	c.evict()
+	return entry.bucket
+}
+
+// peek does not mark the bucket used.
+func (c *bucketCache) peek(key string) *bucket {
+	if element, ok := c.entries[key]; ok {
+		return element.Value.(*bucketEntry).bucket
+	}
+	return nil
+}
+
+func (c *bucketCache) evict() {
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*bucketEntry).key)
+	}
+}
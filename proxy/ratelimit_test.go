@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+func TestRateLimiterRefundsOnDeny(t *testing.T) {
+	limiter := NewRateLimiter(logger.None(), RateLimitConfig{Requests: 3, Period: Duration(time.Hour)})
+	limited := &Route{Config: RouteConfig{Name: "limited", RateLimit: &RateLimitConfig{Requests: 1, Period: Duration(time.Hour)}}}
+	allow := func(route *Route) (bool, *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		return limiter.Allow(rec, httptest.NewRequest(http.MethodGet, "/", nil), route), rec
+	}
+
+	if ok, _ := allow(limited); !ok {
+		t.Fatal("first request to the limited route was rejected")
+	}
+	for i := 0; i < 5; i++ {
+		ok, rec := allow(limited)
+		if ok || rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("request %d to the limited route returned %d", i, rec.Code)
+		}
+		if rec.Header().Get("RateLimit-Limit") != "1" || len(rec.Header().Get("Retry-After")) == 0 {
+			t.Errorf("rejection headers %v do not describe the route limit", rec.Header())
+		}
+	}
+	// the rejected requests were returned to the global bucket
+	for i := 0; i < 2; i++ {
+		if ok, rec := allow(nil); !ok {
+			t.Fatalf("global request %d returned %d", i, rec.Code)
+		}
+	}
+	if ok, _ := allow(nil); ok {
+		t.Error("global limit was not enforced")
+	}
+}
+
+func TestRateLimiterHeaderKeyLimitsIP(t *testing.T) {
+	limiter := NewRateLimiter(logger.None(), RateLimitConfig{Requests: 2, Period: Duration(time.Hour), Key: "header:X-Api-Key"})
+	allow := func(remoteAddr, apiKey string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Api-Key", apiKey)
+		return limiter.Allow(httptest.NewRecorder(), req, nil)
+	}
+
+	if !allow("192.0.2.1:1000", "a") || !allow("192.0.2.2:1000", "a") {
+		t.Fatal("first requests with key a were rejected")
+	}
+	if allow("192.0.2.3:1000", "a") {
+		t.Error("key a was allowed past its limit from another ip")
+	}
+	// a new key for every request does not get around the limit of the ip
+	if !allow("192.0.2.9:1000", "b") || !allow("192.0.2.9:1000", "c") {
+		t.Fatal("first requests from 192.0.2.9 were rejected")
+	}
+	if allow("192.0.2.9:1000", "d") {
+		t.Error("a fresh key was allowed past the limit of its ip")
+	}
+	if n := len(limiter.memory.buckets.entries); n != 7 {
+		t.Errorf("tracking %d buckets, want 7", n)
+	}
+}
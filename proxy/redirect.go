@@ -1,53 +1,85 @@
 package proxy
 
 import (
-	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/blend/go-sdk/logger"
 )
 
 type HTTPRedirect struct {
-	Log    logger.Log
-	Config RedirectConfig
-	Server *http.Server
+	Log             logger.Log
+	Config          RedirectConfig
+	Server          *http.Server
+	Listener        net.Listener
+	Conns           *ConnTracker
+	ShutdownTimeout time.Duration
+
+	lock     sync.RWMutex
+	listener rebindableListener
 }
 
 func NewRedirect(log logger.Log, cfg RedirectConfig) *HTTPRedirect {
 	h := &HTTPRedirect{
 		Log:    log,
 		Config: cfg,
+		Conns:  NewConnTracker(),
 	}
 	server := &http.Server{
 		Addr:    BindAddr(cfg.Port),
 		Handler: h,
 	}
+	cfg.Limits.Apply(server)
+	h.Conns.Install(server)
 	h.Server = server
 	return h
 }
 
 func (hr *HTTPRedirect) Start() error {
-	hr.Log.Infof("Starting Redirect Server on %s", hr.Server.Addr)
-	hr.Server.Handler = hr
-	return hr.Server.ListenAndServe()
+	if hr.Listener == nil {
+		l, err := net.Listen("tcp", hr.Server.Addr)
+		if err != nil {
+			return err
+		}
+		hr.Listener = l
+	}
+	hr.listener.set(hr.Listener)
+	hr.Log.Infof("Starting Redirect Server on %s", hr.Listener.Addr())
+	return hr.listener.serve(hr.Server.Serve)
 }
 
-func (hr *HTTPRedirect) Stop() error {
-	hr.Log.Infof("Stopping Redirect Server")
-	err := hr.Server.Shutdown(context.Background())
-	hr.Log.Infof("Redirect Server stopped")
-	return err
+// SetConfig replaces the redirect settings used for new requests.
+func (hr *HTTPRedirect) SetConfig(cfg RedirectConfig) {
+	hr.lock.Lock()
+	defer hr.lock.Unlock()
+	hr.Config = cfg
+}
 
+// Rebind moves the server onto a new listener, closing the old one.
+func (hr *HTTPRedirect) Rebind(l net.Listener) {
+	hr.Log.Infof("Moving Redirect Server to %s", l.Addr())
+	hr.Listener = l
+	hr.listener.rebind(l)
+}
+
+func (hr *HTTPRedirect) Stop() error {
+	return shutdownServer(hr.Log, "Redirect", hr.Server, hr.Conns, hr.ShutdownTimeout)
 }
 
 func (hr *HTTPRedirect) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	hr.lock.RLock()
+	cfg := hr.Config
+	hr.lock.RUnlock()
+
 	original := req.URL.String()
 	req.URL.Scheme = "https"
-	host, err := hr.replacePort(req.Host, hr.Config.UpstreamPort)
+	host, err := hr.replacePort(req.Host, cfg.UpstreamPort)
 	if err != nil {
-		hr.Log.Errorf("Bad host for redirect request %s", original)
+		hr.Log.ErrorfContext(req.Context(), "Bad host for redirect request %s", original)
 		if len(req.Host) == 0 {
 			rw.WriteHeader(http.StatusBadRequest)
 			return
@@ -55,7 +87,7 @@ func (hr *HTTPRedirect) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 	req.URL.Host = host
 	req.Host = host
-	hr.Log.Infof("Redirecting request for %s to %s", original, req.URL.String())
+	hr.Log.InfofContext(req.Context(), "Redirecting request for %s to %s", original, req.URL.String())
 	http.Redirect(rw, req, req.URL.String(), http.StatusMovedPermanently)
 }
 
@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RedisConfig struct {
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password" secret:"true"`
+	DB       int    `yaml:"db"`
+	// Timeout bounds connecting and each command, defaulting to 100ms so an
+	// unreachable server adds little latency before the fallback applies
+	Timeout Duration `yaml:"timeout"`
+	// KeyPrefix defaults to tls-proxy:
+	KeyPrefix string `yaml:"keyPrefix"`
+	MaxIdle   int    `yaml:"maxIdle"`
+}
+
+type RedisError string
+
+func (e RedisError) Error() string {
+	return string(e)
+}
+
+// RedisClient speaks just enough RESP2.
+type RedisClient struct {
+	Config RedisConfig
+
+	lock   sync.Mutex
+	idle   []*redisConn
+	closed bool
+}
+
+type redisConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func NewRedisClient(cfg RedisConfig) *RedisClient {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = Duration(100 * time.Millisecond)
+	}
+	if len(cfg.KeyPrefix) == 0 {
+		cfg.KeyPrefix = "tls-proxy:"
+	}
+	if cfg.MaxIdle == 0 {
+		cfg.MaxIdle = 16
+	}
+	return &RedisClient{Config: cfg}
+}
+
+// Do returns a string, int64, []interface{}, nil or a RedisError. A pooled
+// connection the server has since closed is retried once on a new one.
+func (c *RedisClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, pooled, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.run(ctx, conn, args...)
+	var redisErr RedisError
+	if err != nil && !errors.As(err, &redisErr) && pooled && ctx.Err() == nil {
+		if conn, err = c.dial(ctx); err != nil {
+			return nil, err
+		}
+		return c.run(ctx, conn, args...)
+	}
+	return reply, err
+}
+
+// run closes conn instead of pooling it when it is in an unknown state.
+func (c *RedisClient) run(ctx context.Context, conn *redisConn, args ...string) (interface{}, error) {
+	reply, err := conn.do(ctx, c.Config.Timeout.Duration(), args...)
+	var redisErr RedisError
+	if err != nil && !errors.As(err, &redisErr) {
+		conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return reply, err
+}
+
+// Close leaves connections in use to be closed as they are returned.
+func (c *RedisClient) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (c *RedisClient) get(ctx context.Context) (*redisConn, bool, error) {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil, false, fmt.Errorf("redis client closed")
+	}
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.lock.Unlock()
+		return conn, true, nil
+	}
+	c.lock.Unlock()
+	conn, err := c.dial(ctx)
+	return conn, false, err
+}
+
+func (c *RedisClient) put(conn *redisConn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed || len(c.idle) >= c.Config.MaxIdle {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+func (c *RedisClient) dial(ctx context.Context) (*redisConn, error) {
+	timeout := c.Config.Timeout.Duration()
+	dialer := net.Dialer{Timeout: timeout}
+	raw, err := dialer.DialContext(ctx, "tcp", c.Config.Address)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: raw, reader: bufio.NewReader(raw)}
+	if len(c.Config.Password) > 0 {
+		args := []string{"AUTH", c.Config.Password}
+		if len(c.Config.Username) > 0 {
+			args = []string{"AUTH", c.Config.Username, c.Config.Password}
+		}
+		if _, err := conn.do(ctx, timeout, args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis auth: %w", err)
+		}
+	}
+	if c.Config.DB != 0 {
+		if _, err := conn.do(ctx, timeout, "SELECT", strconv.Itoa(c.Config.DB)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis select: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (conn *redisConn) do(ctx context.Context, timeout time.Duration, args ...string) (interface{}, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(conn, sb.String()); err != nil {
+		return nil, err
+	}
+	return conn.read()
+}
+
+func (conn *redisConn) read() (interface{}, error) {
+	line, err := conn.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, RedisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("malformed redis reply %q", line)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(conn.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("malformed redis reply %q", line)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			item, err := conn.read()
+			var redisErr RedisError
+			if err != nil && !errors.As(err, &redisErr) {
+				return nil, err
+			}
+			if err != nil {
+				item = redisErr
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("malformed redis reply %q", line)
+	}
+}
+
+// gcraScript is the generic cell rate algorithm: the key holds the
+// theoretical arrival time of the next request in milliseconds of the
+// server's clock, so every proxy agrees on it. It returns whether the request
+// is allowed, the requests remaining, and the milliseconds until a retry
+// would be allowed and until the bucket is full again.
+const gcraScript = `
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then
+  tat = now
+end
+local nextTat = tat + interval
+local allowAt = nextTat - interval * burst
+if allowAt > now then
+  return {0, 0, math.ceil(allowAt - now), math.ceil(tat - now)}
+end
+redis.call("SET", KEYS[1], tostring(nextTat), "PX", math.ceil(nextTat - now))
+return {1, math.floor((now - allowAt) / interval), 0, math.ceil(nextTat - now)}
+`
+
+// gcraRefundScript moves the theoretical arrival time back one interval.
+const gcraRefundScript = `
+local interval = tonumber(ARGV[1])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local tat = tonumber(redis.call("GET", KEYS[1]) or now) - interval
+if tat <= now then
+  redis.call("DEL", KEYS[1])
+  return 0
+end
+redis.call("SET", KEYS[1], tostring(tat), "PX", math.ceil(tat - now))
+return 1
+`
+
+var (
+	gcraScriptSHA       = scriptSHA(gcraScript)
+	gcraRefundScriptSHA = scriptSHA(gcraRefundScript)
+)
+
+func scriptSHA(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+type RedisRateLimitStore struct {
+	Client *RedisClient
+}
+
+func NewRedisRateLimitStore(client *RedisClient) *RedisRateLimitStore {
+	return &RedisRateLimitStore{Client: client}
+}
+
+func (r *RedisRateLimitStore) Take(ctx context.Context, key string, limit RateLimitConfig) (RateLimitDecision, error) {
+	reply, err := r.eval(ctx, gcraScript, gcraScriptSHA, key, limit, strconv.Itoa(limit.Burst))
+	if err != nil {
+		return RateLimitDecision{}, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 4 {
+		return RateLimitDecision{}, fmt.Errorf("unexpected rate limit script reply %v", reply)
+	}
+	ints := make([]int64, len(values))
+	for i, value := range values {
+		n, ok := value.(int64)
+		if !ok {
+			return RateLimitDecision{}, fmt.Errorf("unexpected rate limit script reply %v", reply)
+		}
+		ints[i] = n
+	}
+	return RateLimitDecision{
+		Allowed:    ints[0] == 1,
+		Limit:      limit.Burst,
+		Remaining:  int(ints[1]),
+		RetryAfter: time.Duration(ints[2]) * time.Millisecond,
+		Reset:      time.Duration(ints[3]) * time.Millisecond,
+	}, nil
+}
+
+func (r *RedisRateLimitStore) Refund(ctx context.Context, key string, limit RateLimitConfig) error {
+	_, err := r.eval(ctx, gcraRefundScript, gcraRefundScriptSHA, key, limit)
+	return err
+}
+
+func (r *RedisRateLimitStore) eval(ctx context.Context, script, sha, key string, limit RateLimitConfig, extra ...string) (interface{}, error) {
+	interval := float64(limit.Period.Duration()) / float64(time.Millisecond) / float64(limit.Requests)
+	args := append([]string{
+		sha, "1", r.Client.Config.KeyPrefix + "ratelimit:" + key,
+		strconv.FormatFloat(interval, 'f', -1, 64),
+	}, extra...)
+	reply, err := r.Client.Do(ctx, append([]string{"EVALSHA"}, args...)...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		// the server has not seen the script yet, EVAL caches it
+		args[0] = script
+		reply, err = r.Client.Do(ctx, append([]string{"EVAL"}, args...)...)
+	}
+	return reply, err
+}
@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+// respServer speaks just enough RESP for the client, answering each command
+// with reply.
+type respServer struct {
+	net.Listener
+	lock  sync.Mutex
+	conns []net.Conn
+}
+
+func serveRESP(t *testing.T, reply func(args []string) string) *respServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &respServer{Listener: l}
+	t.Cleanup(r.stop)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r.lock.Lock()
+			r.conns = append(r.conns, conn)
+			r.lock.Unlock()
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					args, err := readRESPCommand(reader)
+					if err != nil {
+						return
+					}
+					io.WriteString(conn, reply(args))
+				}
+			}()
+		}
+	}()
+	return r
+}
+
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// dropConns closes the accepted connections, as a redis restart or idle
+// timeout would.
+func (r *respServer) dropConns() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+	r.conns = nil
+}
+
+func (r *respServer) stop() {
+	r.Listener.Close()
+	r.dropConns()
+}
+
+func TestRedisClientReconnects(t *testing.T) {
+	server := serveRESP(t, func(args []string) string {
+		if args[0] == "PING" {
+			return "+PONG\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	})
+	client := NewRedisClient(RedisConfig{Address: server.Addr().String(), Timeout: Duration(time.Second)})
+	defer client.Close()
+
+	if reply, err := client.Do(context.Background(), "PING"); err != nil || reply != "PONG" {
+		t.Fatalf("got %v, %v", reply, err)
+	}
+	if len(client.idle) != 1 {
+		t.Fatalf("%d idle connections, want 1", len(client.idle))
+	}
+	server.dropConns()
+	if reply, err := client.Do(context.Background(), "PING"); err != nil || reply != "PONG" {
+		t.Fatalf("dead pooled connection was not replaced: %v, %v", reply, err)
+	}
+	if _, err := client.Do(context.Background(), "NOPE"); err == nil || err.Error() != "ERR unknown command" {
+		t.Errorf("got error %v, want the server's", err)
+	}
+	if len(client.idle) != 1 {
+		t.Errorf("an error reply did not return the connection to the pool")
+	}
+}
+
+func TestRedisRateLimitStoreLoadsScript(t *testing.T) {
+	// the script is only known once sent with EVAL, as after a redis restart
+	var lock sync.Mutex
+	var sent []string
+	loaded := map[string]bool{}
+	taken := 0
+	server := serveRESP(t, func(args []string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		sent = append(sent, args[0])
+		sha := args[1]
+		if args[0] == "EVAL" {
+			sum := sha1.Sum([]byte(args[1]))
+			sha = hex.EncodeToString(sum[:])
+			loaded[sha] = true
+		} else if !loaded[sha] {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+		if burst, _ := strconv.Atoi(args[5]); taken < burst {
+			taken++
+			return fmt.Sprintf("*4\r\n:1\r\n:%d\r\n:0\r\n:1000\r\n", burst-taken)
+		}
+		return "*4\r\n:0\r\n:0\r\n:1000\r\n:1000\r\n"
+	})
+	commands := func() string {
+		lock.Lock()
+		defer lock.Unlock()
+		commands := strings.Join(sent, " ")
+		sent = nil
+		return commands
+	}
+	store := NewRedisRateLimitStore(NewRedisClient(RedisConfig{Address: server.Addr().String(), Timeout: Duration(time.Second)}))
+	defer store.Client.Close()
+	limit := rateLimitOrDefault(RateLimitConfig{Requests: 2})
+
+	for i, want := range []bool{true, true, false} {
+		decision, err := store.Take(context.Background(), "client", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decision.Allowed != want || decision.Limit != 2 {
+			t.Errorf("request %d decided %+v", i, decision)
+		}
+	}
+	if got := commands(); got != "EVALSHA EVAL EVALSHA EVALSHA" {
+		t.Errorf("sent %s, want the script loaded once", got)
+	}
+}
+
+func TestRateLimiterRedisOnError(t *testing.T) {
+	cases := []struct {
+		onError string
+		codes   []int
+	}{
+		{RateLimitOnErrorLocal, []int{http.StatusOK, http.StatusTooManyRequests}},
+		{RateLimitOnErrorOpen, []int{http.StatusOK, http.StatusOK}},
+		{RateLimitOnErrorClosed, []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}},
+	}
+	for _, c := range cases {
+		t.Run(c.onError, func(t *testing.T) {
+			// allows the first request, then limits every other
+			var calls int32
+			server := serveRESP(t, func(args []string) string {
+				if atomic.AddInt32(&calls, 1) == 1 {
+					return "*4\r\n:1\r\n:0\r\n:0\r\n:1000\r\n"
+				}
+				return "*4\r\n:0\r\n:0\r\n:1000\r\n:1000\r\n"
+			})
+			limiter := NewRateLimiter(logger.None(), RateLimitConfig{
+				Requests: 1,
+				Period:   Duration(time.Hour),
+				Redis:    RedisConfig{Address: server.Addr().String(), Timeout: Duration(time.Second)},
+				OnError:  c.onError,
+			})
+			defer limiter.Close()
+			serve := func() int {
+				rec := httptest.NewRecorder()
+				if limiter.Allow(rec, httptest.NewRequest(http.MethodGet, "/", nil), nil) {
+					return http.StatusOK
+				}
+				return rec.Code
+			}
+
+			if code := serve(); code != http.StatusOK {
+				t.Fatalf("request through redis returned %d", code)
+			}
+			if code := serve(); code != http.StatusTooManyRequests {
+				t.Fatalf("redis limit returned %d", code)
+			}
+			server.stop()
+			for i, want := range c.codes {
+				if code := serve(); code != want {
+					t.Errorf("request %d without redis returned %d, want %d", i, code, want)
+				}
+			}
+			if limiter.failing != 1 {
+				t.Error("limiter did not notice redis failing")
+			}
+		})
+	}
+}
+
+func TestRedisRateLimitStoreRefunds(t *testing.T) {
+	var lock sync.Mutex
+	tokens := 1
+	server := serveRESP(t, func(args []string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		if args[0] != "EVALSHA" {
+			return "-ERR unknown command\r\n"
+		}
+		if args[1] == gcraRefundScriptSHA {
+			tokens++
+			return ":1\r\n"
+		}
+		if args[1] != gcraScriptSHA || tokens == 0 {
+			return "*4\r\n:0\r\n:0\r\n:1000\r\n:1000\r\n"
+		}
+		tokens--
+		return fmt.Sprintf("*4\r\n:1\r\n:%d\r\n:0\r\n:1000\r\n", tokens)
+	})
+	store := NewRedisRateLimitStore(NewRedisClient(RedisConfig{Address: server.Addr().String(), Timeout: Duration(time.Second)}))
+	defer store.Client.Close()
+	limit := rateLimitOrDefault(RateLimitConfig{Requests: 1})
+
+	for i, want := range []bool{true, false} {
+		if decision, err := store.Take(context.Background(), "client", limit); err != nil || decision.Allowed != want {
+			t.Fatalf("request %d decided %+v, %v", i, decision, err)
+		}
+	}
+	if err := store.Refund(context.Background(), "client", limit); err != nil {
+		t.Fatal(err)
+	}
+	if decision, err := store.Take(context.Background(), "client", limit); err != nil || !decision.Allowed {
+		t.Errorf("refunded request was not allowed: %+v, %v", decision, err)
+	}
+}
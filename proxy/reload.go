@@ -0,0 +1,321 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Listeners are only rebound when their port changed. If anything in the new
+// config fails to load the running config is kept.
+func (p *Proxy) Reload() error {
+	cfg, err := ReadConfigFile(p.File)
+	if err != nil {
+		return fmt.Errorf("rejected config, keeping the running one: %w", err)
+	}
+	next := ConfigOrDefault(*cfg)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	current := p.Config
+
+	// these decide which servers exist and what they were handed at startup
+	if next.TLS.IsEnabled() != current.TLS.IsEnabled() || next.HTTP.Enabled != current.HTTP.Enabled || next.Redirect.Enabled != current.Redirect.Enabled || next.Metrics.Enabled != current.Metrics.Enabled || next.Admin.Enabled != current.Admin.Enabled {
+		p.Log.Warningf("Enabling or disabling servers requires a restart, keeping the running servers")
+		next.TLS.Enabled = current.TLS.Enabled
+		next.HTTP.Enabled = current.HTTP.Enabled
+		next.Redirect.Enabled = current.Redirect.Enabled
+		next.Metrics.Enabled = current.Metrics.Enabled
+		next.Admin.Enabled = current.Admin.Enabled
+	}
+	if next.TLS.Listener != current.TLS.Listener || next.HTTP.Listener != current.HTTP.Listener || next.Redirect.Listener != current.Redirect.Listener || next.Metrics.Listener != current.Metrics.Listener || next.Admin.Listener != current.Admin.Listener {
+		p.Log.Warningf("Changing listener names requires a restart, keeping the current names")
+		next.TLS.Listener = current.TLS.Listener
+		next.HTTP.Listener = current.HTTP.Listener
+		next.Redirect.Listener = current.Redirect.Listener
+		next.Metrics.Listener = current.Metrics.Listener
+		next.Admin.Listener = current.Admin.Listener
+	}
+	if next.Reload != current.Reload {
+		p.Log.Warningf("Changing reload settings requires a restart, keeping the current settings")
+		next.Reload = current.Reload
+	}
+	if next.Health != current.Health {
+		p.Log.Warningf("Changing health paths requires a restart, keeping the current paths")
+		next.Health = current.Health
+	}
+	if next.TLS.Limits.ServerOnly() != current.TLS.Limits.ServerOnly() || next.HTTP.Limits.ServerOnly() != current.HTTP.Limits.ServerOnly() || next.Redirect.Limits != current.Redirect.Limits || next.Metrics.Limits != current.Metrics.Limits || next.Admin.Limits != current.Admin.Limits {
+		p.Log.Warningf("Changing server timeouts and header limits requires a restart, keeping the current ones")
+		next.TLS.Limits = mergeServerLimits(current.TLS.Limits, next.TLS.Limits)
+		next.HTTP.Limits = mergeServerLimits(current.HTTP.Limits, next.HTTP.Limits)
+		next.Redirect.Limits = current.Redirect.Limits
+		next.Metrics.Limits = current.Metrics.Limits
+		next.Admin.Limits = current.Admin.Limits
+	}
+	if !reflect.DeepEqual(next.Tracing, current.Tracing) {
+		p.Log.Warningf("Changing tracing settings requires a restart, keeping the current settings")
+		next.Tracing = current.Tracing
+	}
+	if next.RequestID.Enabled != current.RequestID.Enabled {
+		p.Log.Warningf("Enabling or disabling request ids requires a restart")
+		next.RequestID.Enabled = current.RequestID.Enabled
+	}
+	if next.TLS.ClientCA != current.TLS.ClientCA || next.TLS.ClientCAFile != current.TLS.ClientCAFile {
+		p.Log.Warningf("Changing client CAs requires a restart, keeping the current ones")
+		next.TLS.ClientCA, next.TLS.ClientCAFile = current.TLS.ClientCA, current.TLS.ClientCAFile
+	}
+	if next.AccessLog.IsEnabled() != current.AccessLog.IsEnabled() {
+		p.Log.Warningf("Enabling or disabling the access log requires a restart")
+		next.AccessLog.Enabled = current.AccessLog.Enabled
+	}
+
+	tlsServer, _ := p.TLSServer.(*TLSServer)
+	httpServer, _ := p.HTTPServer.(*HTTPServer)
+	redirect, _ := p.RedirectServer.(*HTTPRedirect)
+	metrics, _ := p.MetricsServer.(*MetricsServer)
+	admin, _ := p.AdminServer.(*AdminServer)
+
+	// load everything that can fail before touching the running servers
+	reject := func(err error) error {
+		return fmt.Errorf("rejected config, keeping the running one: %w", err)
+	}
+	if err := validate(next, nil); err != nil {
+		return reject(err)
+	}
+	var cert *tls.Certificate
+	var tlsRouter, httpRouter *Router
+	if tlsServer != nil {
+		cert, err = LoadCertificate(next.TLS)
+		if err != nil {
+			return reject(err)
+		}
+		tlsRouter, err = p.newRouter(next.TLS.Upstream, next)
+		if err != nil {
+			return reject(err)
+		}
+	}
+	if httpServer != nil {
+		httpRouter, err = p.newRouter(next.HTTP.Upstream, next)
+		if err != nil {
+			return reject(err)
+		}
+	}
+	accessRules, geoIP, err := loadAccess(next.Access, next.GeoIP)
+	if err != nil {
+		return reject(err)
+	}
+	routesChanged := !reflect.DeepEqual(next.Upstreams, current.Upstreams) || !reflect.DeepEqual(next.Routes, current.Routes)
+	if routesChanged {
+		p.Log.Infof("Reload: %d upstreams and %d routes", len(next.Upstreams), len(next.Routes))
+	}
+	rebinds := []func(){}
+	opened := []net.Listener{}
+	rebind := func(port, currentPort uint16, apply func(net.Listener)) error {
+		if port == currentPort {
+			return nil
+		}
+		l, err := net.Listen("tcp", BindAddr(port))
+		if err != nil {
+			for _, l := range opened {
+				l.Close()
+			}
+			return err
+		}
+		opened = append(opened, l)
+		rebinds = append(rebinds, func() { apply(l) })
+		return nil
+	}
+	if tlsServer != nil {
+		err = rebind(next.TLS.Port, current.TLS.Port, func(l net.Listener) {
+			tlsServer.Rebind(l)
+			p.Listeners[next.TLS.Listener] = l
+		})
+		if err != nil {
+			return reject(err)
+		}
+	}
+	if httpServer != nil {
+		err = rebind(next.HTTP.Port, current.HTTP.Port, func(l net.Listener) {
+			httpServer.Rebind(l)
+			p.Listeners[next.HTTP.Listener] = l
+		})
+		if err != nil {
+			return reject(err)
+		}
+	}
+	if redirect != nil {
+		err = rebind(next.Redirect.Port, current.Redirect.Port, func(l net.Listener) {
+			redirect.Rebind(l)
+			p.Listeners[next.Redirect.Listener] = l
+		})
+		if err != nil {
+			return reject(err)
+		}
+	}
+	if metrics != nil {
+		err = rebind(next.Metrics.Port, current.Metrics.Port, func(l net.Listener) {
+			metrics.Rebind(l)
+			p.Listeners[next.Metrics.Listener] = l
+		})
+		if err != nil {
+			return reject(err)
+		}
+	}
+	if admin != nil && next.Admin.Address != current.Admin.Address {
+		l, err := ListenAdmin(next.Admin)
+		if err != nil {
+			for _, l := range opened {
+				l.Close()
+			}
+			return reject(err)
+		}
+		opened = append(opened, l)
+		rebinds = append(rebinds, func() {
+			admin.Rebind(l)
+			p.Listeners[next.Admin.Listener] = l
+		})
+	}
+	if p.AccessLog != nil && !reflect.DeepEqual(next.AccessLog, current.AccessLog) {
+		// the last step that can fail, and it swaps the output straight away
+		if err := p.AccessLog.SetConfig(next.AccessLog); err != nil {
+			for _, l := range opened {
+				l.Close()
+			}
+			return reject(err)
+		}
+	}
+
+	shutdownTimeout := next.Shutdown.Timeout.Duration()
+	if tlsServer != nil {
+		if next.TLS.Upstream != current.TLS.Upstream {
+			p.Log.Infof("Reload: tls upstream %s -> %s", current.TLS.Upstream, next.TLS.Upstream)
+		}
+		if next.TLS.Upstream != current.TLS.Upstream || routesChanged {
+			tlsServer.Handler.SetRouter(tlsRouter)
+		}
+		tlsServer.Handler.SetLimits(next.TLS.Limits)
+		tlsServer.Certs.Set(cert)
+		tlsServer.ShutdownTimeout = shutdownTimeout
+	}
+	if httpServer != nil {
+		if next.HTTP.Upstream != current.HTTP.Upstream {
+			p.Log.Infof("Reload: http upstream %s -> %s", current.HTTP.Upstream, next.HTTP.Upstream)
+		}
+		if next.HTTP.Upstream != current.HTTP.Upstream || routesChanged {
+			httpServer.Handler.SetRouter(httpRouter)
+		}
+		httpServer.Handler.SetLimits(next.HTTP.Limits)
+		httpServer.ShutdownTimeout = shutdownTimeout
+	}
+	if redirect != nil {
+		redirect.SetConfig(next.Redirect)
+		redirect.ShutdownTimeout = shutdownTimeout
+	}
+	if p.RateLimiter != nil {
+		p.RateLimiter.SetConfig(next.RateLimit)
+	}
+	if p.AccessControl != nil {
+		p.AccessControl.set(accessRules, geoIP)
+	}
+	if p.Forwarding != nil {
+		// validated above, so the trusted CIDRs parse
+		p.Forwarding.SetConfig(next.Forwarded)
+	}
+	if p.RequestIDs != nil {
+		// ids from clients dropped from the trusted list are replaced from
+		// their next request on
+		p.RequestIDs.SetConfig(next.RequestID)
+	}
+	if metrics != nil {
+		metrics.SetConfig(next.Metrics)
+		metrics.ShutdownTimeout = shutdownTimeout
+	}
+	if admin != nil {
+		admin.SetConfig(next.Admin)
+		admin.ShutdownTimeout = shutdownTimeout
+	}
+	for _, apply := range rebinds {
+		apply()
+	}
+	if !reflect.DeepEqual(next.Log, current.Log) {
+		p.applyLogConfig(next.Log)
+	}
+
+	p.Config = next
+	p.Log.Infof("Reloaded config from %s", p.File)
+	return nil
+}
+
+func (p *Proxy) applyLogConfig(cfg LogConfig) {
+	if len(cfg.Flags) == 0 {
+		return
+	}
+	if p.LogFlags != nil {
+		p.LogFlags.Set(cfg.Flags...)
+	}
+}
+
+func (p *Proxy) handleReloads(done <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	var ticker *time.Ticker
+	var changes <-chan time.Time
+	var last string
+	if p.Config.Reload.Watch && len(p.File) > 0 {
+		last = p.sourcesStamp()
+		ticker = time.NewTicker(p.Config.Reload.Interval.Duration())
+		changes = ticker.C
+	}
+
+	go func() {
+		defer signal.Stop(signals)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+				p.Log.Infof("Received reload signal")
+			case <-changes:
+				stamp := p.sourcesStamp()
+				if stamp == last {
+					continue
+				}
+				last = stamp
+				p.Log.Infof("Config file %s or its includes changed", p.File)
+			}
+			if err := p.Reload(); err != nil {
+				p.Log.Errorf("%v", err)
+			}
+			// a reload may include different files
+			last = p.sourcesStamp()
+		}
+	}()
+}
+
+// directories are included so added and removed fragments are noticed
+func (p *Proxy) sourcesStamp() string {
+	p.lock.Lock()
+	sources := append([]string{p.File}, p.Config.Sources...)
+	p.lock.Unlock()
+
+	var sb strings.Builder
+	for _, source := range sources {
+		info, err := os.Stat(source)
+		if err != nil {
+			fmt.Fprintf(&sb, "%s:missing;", source)
+			continue
+		}
+		fmt.Fprintf(&sb, "%s:%d:%d;", source, info.ModTime().UnixNano(), info.Size())
+	}
+	return sb.String()
+}
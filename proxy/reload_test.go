@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func namedUpstream(t *testing.T, name string) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(name))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// reloadingProxy runs a proxy serving plain http from the config file, which
+// the returned function rewrites.
+func reloadingProxy(t *testing.T, config string) (*Proxy, func(string)) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yml")
+	write := func(config string) {
+		if err := os.WriteFile(file, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(config)
+	p, err := NewProxyFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Log = logger.None()
+	go p.Start()
+	t.Cleanup(func() { p.Stop() })
+	for deadline := time.Now().Add(5 * time.Second); !p.Readiness.Ready(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("proxy did not start")
+		}
+	}
+	return p, write
+}
+
+func reloadConfig(port uint16, upstream, extra string) string {
+	return fmt.Sprintf(`tls:
+  enabled: false
+http:
+  enabled: true
+  port: %d
+  upstream: %s
+accessLog:
+  enabled: false
+shutdown:
+  timeout: 1s
+%s`, port, upstream, extra)
+}
+
+func getBody(t *testing.T, port uint16) string {
+	t.Helper()
+	res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestReloadAppliesUpstreamAndKeepsRestartOnlySettings(t *testing.T) {
+	port := freePort(t)
+	a, b := namedUpstream(t, "a"), namedUpstream(t, "b")
+	p, write := reloadingProxy(t, reloadConfig(port, a, ""))
+	if got := getBody(t, port); got != "a" {
+		t.Fatalf("proxied to %q before reloading", got)
+	}
+	listener := p.HTTPServer.(*HTTPServer).Listener
+
+	write(reloadConfig(port, b, `health:
+  livenessPath: /live
+reload:
+  watch: true
+admin:
+  enabled: true
+`))
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := getBody(t, port); got != "b" {
+		t.Errorf("proxied to %q after reloading the upstream", got)
+	}
+	if p.Config.Reload.Watch || len(p.Config.Health.LivenessPath) > 0 || p.Config.Admin.Enabled || p.AdminServer != nil {
+		t.Errorf("restart only settings changed on reload: reload %+v, health %+v, admin %v", p.Config.Reload, p.Config.Health, p.Config.Admin.Enabled)
+	}
+	if p.HTTPServer.(*HTTPServer).Listener != listener {
+		t.Error("rebound the listener without a port change")
+	}
+}
+
+func TestReloadRejectedKeepsRunningConfig(t *testing.T) {
+	port := freePort(t)
+	a := namedUpstream(t, "a")
+	p, write := reloadingProxy(t, reloadConfig(port, a, ""))
+	running := p.Config
+
+	write(reloadConfig(freePort(t), a, `routes:
+  - path: /api
+    upstream: missing
+`))
+	err := p.Reload()
+	if err == nil || !strings.Contains(err.Error(), `unknown upstream "missing"`) {
+		t.Fatalf("got %v, want the unknown upstream rejected", err)
+	}
+	if p.Config.HTTP.Port != running.HTTP.Port || len(p.Config.Routes) != 0 {
+		t.Errorf("running config changed to port %d with %d routes", p.Config.HTTP.Port, len(p.Config.Routes))
+	}
+	if got := getBody(t, port); got != "a" {
+		t.Errorf("proxied to %q after a rejected reload", got)
+	}
+}
+
+func TestReloadRebindsChangedPort(t *testing.T) {
+	port, next := freePort(t), freePort(t)
+	a := namedUpstream(t, "a")
+	p, write := reloadingProxy(t, reloadConfig(port, a, ""))
+
+	write(reloadConfig(next, a, ""))
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := getBody(t, next); got != "a" {
+		t.Errorf("new port answered %q", got)
+	}
+	if addr := p.Listeners["http"].Addr().(*net.TCPAddr); addr.Port != int(next) {
+		t.Errorf("http listener is on %v, want port %d", addr, next)
+	}
+	if _, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/", port)); err == nil {
+		t.Error("old port still accepts connections")
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+type requestInfoKey struct{}
+
+type RequestInfo struct {
+	Server string
+	// before any rewriting
+	Host      string
+	RequestID string
+	// as told by any trusted proxies in front
+	ClientIP net.IP
+	Proto    string
+	User     string
+	Route    string
+	Upstream string
+	Target   string
+	Start    time.Time
+
+	UpstreamStart   time.Time
+	UpstreamLatency time.Duration
+}
+
+func GetRequestInfo(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+func withRequestInfo(req *http.Request, server string) (*http.Request, *RequestInfo) {
+	if info := GetRequestInfo(req.Context()); info != nil {
+		return req, info
+	}
+	info := &RequestInfo{Server: server, Host: req.Host, Start: time.Now()}
+	return req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info)), info
+}
+
+// Unwrap lets http.ResponseController reach the hijacker and flusher of the
+// underlying writer.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 && status >= 200 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(p)
+	rr.written += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) Flush() {
+	if flusher, ok := rr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+func (rr *responseRecorder) Status() int {
+	if rr.status == 0 {
+		return http.StatusOK
+	}
+	return rr.status
+}
+
+type bodyCounter struct {
+	io.ReadCloser
+	read int64
+}
+
+func (bc *bodyCounter) Read(p []byte) (int, error) {
+	n, err := bc.ReadCloser.Read(p)
+	bc.read += int64(n)
+	return n, err
+}
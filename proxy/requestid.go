@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+type RequestIDConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Header  string `yaml:"header"`
+	// clients whose own request id is kept
+	Trusted []string `yaml:"trusted"`
+}
+
+const RequestIDLabel = "request_id"
+
+type RequestIDs struct {
+	lock    sync.RWMutex
+	header  string
+	trusted []*net.IPNet
+}
+
+func NewRequestIDs(cfg RequestIDConfig) (*RequestIDs, error) {
+	rid := &RequestIDs{}
+	if err := rid.SetConfig(cfg); err != nil {
+		return nil, err
+	}
+	return rid, nil
+}
+
+func (rid *RequestIDs) SetConfig(cfg RequestIDConfig) error {
+	trusted, err := ParseCIDRs(cfg.Trusted)
+	if err != nil {
+		return err
+	}
+	rid.lock.Lock()
+	defer rid.lock.Unlock()
+	rid.header, rid.trusted = http.CanonicalHeaderKey(cfg.Header), trusted
+	return nil
+}
+
+func (rid *RequestIDs) Handler(server string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rid.lock.RLock()
+		header, trusted := rid.header, rid.trusted
+		rid.lock.RUnlock()
+
+		req, info := withRequestInfo(req, server)
+		id := req.Header.Get(header)
+		if !validRequestID(id) || !containsIP(trusted, remoteIP(req.RemoteAddr)) {
+			id = NewUUIDv7()
+		}
+		info.RequestID = id
+		req.Header.Set(header, id)
+		ctx := logger.WithLabel(req.Context(), RequestIDLabel, id)
+		next.ServeHTTP(&headerOverride{ResponseWriter: rw, key: header, value: id}, req.WithContext(ctx))
+	})
+}
+
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func NewUUIDv7() string {
+	var id [16]byte
+	rand.Read(id[6:])
+	ms := uint64(time.Now().UnixMilli())
+	binary.BigEndian.PutUint16(id[0:], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:], uint32(ms))
+	id[6] = 0x70 | id[6]&0x0f
+	id[8] = 0x80 | id[8]&0x3f
+	hexed := hex.EncodeToString(id[:])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", hexed[0:8], hexed[8:12], hexed[12:16], hexed[16:20], hexed[20:])
+}
+
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", value)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// replaces whatever the upstream sent for the header
+type headerOverride struct {
+	http.ResponseWriter
+	key, value  string
+	wroteHeader bool
+}
+
+func (ho *headerOverride) WriteHeader(status int) {
+	// informational responses are followed by the real headers
+	if !ho.wroteHeader && status >= 200 {
+		ho.wroteHeader = true
+		ho.Header().Set(ho.key, ho.value)
+	}
+	ho.ResponseWriter.WriteHeader(status)
+}
+
+func (ho *headerOverride) Write(p []byte) (int, error) {
+	if !ho.wroteHeader {
+		ho.WriteHeader(http.StatusOK)
+	}
+	return ho.ResponseWriter.Write(p)
+}
+
+func (ho *headerOverride) Flush() {
+	if !ho.wroteHeader {
+		ho.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := ho.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (ho *headerOverride) Unwrap() http.ResponseWriter {
+	return ho.ResponseWriter
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+var uuidV7 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequestIDTrust(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// the upstream's own id never reaches the client
+		rw.Header().Set("X-Request-Id", "from-upstream")
+		rw.Write([]byte(req.Header.Get("X-Request-Id")))
+	}))
+	defer upstream.Close()
+	proxy, err := NewProxyHandler(logger.None(), upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rid, err := NewRequestIDs(RequestIDConfig{Enabled: true, Header: "x-request-id", Trusted: []string{"10.0.0.0/8", "192.0.2.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := rid.Handler("tls", proxy)
+
+	cases := []struct {
+		name   string
+		remote string
+		id     string
+		kept   bool
+	}{
+		{"trusted network", "10.1.2.3:5000", "edge-1234", true},
+		{"trusted address", "192.0.2.1:5000", "edge-1234", true},
+		{"untrusted", "192.0.2.2:5000", "edge-1234", false},
+		{"trusted without an id", "10.1.2.3:5000", "", false},
+		{"trusted with a space", "10.1.2.3:5000", "edge 1234", false},
+		{"trusted and too long", "10.1.2.3:5000", strings.Repeat("a", 129), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = c.remote
+			if len(c.id) > 0 {
+				req.Header.Set("X-Request-Id", c.id)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			sent, returned := rec.Body.String(), rec.Header().Get("X-Request-Id")
+			if sent != returned {
+				t.Errorf("upstream got %q, client got %q", sent, returned)
+			}
+			if c.kept && sent != c.id {
+				t.Errorf("replaced a trusted id with %q", sent)
+			}
+			if !c.kept && !uuidV7.MatchString(sent) {
+				t.Errorf("sent %q upstream, want a generated id", sent)
+			}
+		})
+	}
+}
+
+func TestRequestIDsRejectBadTrustedCIDRs(t *testing.T) {
+	if _, err := NewRequestIDs(RequestIDConfig{Trusted: []string{"10.0.0.0/33"}}); err == nil || !strings.Contains(err.Error(), `invalid CIDR "10.0.0.0/33"`) {
+		t.Errorf("got %v, want the CIDR rejected", err)
+	}
+}
+
+func TestNewUUIDv7SortsByTime(t *testing.T) {
+	previous := NewUUIDv7()
+	for i := 0; i < 3; i++ {
+		if !uuidV7.MatchString(previous) {
+			t.Fatalf("%q is not a version 7 uuid", previous)
+		}
+		next := NewUUIDv7()
+		// the first 48 bits are milliseconds since the epoch
+		if next[:13] < previous[:13] || next == previous {
+			t.Errorf("%q sorts before %q", next, previous)
+		}
+		previous = next
+	}
+}
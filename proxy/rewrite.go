@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+type RewriteConfig struct {
+	Prefix string `yaml:"prefix"`
+	// Regex matches the escaped path with ?query appended, a ? in the
+	// replacement starts the new query
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+	Location    bool   `yaml:"location"`
+	Cookies     bool   `yaml:"cookies"`
+}
+
+type PathRewrite struct {
+	Config RewriteConfig
+	regex  *regexp.Regexp
+}
+
+func NewPathRewrite(cfg RewriteConfig) (*PathRewrite, error) {
+	rewrite := &PathRewrite{Config: cfg}
+	if len(cfg.Regex) > 0 {
+		regex, err := regexp.Compile(cfg.Regex)
+		if err != nil {
+			return nil, err
+		}
+		rewrite.regex = regex
+	}
+	return rewrite, nil
+}
+
+type routeMatchKey struct{}
+
+type routeMatch struct {
+	Route  *Route
+	Prefix string
+	Origin string
+}
+
+func withRouteMatch(req *http.Request, route *Route) *http.Request {
+	if route == nil || route.Rewrite == nil {
+		return req
+	}
+	path := req.URL.EscapedPath()
+	n, _, _ := route.matchPath(path)
+	match := &routeMatch{Route: route, Prefix: path[:n], Origin: requestProto(req) + "://" + req.Host}
+	return req.WithContext(context.WithValue(req.Context(), routeMatchKey{}, match))
+}
+
+func getRouteMatch(ctx context.Context) *routeMatch {
+	match, _ := ctx.Value(routeMatchKey{}).(*routeMatch)
+	return match
+}
+
+func (r *PathRewrite) Apply(u *url.URL, prefix string) {
+	path := u.EscapedPath()
+	if len(r.Config.Prefix) > 0 && strings.HasPrefix(path, prefix) {
+		path = joinPrefix(r.Config.Prefix, path[len(prefix):])
+	}
+	if r.regex != nil {
+		subject := path
+		if len(u.RawQuery) > 0 {
+			subject += "?" + u.RawQuery
+		}
+		if r.regex.MatchString(subject) {
+			rewritten := r.regex.ReplaceAllString(subject, r.Config.Replacement)
+			path, u.RawQuery, _ = strings.Cut(rewritten, "?")
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+		}
+	}
+	setEscapedPath(u, path)
+}
+
+func joinPrefix(prefix, rest string) string {
+	if len(rest) > 0 && !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	if joined := strings.TrimSuffix(prefix, "/") + rest; len(joined) > 0 {
+		return joined
+	}
+	return "/"
+}
+
+func setEscapedPath(u *url.URL, escaped string) {
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		u.Path, u.RawPath = escaped, ""
+		return
+	}
+	u.Path, u.RawPath = path, escaped
+}
+
+func (r *PathRewrite) unprefix(path, routePrefix string) (string, bool) {
+	if len(r.Config.Prefix) == 0 {
+		return path, false
+	}
+	replaced := strings.TrimSuffix(r.Config.Prefix, "/")
+	if !strings.HasPrefix(path, replaced) {
+		return path, false
+	}
+	rest := path[len(replaced):]
+	if len(rest) > 0 && rest[0] != '/' {
+		return path, false
+	}
+	return joinPrefix(routePrefix, rest), true
+}
+
+func (r *PathRewrite) RewriteResponse(res *http.Response, target *url.URL, match *routeMatch) {
+	if r.Config.Location {
+		for _, key := range []string{"Location", "Content-Location"} {
+			if value := res.Header.Get(key); len(value) > 0 {
+				res.Header.Set(key, r.location(value, target, res.Request.Host, match))
+			}
+		}
+	}
+	if r.Config.Cookies {
+		cookies := res.Header.Values("Set-Cookie")
+		res.Header.Del("Set-Cookie")
+		for _, cookie := range cookies {
+			res.Header.Add("Set-Cookie", r.cookie(cookie, target, match))
+		}
+	}
+}
+
+func (r *PathRewrite) location(value string, target *url.URL, upstreamHost string, match *routeMatch) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return value
+	}
+	if len(u.Host) > 0 {
+		if !strings.EqualFold(u.Host, target.Host) && !strings.EqualFold(u.Host, upstreamHost) {
+			return value
+		}
+		origin, _ := url.Parse(match.Origin)
+		u.Scheme, u.Host = origin.Scheme, origin.Host
+	} else if !strings.HasPrefix(u.Path, "/") {
+		// relative to the current path, which is already right
+		return value
+	}
+	path := strings.TrimPrefix(u.EscapedPath(), strings.TrimSuffix(target.EscapedPath(), "/"))
+	if unprefixed, ok := r.unprefix(path, match.Prefix); ok {
+		setEscapedPath(u, unprefixed)
+	}
+	return u.String()
+}
+
+func (r *PathRewrite) cookie(value string, target *url.URL, match *routeMatch) string {
+	parts := strings.Split(value, ";")
+	kept := []string{parts[0]}
+	for _, part := range parts[1:] {
+		key, attr, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch strings.ToLower(key) {
+		case "path":
+			path := strings.TrimPrefix(attr, strings.TrimSuffix(target.EscapedPath(), "/"))
+			if unprefixed, ok := r.unprefix(path, match.Prefix); ok {
+				if len(unprefixed) > 1 {
+					unprefixed = strings.TrimSuffix(unprefixed, "/")
+				}
+				part = " Path=" + unprefixed
+			}
+		case "domain":
+			if strings.EqualFold(strings.TrimPrefix(attr, "."), target.Hostname()) {
+				// host only, for whichever host the client used
+				continue
+			}
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, ";")
+}
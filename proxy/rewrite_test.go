@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestPathRewriteApply(t *testing.T) {
+	cases := []struct {
+		name string
+		cfg  RewriteConfig
+		in   string
+		want string
+	}{
+		{"prefix", RewriteConfig{Prefix: "/v2"}, "/app/items?page=2", "/v2/items?page=2"},
+		{"prefix of the route root", RewriteConfig{Prefix: "/v2/"}, "/app", "/v2"},
+		{"prefix to root", RewriteConfig{Prefix: "/"}, "/app/items", "/items"},
+		{"escaped path", RewriteConfig{Prefix: "/v2"}, "/app/a%2Fb", "/v2/a%2Fb"},
+		{"regex with a new query", RewriteConfig{Regex: `^/app/users/(\d+)$`, Replacement: "/users?id=$1"}, "/app/users/7", "/users?id=7"},
+		{"regex on the query", RewriteConfig{Regex: `page=(\d+)`, Replacement: "offset=${1}0"}, "/app/items?page=2", "/app/items?offset=20"},
+		{"regex without a match", RewriteConfig{Regex: `^/api/`, Replacement: "/"}, "/app/items", "/app/items"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rewrite, err := NewPathRewrite(c.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, _ := url.Parse("http://backend" + c.in)
+			rewrite.Apply(u, "/app")
+			if got := u.RequestURI(); got != c.want {
+				t.Errorf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+
+	if _, err := NewPathRewrite(RewriteConfig{Regex: "("}); err == nil {
+		t.Error("compiled an invalid regex")
+	}
+}
+
+// rewriteResponse rewrites the headers of a response from the target
+// http://10.0.0.5:8080/base, sent as Host backend.internal, to a request
+// for https://www.example.com on the route /app, rewritten to /v2.
+func rewriteResponse(t *testing.T, cfg RewriteConfig, header http.Header) http.Header {
+	t.Helper()
+	cfg.Prefix = "/v2"
+	rewrite, err := NewPathRewrite(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, _ := url.Parse("http://10.0.0.5:8080/base")
+	res := &http.Response{Header: header, Request: &http.Request{Host: "backend.internal"}}
+	rewrite.RewriteResponse(res, target, &routeMatch{Prefix: "/app", Origin: "https://www.example.com"})
+	return res.Header
+}
+
+func TestPathRewriteLocation(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"http://10.0.0.5:8080/base/v2/items?page=2", "https://www.example.com/app/items?page=2"},
+		{"http://BACKEND.internal/base/v2/", "https://www.example.com/app/"},
+		{"/base/v2/login", "/app/login"},
+		{"/base/v2", "/app"},
+		{"/base/v2x", "/base/v2x"},
+		{"/elsewhere", "/elsewhere"},
+		{"next", "next"},
+		{"https://auth.example.org/v2/login", "https://auth.example.org/v2/login"},
+	}
+	for _, c := range cases {
+		header := rewriteResponse(t, RewriteConfig{Location: true}, http.Header{"Location": {c.in}, "Content-Location": {c.in}})
+		if header.Get("Location") != c.want || header.Get("Content-Location") != c.want {
+			t.Errorf("%s rewrote to %s and %s, want %s", c.in, header.Get("Location"), header.Get("Content-Location"), c.want)
+		}
+	}
+
+	header := rewriteResponse(t, RewriteConfig{}, http.Header{"Location": {"/base/v2/login"}})
+	if got := header.Get("Location"); got != "/base/v2/login" {
+		t.Errorf("location rewritten to %s while disabled", got)
+	}
+}
+
+func TestPathRewriteCookies(t *testing.T) {
+	in := []string{
+		"sid=1; Path=/base/v2/; Domain=10.0.0.5; HttpOnly",
+		"lang=en; path=/base/v2",
+		"theme=dark; Path=/; Domain=.example.org; Secure",
+		"cart=3; Path=/base/v2/cart/; Domain=.10.0.0.5",
+	}
+	want := []string{
+		"sid=1; Path=/app; HttpOnly",
+		"lang=en; Path=/app",
+		"theme=dark; Path=/; Domain=.example.org; Secure",
+		"cart=3; Path=/app/cart",
+	}
+	header := rewriteResponse(t, RewriteConfig{Cookies: true}, http.Header{"Set-Cookie": append([]string{}, in...)})
+	got := header.Values("Set-Cookie")
+	if len(got) != len(want) {
+		t.Fatalf("got cookies %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%s rewrote to %s, want %s", in[i], got[i], want[i])
+		}
+	}
+
+	header = rewriteResponse(t, RewriteConfig{}, http.Header{"Set-Cookie": {in[0]}})
+	if got := header.Get("Set-Cookie"); got != in[0] {
+		t.Errorf("cookie rewritten to %s while disabled", got)
+	}
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A MaxSize of zero never rotates.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	closed bool
+}
+
+const backupTimeFormat = "20060102T150405.000"
+
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file, rf.size = file, info.Size()
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.closed {
+		return 0, os.ErrClosed
+	}
+	// a failed rotation leaves no file when even reopening the path failed
+	if rf.file == nil {
+		if err := rf.open(); err != nil {
+			return 0, err
+		}
+	}
+	var rotateErr error
+	if rf.MaxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.MaxSize {
+		if rotateErr = rf.rotate(); rf.file == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+func (rf *RotatingFile) Rotate() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.closed {
+		return os.ErrClosed
+	}
+	return rf.rotate()
+}
+
+// When the rename fails the original path is reopened, so writing carries on
+// there and rotation is tried again on a later write.
+func (rf *RotatingFile) rotate() error {
+	if rf.file != nil {
+		rf.file.Close()
+		rf.file = nil
+	}
+	backup := rf.Path + "." + time.Now().UTC().Format(backupTimeFormat)
+	if err := os.Rename(rf.Path, backup); err != nil && !os.IsNotExist(err) {
+		if openErr := rf.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("rotating %s: %w", rf.Path, err)
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	return rf.prune()
+}
+
+func (rf *RotatingFile) prune() error {
+	if rf.MaxBackups <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(rf.Path + ".*")
+	if err != nil {
+		return err
+	}
+	// only files named by rotate count, whatever else shares the prefix
+	backups := []string{}
+	for _, match := range matches {
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(match, rf.Path+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	// the timestamp suffix sorts oldest first
+	sort.Strings(backups)
+	for len(backups) > rf.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	rf.closed = true
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
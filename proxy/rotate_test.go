@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingFileRotatesBySizeAndPrunes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	for _, name := range []string{"access.log.old", "access.log.20200101T000000.000"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rf, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := fmt.Fprintf(rf, "line-%d\n", i); err != nil {
+			t.Fatal(err)
+		}
+		// backups are named to the millisecond
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if got := readFile(t, path); got != "line-4\n" {
+		t.Errorf("current file has %q", got)
+	}
+	backups, _ := filepath.Glob(path + ".2*")
+	sort.Strings(backups)
+	if len(backups) != 2 {
+		t.Fatalf("kept backups %q, want the newest 2", backups)
+	}
+	if got := readFile(t, backups[0]) + readFile(t, backups[1]); got != "line-2\nline-3\n" {
+		t.Errorf("backups hold %q", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "access.log.old")); got != "access.log.old" {
+		t.Errorf("pruned a file rotate did not write, left %q", got)
+	}
+}
+
+func TestRotatingFileReopensAfterFailedRotation(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "access.log")
+	rf, err := OpenRotatingFile(path, 4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	if _, err := rf.Write([]byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotating cannot reopen the path while its directory is gone
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rf.Write([]byte("lost\n")); err == nil {
+		t.Fatal("wrote with the directory removed")
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rf.Write([]byte("again\n")); err != nil {
+		t.Fatalf("write after the directory came back got %v", err)
+	}
+	if got := readFile(t, path); got != "again\n" {
+		t.Errorf("reopened file has %q", got)
+	}
+
+	rf.Close()
+	if _, err := rf.Write([]byte("closed\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("write after close got %v", err)
+	}
+}
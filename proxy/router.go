@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+type RouteConfig struct {
+	Name string `yaml:"name"`
+	// Host is matched exactly, or as a suffix when it starts with *. and
+	// matches any host when empty
+	Host string `yaml:"host"`
+	// Path is a prefix matched on segment boundaries, defaulting to /. A
+	// segment of {name} matches any one segment, captured as a path param.
+	Path string `yaml:"path"`
+	// Upstream is the name of an upstream or a url
+	Upstream string `yaml:"upstream"`
+	// RateLimit applies on top of the global rate limit
+	RateLimit *RateLimitConfig `yaml:"rateLimit"`
+	// Access applies on top of the global access rules
+	Access  *AccessConfig  `yaml:"access"`
+	Auth    *AuthConfig    `yaml:"auth"`
+	Headers *HeadersConfig `yaml:"headers"`
+	Rewrite *RewriteConfig `yaml:"rewrite"`
+	// MaxBodyBytes answers requests with larger bodies 413, overriding the
+	// server's limit, which a negative value lifts
+	MaxBodyBytes int64 `yaml:"maxBodyBytes"`
+	// Timeout is the deadline for proxying a request, overriding the
+	// server's requestTimeout. Upgraded connections are not bound by it.
+	Timeout Duration `yaml:"timeout"`
+	// Stream lifts the server's read timeout, body size limit and request
+	// timeout, for long uploads and streamed responses
+	Stream bool `yaml:"stream"`
+}
+
+type Route struct {
+	Config          RouteConfig
+	Upstream        *UpstreamPool
+	Access          *AccessRules
+	Auth            Authenticator
+	RequestHeaders  *HeaderRules
+	ResponseHeaders *HeaderRules
+	Rewrite         *PathRewrite
+
+	// segments is the split path when it has params
+	segments []string
+}
+
+func (r *Route) Matches(host, path string) bool {
+	switch {
+	case len(r.Config.Host) == 0:
+	case strings.HasPrefix(r.Config.Host, "*."):
+		if !strings.HasSuffix(host, r.Config.Host[1:]) {
+			return false
+		}
+	case host != r.Config.Host:
+		return false
+	}
+	_, _, ok := r.matchPath(path)
+	return ok
+}
+
+func (r *Route) Params(path string) map[string]string {
+	_, params, _ := r.matchPath(path)
+	return params
+}
+
+// matchPath returns how much of path the route's prefix matched and the
+// params it captured.
+func (r *Route) matchPath(path string) (int, map[string]string, bool) {
+	prefix := r.Config.Path
+	if r.segments == nil {
+		if prefix == "/" || len(prefix) == 0 {
+			return 0, nil, true
+		}
+		if !strings.HasPrefix(path, prefix) {
+			return 0, nil, false
+		}
+		ok := len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+		return len(prefix), nil, ok
+	}
+	params := map[string]string{}
+	at := 0
+	for _, segment := range r.segments {
+		if at >= len(path) || path[at] != '/' {
+			return 0, nil, false
+		}
+		end := len(path)
+		if next := strings.IndexByte(path[at+1:], '/'); next >= 0 {
+			end = at + 1 + next
+		}
+		value := path[at+1 : end]
+		if name, ok := pathParam(segment); ok {
+			if len(value) == 0 {
+				return 0, nil, false
+			}
+			params[name] = value
+		} else if value != segment {
+			return 0, nil, false
+		}
+		at = end
+	}
+	return at, params, true
+}
+
+func pathParam(segment string) (string, bool) {
+	if len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+type Router struct {
+	Default   *UpstreamPool
+	Upstreams map[string]*UpstreamPool
+	Routes    []*Route
+}
+
+// NewRouter orders routes exact hosts first, then wildcard hosts, then any
+// host, and longest path first within each.
+func NewRouter(defaultUpstream string, upstreams []UpstreamConfig, routes []RouteConfig) (*Router, error) {
+	router := &Router{Upstreams: map[string]*UpstreamPool{}}
+	for _, cfg := range upstreams {
+		if _, ok := router.Upstreams[cfg.Name]; ok {
+			return nil, fmt.Errorf("duplicate upstream %q", cfg.Name)
+		}
+		pool, err := NewUpstreamPool(cfg)
+		if err != nil {
+			return nil, err
+		}
+		router.Upstreams[cfg.Name] = pool
+	}
+	if len(defaultUpstream) > 0 {
+		pool, err := router.resolve(defaultUpstream)
+		if err != nil {
+			return nil, err
+		}
+		router.Default = pool
+	}
+	for _, cfg := range routes {
+		pool, err := router.resolve(cfg.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("route %s: %w", routeName(cfg), err)
+		}
+		cfg.Host = strings.ToLower(cfg.Host)
+		route := &Route{Config: cfg, Upstream: pool}
+		if strings.Contains(cfg.Path, "{") {
+			route.segments = strings.Split(strings.Trim(cfg.Path, "/"), "/")
+		}
+		if cfg.Access != nil {
+			route.Access, err = NewAccessRules(*cfg.Access)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", routeName(cfg), err)
+			}
+		}
+		if cfg.Auth != nil {
+			route.Auth, err = NewAuthenticator(*cfg.Auth, cfg.Path)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %w", routeName(cfg), err)
+			}
+		}
+		if cfg.Headers != nil {
+			route.RequestHeaders, err = NewHeaderRules(cfg.Headers.Request)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: request headers: %w", routeName(cfg), err)
+			}
+			route.ResponseHeaders, err = NewHeaderRules(cfg.Headers.Response)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: response headers: %w", routeName(cfg), err)
+			}
+		}
+		if cfg.Rewrite != nil {
+			route.Rewrite, err = NewPathRewrite(*cfg.Rewrite)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: rewrite: %w", routeName(cfg), err)
+			}
+		}
+		router.Routes = append(router.Routes, route)
+	}
+	sort.SliceStable(router.Routes, func(i, j int) bool {
+		a, b := router.Routes[i].Config, router.Routes[j].Config
+		if hostRank(a.Host) != hostRank(b.Host) {
+			return hostRank(a.Host) < hostRank(b.Host)
+		}
+		return len(a.Path) > len(b.Path)
+	})
+	return router, nil
+}
+
+func (r *Router) SetDrains(drains *Drains) {
+	for _, pool := range r.Pools() {
+		pool.Drains = drains
+	}
+}
+
+func (r *Router) SetLog(log logger.Log) {
+	for _, pool := range r.Pools() {
+		for _, target := range pool.Targets {
+			target.Log = log
+		}
+	}
+}
+
+func (r *Router) SetForwarding(forwarding *Forwarding) {
+	for _, pool := range r.Pools() {
+		for _, target := range pool.Targets {
+			target.Forwarding = forwarding
+		}
+	}
+}
+
+// Pools includes the upstreams routes name by url.
+func (r *Router) Pools() []*UpstreamPool {
+	seen := map[*UpstreamPool]bool{}
+	pools := []*UpstreamPool{}
+	add := func(pool *UpstreamPool) {
+		if pool != nil && !seen[pool] {
+			seen[pool] = true
+			pools = append(pools, pool)
+		}
+	}
+	add(r.Default)
+	names := make([]string, 0, len(r.Upstreams))
+	for name := range r.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(r.Upstreams[name])
+	}
+	for _, route := range r.Routes {
+		add(route.Upstream)
+	}
+	return pools
+}
+
+func (r *Router) resolve(ref string) (*UpstreamPool, error) {
+	if pool, ok := r.Upstreams[ref]; ok {
+		return pool, nil
+	}
+	if !strings.Contains(ref, "://") {
+		return nil, fmt.Errorf("unknown upstream %q", ref)
+	}
+	return NewUpstreamPool(UpstreamConfig{Name: ref, Targets: []string{ref}})
+}
+
+// Match returns nil when only the default upstream applies.
+func (r *Router) Match(req *http.Request) *Route {
+	host := strings.ToLower(req.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, route := range r.Routes {
+		if route.Matches(host, req.URL.Path) {
+			return route
+		}
+	}
+	return nil
+}
+
+func hostRank(host string) int {
+	switch {
+	case len(host) == 0:
+		return 2
+	case strings.HasPrefix(host, "*."):
+		return 1
+	default:
+		return 0
+	}
+}
+
+func routeName(cfg RouteConfig) string {
+	if len(cfg.Name) > 0 {
+		return cfg.Name
+	}
+	path := cfg.Path
+	if len(path) == 0 {
+		path = "/"
+	}
+	return cfg.Host + path
+}
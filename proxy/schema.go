@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+
+	"gopkg.in/yaml.v2"
+)
+
+const Redacted = "REDACTED"
+
+func JSONSchema() map[string]interface{} {
+	schema := schemaFor(reflect.TypeOf(Config{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "tls-proxy config"
+	return schema
+}
+
+func schemaFor(t reflect.Type) map[string]interface{} {
+	if t == durationType {
+		return map[string]interface{}{
+			"type":        "string",
+			"description": "a duration such as 300ms, 30s or 5m",
+			"pattern":     `^(\d+(\.\d+)?(ns|us|µs|ms|s|m|h))+$`,
+		}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema := map[string]interface{}{"type": "integer", "minimum": 0}
+		if t.Bits() < 64 {
+			schema["maximum"] = uint64(math.MaxUint64) >> (64 - t.Bits())
+		}
+		return schema
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			key := yamlKey(field)
+			if !field.IsExported() || key == "-" {
+				continue
+			}
+			property := schemaFor(field.Type)
+			if field.Tag.Get("secret") == "true" {
+				property["writeOnly"] = true
+			}
+			properties[key] = property
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           properties,
+			"additionalProperties": false,
+		}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+func RedactSecrets(cfg *Config) {
+	redact(reflect.ValueOf(cfg).Elem())
+}
+
+func redact(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			redact(v.Elem())
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			redact(v.Index(i))
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			redact(elem)
+			v.SetMapIndex(key, elem)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			fv := v.Field(i)
+			if field.Tag.Get("secret") == "true" {
+				redactSecret(fv)
+				continue
+			}
+			redact(fv)
+		}
+	}
+}
+
+func redactSecret(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() > 0 {
+			v.SetString(Redacted)
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		for _, key := range v.MapKeys() {
+			v.SetMapIndex(key, reflect.ValueOf(Redacted).Convert(v.Type().Elem()))
+		}
+	}
+}
+
+func EffectiveConfig(cfg Config) (string, error) {
+	// round trip to copy, so redacting leaves slices and maps shared with cfg
+	// untouched
+	data, err := yaml.Marshal(ConfigOrDefault(cfg))
+	if err != nil {
+		return "", fmt.Errorf("rendering config: %w", err)
+	}
+	var copied Config
+	if err := yaml.Unmarshal(data, &copied); err != nil {
+		return "", fmt.Errorf("rendering config: %w", err)
+	}
+	RedactSecrets(&copied)
+	data, err = yaml.Marshal(copied)
+	if err != nil {
+		return "", fmt.Errorf("rendering config: %w", err)
+	}
+	return string(data), nil
+}
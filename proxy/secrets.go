@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SecretProvider interface {
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+type SecretProviderFunc func(ctx context.Context, ref string) (string, error)
+
+func (f SecretProviderFunc) Resolve(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+type SecretsConfig struct {
+	Vault VaultConfig `yaml:"vault"`
+}
+
+type VaultConfig struct {
+	Address string   `yaml:"address"`
+	Token   string   `yaml:"token" secret:"true"`
+	Timeout Duration `yaml:"timeout"`
+}
+
+func DefaultSecretProviders() map[string]SecretProvider {
+	return map[string]SecretProvider{
+		"env": SecretProviderFunc(func(_ context.Context, name string) (string, error) {
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("environment variable %s is not set", name)
+			}
+			return value, nil
+		}),
+		"file": SecretProviderFunc(func(_ context.Context, path string) (string, error) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimRight(string(data), "\r\n"), nil
+		}),
+	}
+}
+
+var secretRef = regexp.MustCompile(`\$\$|\$\{([a-zA-Z][a-zA-Z0-9_-]*):([^}]*)\}`)
+
+var secretProviderName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]*$`)
+
+var (
+	registeredProvidersLock sync.Mutex
+	registeredProviders     = map[string]SecretProvider{}
+)
+
+// RegisterSecretProvider resolves ${name:ref} references with provider in
+// every config read afterwards. env, file and vault cannot be replaced.
+func RegisterSecretProvider(name string, provider SecretProvider) error {
+	if !secretProviderName.MatchString(name) {
+		return fmt.Errorf("invalid secret provider name %q", name)
+	}
+	if _, ok := DefaultSecretProviders()[name]; ok || name == "vault" {
+		return fmt.Errorf("secret provider %q is built in", name)
+	}
+	registeredProvidersLock.Lock()
+	defer registeredProvidersLock.Unlock()
+	if _, ok := registeredProviders[name]; ok {
+		return fmt.Errorf("secret provider %q is already registered", name)
+	}
+	registeredProviders[name] = provider
+	return nil
+}
+
+// A literal $ is written as $$.
+func ResolveSecrets(ctx context.Context, cfg *Config) error {
+	return resolveSecrets(ctx, cfg, nil)
+}
+
+func resolveSecrets(ctx context.Context, cfg *Config, lines map[string]location) error {
+	providers := DefaultSecretProviders()
+	registeredProvidersLock.Lock()
+	for name, provider := range registeredProviders {
+		providers[name] = provider
+	}
+	registeredProvidersLock.Unlock()
+
+	// the secrets section may itself reference env, file and registered
+	// providers
+	var errs ValidationErrors
+	walkStrings(reflect.ValueOf(&cfg.Secrets).Elem(), "secrets", func(field string, v reflect.Value) {
+		resolveValue(ctx, providers, field, v, lines, &errs)
+	})
+	if len(errs) > 0 {
+		return errs.orNil()
+	}
+	if len(cfg.Secrets.Vault.Address) > 0 {
+		providers["vault"] = NewVaultProvider(cfg.Secrets.Vault)
+	}
+
+	walkStrings(reflect.ValueOf(cfg).Elem(), "", func(field string, v reflect.Value) {
+		if field == "secrets" || strings.HasPrefix(field, "secrets.") {
+			return
+		}
+		resolveValue(ctx, providers, field, v, lines, &errs)
+	})
+	return errs.orNil()
+}
+
+func resolveValue(ctx context.Context, providers map[string]SecretProvider, field string, v reflect.Value, lines map[string]location, errs *ValidationErrors) {
+	raw := v.String()
+	if !strings.Contains(raw, "$") {
+		return
+	}
+	var resolveErr error
+	resolved := secretRef.ReplaceAllStringFunc(raw, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		parts := secretRef.FindStringSubmatch(match)
+		provider, ok := providers[parts[1]]
+		if !ok {
+			resolveErr = fmt.Errorf("unknown secret provider %q", parts[1])
+			return match
+		}
+		value, err := provider.Resolve(ctx, parts[2])
+		if err != nil {
+			resolveErr = fmt.Errorf("resolving %s: %w", match, err)
+			return match
+		}
+		return value
+	})
+	if resolveErr != nil {
+		loc := locate(lines, field)
+		*errs = append(*errs, ValidationError{File: loc.File, Line: loc.Line, Field: field, Message: resolveErr.Error()})
+		return
+	}
+	v.SetString(resolved)
+}
+
+func walkStrings(v reflect.Value, path string, fn func(string, reflect.Value)) {
+	join := func(key string) string {
+		if len(path) == 0 {
+			return key
+		}
+		return path + "." + key
+	}
+	switch v.Kind() {
+	case reflect.String:
+		fn(path, v)
+	case reflect.Pointer:
+		if !v.IsNil() {
+			walkStrings(v.Elem(), path, fn)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if key := yamlKey(field); field.IsExported() && key != "-" {
+				walkStrings(v.Field(i), join(key), fn)
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkStrings(v.Index(i), fmt.Sprintf("%s[%d]", path, i), fn)
+		}
+	case reflect.Map:
+		// map values are not addressable, so strings are copied out and back
+		for _, key := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			walkStrings(elem, join(fmt.Sprint(key.Interface())), fn)
+			v.SetMapIndex(key, elem)
+		}
+	}
+}
+
+// Both KV version 1 and version 2 responses are understood.
+type VaultProvider struct {
+	Config VaultConfig
+	Client *http.Client
+}
+
+func NewVaultProvider(cfg VaultConfig) *VaultProvider {
+	timeout := cfg.Timeout.Duration()
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	return &VaultProvider{
+		Config: cfg,
+		Client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (vp *VaultProvider) Resolve(ctx context.Context, ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || len(path) == 0 || len(field) == 0 {
+		return "", fmt.Errorf("vault reference must be path#field")
+	}
+	u, err := url.Parse(strings.TrimRight(vp.Config.Address, "/") + "/v1/" + strings.TrimLeft(path, "/"))
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if len(vp.Config.Token) > 0 {
+		req.Header.Set("X-Vault-Token", vp.Config.Token)
+	}
+	res, err := vp.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for %s", res.Status, path)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decoding vault response: %w", err)
+	}
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, isMeta := data["metadata"]; isMeta {
+			data = nested
+		}
+	}
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("field %s not found in %s", field, path)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
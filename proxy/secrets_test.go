@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecretsEnvAndFile(t *testing.T) {
+	t.Setenv("TLS_PROXY_TEST_UPSTREAM_HOST", "backend")
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte("file-key\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{}
+	cfg.TLS.Key = "${file:" + keyFile + "}"
+	cfg.TLS.Upstream = "http://${env:TLS_PROXY_TEST_UPSTREAM_HOST}:8080/$${env:HOME}"
+	cfg.HTTP.Upstream = "http://localhost:8080"
+	if err := ResolveSecrets(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TLS.Key != "file-key" {
+		t.Errorf("tls.key = %q, want the file without its trailing newline", cfg.TLS.Key)
+	}
+	if cfg.TLS.Upstream != "http://backend:8080/${env:HOME}" {
+		t.Errorf("tls.upstream = %q", cfg.TLS.Upstream)
+	}
+	if cfg.HTTP.Upstream != "http://localhost:8080" {
+		t.Errorf("http.upstream without references changed to %q", cfg.HTTP.Upstream)
+	}
+}
+
+func TestResolveSecretsReportsEveryField(t *testing.T) {
+	cfg := &Config{}
+	cfg.TLS.Key = "${env:TLS_PROXY_TEST_UNSET}"
+	cfg.TLS.Cert = "${file:" + filepath.Join(t.TempDir(), "missing") + "}"
+	cfg.HTTP.Upstream = "${vault:secret/data/proxy#key}"
+	err := ResolveSecrets(context.Background(), cfg)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{
+		"tls.key", "environment variable TLS_PROXY_TEST_UNSET is not set",
+		"tls.cert", "no such file",
+		"http.upstream", `unknown secret provider "vault"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+	if cfg.TLS.Key != "${env:TLS_PROXY_TEST_UNSET}" {
+		t.Errorf("tls.key was changed to %q", cfg.TLS.Key)
+	}
+}
+
+// TestResolveSecretsVault reads the vault token from the environment, as the
+// secrets section may reference env, and reads both KV versions.
+func TestResolveSecretsVault(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "s.token" {
+			http.Error(rw, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/secret/data/proxy":
+			rw.Write([]byte(`{"data":{"data":{"key":"v2-key","port":8443},"metadata":{"version":3}}}`))
+		case "/v1/kv/proxy":
+			rw.Write([]byte(`{"data":{"key":"v1-key"}}`))
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer vault.Close()
+	t.Setenv("TLS_PROXY_TEST_VAULT_TOKEN", "s.token")
+
+	cfg := &Config{}
+	cfg.Secrets.Vault = VaultConfig{Address: vault.URL + "/", Token: "${env:TLS_PROXY_TEST_VAULT_TOKEN}"}
+	cfg.TLS.Key = "${vault:secret/data/proxy#key}"
+	cfg.TLS.Cert = "${vault:/kv/proxy#key}"
+	cfg.HTTP.Upstream = "http://upstream:${vault:secret/data/proxy#port}"
+	if err := ResolveSecrets(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TLS.Key != "v2-key" || cfg.TLS.Cert != "v1-key" {
+		t.Errorf("kv v2 resolved %q and kv v1 %q", cfg.TLS.Key, cfg.TLS.Cert)
+	}
+	if cfg.HTTP.Upstream != "http://upstream:8443" {
+		t.Errorf("http.upstream = %q, want the number formatted", cfg.HTTP.Upstream)
+	}
+	if cfg.Secrets.Vault.Token != "s.token" {
+		t.Errorf("secrets.vault.token = %q", cfg.Secrets.Vault.Token)
+	}
+}
+
+func TestVaultProviderErrors(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v1/secret/data/proxy":
+			rw.Write([]byte(`{"data":{"data":{"key":"v2-key"},"metadata":{"version":1}}}`))
+		case "/v1/secret/data/broken":
+			rw.Write([]byte(`<html>`))
+		case "/v1/secret/data/forbidden":
+			http.Error(rw, `{"errors":["permission denied"]}`, http.StatusForbidden)
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer vault.Close()
+	provider := NewVaultProvider(VaultConfig{Address: vault.URL})
+
+	cases := []struct {
+		ref  string
+		want string
+	}{
+		{"secret/data/proxy#nope", "field nope not found in secret/data/proxy"},
+		{"secret/data/forbidden#key", "vault returned 403 Forbidden"},
+		{"secret/data/other#key", "vault returned 404 Not Found"},
+		{"secret/data/broken#key", "decoding vault response"},
+		{"secret/data/proxy", "vault reference must be path#field"},
+	}
+	for _, c := range cases {
+		if _, err := provider.Resolve(context.Background(), c.ref); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s got %v, want %q", c.ref, err, c.want)
+		}
+	}
+}
+
+func TestRegisterSecretProvider(t *testing.T) {
+	var refs []string
+	err := RegisterSecretProvider("test-kms", SecretProviderFunc(func(_ context.Context, ref string) (string, error) {
+		refs = append(refs, ref)
+		return "decrypted-" + ref, nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		registeredProvidersLock.Lock()
+		delete(registeredProviders, "test-kms")
+		registeredProvidersLock.Unlock()
+	})
+
+	cfg := &Config{}
+	cfg.Secrets.Vault.Token = "${test-kms:vault-token}"
+	cfg.TLS.Key = "${test-kms:tls-key}"
+	if err := ResolveSecrets(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TLS.Key != "decrypted-tls-key" || cfg.Secrets.Vault.Token != "decrypted-vault-token" {
+		t.Errorf("resolved tls.key %q and secrets.vault.token %q", cfg.TLS.Key, cfg.Secrets.Vault.Token)
+	}
+	if len(refs) != 2 {
+		t.Errorf("provider resolved %q", refs)
+	}
+
+	for name, want := range map[string]string{
+		"test-kms": "already registered",
+		"env":      "built in",
+		"vault":    "built in",
+		"9kms":     "invalid secret provider name",
+		"kms:v1":   "invalid secret provider name",
+	} {
+		if err := RegisterSecretProvider(name, SecretProviderFunc(nil)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("registering %q got %v, want %q", name, err, want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+type rebindableListener struct {
+	lock     sync.Mutex
+	listener net.Listener
+}
+
+func (rl *rebindableListener) get() net.Listener {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.listener
+}
+
+func (rl *rebindableListener) set(l net.Listener) net.Listener {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	old := rl.listener
+	rl.listener = l
+	return old
+}
+
+// connections on the old listener are left to finish on their own
+func (rl *rebindableListener) serve(serve func(net.Listener) error) error {
+	l := rl.get()
+	for {
+		err := serve(l)
+		if err == http.ErrServerClosed {
+			return nil
+		}
+		next := rl.get()
+		if next == l {
+			return err
+		}
+		l = next
+	}
+}
+
+func (rl *rebindableListener) rebind(l net.Listener) {
+	if old := rl.set(l); old != nil {
+		old.Close()
+	}
+}
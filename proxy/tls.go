@@ -1,77 +1,96 @@
 package proxy
 
 import (
-	"context"
 	"crypto/ed25519"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
-	"strconv"
+	"time"
 
 	"github.com/blend/go-sdk/logger"
 )
 
 type TLSServer struct {
-	Log          logger.Log
-	Config       TLSConfig
-	Server       *http.Server
-	ReverseProxy *httputil.ReverseProxy
-	upstreamPort uint16
+	Log             logger.Log
+	Config          TLSConfig
+	Server          *http.Server
+	Handler         *ProxyHandler
+	Listener        net.Listener
+	Conns           *ConnTracker
+	Certs           *CertStore
+	ShutdownTimeout time.Duration
+
+	listener rebindableListener
 }
 
 func NewTLSServer(log logger.Log, cfg TLSConfig) (*TLSServer, error) {
-	target, err := url.Parse(cfg.Upstream)
+	handler, err := NewProxyHandler(log, cfg.Upstream)
 	if err != nil {
 		return nil, err
 	}
-	up := uint16(0)
-	parsed, err := strconv.ParseUint(target.Port(), 10, 16)
-	if err == nil {
-		up = uint16(parsed)
-	}
-	log.Debugf("proxying to target %s", target.String())
-	rev := httputil.NewSingleHostReverseProxy(target)
 	t := &TLSServer{
-		Config:       cfg,
-		ReverseProxy: rev,
-		Log:          log,
-		upstreamPort: up,
+		Config:  cfg,
+		Log:     log,
+		Handler: handler,
+		Conns:   NewConnTracker(),
+		Certs:   &CertStore{},
+	}
+	if len(cfg.CertFile) > 0 || len(cfg.Cert) > 0 {
+		cert, err := LoadCertificate(cfg)
+		if err != nil {
+			return nil, err
+		}
+		t.Certs.Set(cert)
+	}
+	clientCAs, err := LoadClientCAs(cfg)
+	if err != nil {
+		return nil, err
 	}
 	serv := &http.Server{
 		Addr:    BindAddr(cfg.Port),
-		Handler: t,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			GetCertificate: t.Certs.GetCertificate,
+		},
 	}
+	if clientCAs != nil {
+		serv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		serv.TLSConfig.ClientCAs = clientCAs
+	}
+	cfg.Limits.Apply(serv)
+	handler.SetLimits(cfg.Limits)
+	t.Conns.Install(serv)
 	t.Server = serv
 	return t, nil
 }
 
-func (s *TLSServer) Start() error {
-	s.Log.Infof("Starting TLS Server on %s", s.Server.Addr)
-	return s.Server.ListenAndServeTLS(s.Config.CertFile, s.Config.KeyFile)
-}
-func (s *TLSServer) Stop() error {
-	s.Log.Infof("Stopping TLS Server")
-	err := s.Server.Shutdown(context.Background())
-	s.Log.Infof("TLS Server stopped")
-	return err
+// connections accepted on the old listener are kept
+func (s *TLSServer) Rebind(l net.Listener) {
+	s.Log.Infof("Moving TLS Server to %s", l.Addr())
+	s.Listener = l
+	s.listener.rebind(l)
 }
 
-func (s *TLSServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	s.Log.Infof("Proxying request for %s", req.URL.String())
-	if s.upstreamPort != 0 {
-		host, err := replacePort(req.Host, s.upstreamPort)
-		if err == nil {
-			req.Host = host
+func (s *TLSServer) Start() error {
+	if s.Listener == nil {
+		l, err := net.Listen("tcp", s.Server.Addr)
+		if err != nil {
+			return err
 		}
+		s.Listener = l
 	}
-	s.ReverseProxy.ServeHTTP(rw, req)
+	s.listener.set(s.Listener)
+	s.Log.Infof("Starting TLS Server on %s", s.Listener.Addr())
+	return s.listener.serve(func(l net.Listener) error {
+		return s.Server.ServeTLS(l, "", "")
+	})
 }
 
-func (s *TLSServer) rewritePort(pr *httputil.ProxyRequest) {
-
+func (s *TLSServer) Stop() error {
+	return shutdownServer(s.Log, "TLS", s.Server, s.Conns, s.ShutdownTimeout)
 }
 
 func ParsePemEd25519PrivateKey(data []byte) (ed25519.PrivateKey, error) {
@@ -0,0 +1,266 @@
+package proxy
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+type certAuthority struct {
+	cert *x509.Certificate
+	key  ed25519.PrivateKey
+	PEM  string
+}
+
+func newCertAuthority(t *testing.T, name string) *certAuthority {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &certAuthority{cert: cert, key: key, PEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+// issue returns the PEM certificate and key for a server on 127.0.0.1, or for
+// a client named commonName.
+func (ca *certAuthority) issue(t *testing.T, commonName string, serial int64, server bool) (string, string) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Example"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+// serveTLS starts a tls server for cfg, filling in a certificate from ca,
+// and returns a function making https requests to it with a client
+// certificate, when one is given.
+func serveTLS(t *testing.T, ca *certAuthority, cfg TLSConfig, configure func(*TLSServer)) func(certPEM, keyPEM string) (*http.Response, error) {
+	t.Helper()
+	cfg.Cert, cfg.Key = ca.issue(t, "proxy", 2, true)
+	server, err := NewTLSServer(logger.None(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(server)
+	}
+	server.Listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.ShutdownTimeout = time.Second
+	go server.Start()
+	t.Cleanup(func() { server.Stop() })
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return func(certPEM, keyPEM string) (*http.Response, error) {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if len(certPEM) > 0 {
+			cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// sent even when the server asks for another CA
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &cert, nil
+			}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		defer client.CloseIdleConnections()
+		res, err := client.Get("https://" + server.Listener.Addr().String() + "/")
+		if err == nil {
+			res.Body.Close()
+		}
+		return res, err
+	}
+}
+
+func TestTLSServerVerifiesClientCertificates(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	defer upstream.Close()
+	ca, other := newCertAuthority(t, "clients"), newCertAuthority(t, "other")
+	get := serveTLS(t, ca, TLSConfig{Upstream: upstream.URL, ClientCA: ca.PEM}, func(server *TLSServer) {
+		server.Handler.SetRateLimiter(NewRateLimiter(logger.None(), RateLimitConfig{Requests: 1, Period: Duration(time.Hour), Key: RateLimitKeyMTLS}))
+	})
+
+	aliceCert, aliceKey := ca.issue(t, "alice", 3, false)
+	bobCert, bobKey := ca.issue(t, "bob", 4, false)
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		if res, err := get(aliceCert, aliceKey); err != nil || res.StatusCode != want {
+			t.Fatalf("request %d with alice's certificate got %v %v, want %d", i, res, err, want)
+		}
+	}
+	// limited by certificate, not by the ip every client here shares
+	if res, err := get(bobCert, bobKey); err != nil || res.StatusCode != http.StatusOK {
+		t.Errorf("bob's certificate got %v %v", res, err)
+	}
+	if res, err := get("", ""); err != nil || res.StatusCode != http.StatusOK {
+		t.Errorf("no certificate got %v %v, want it allowed by ip", res, err)
+	}
+
+	mallory, malloryKey := other.issue(t, "alice", 3, false)
+	if _, err := get(mallory, malloryKey); err == nil {
+		t.Error("a certificate from another CA was accepted")
+	}
+}
+
+func TestHeaderTemplatesSeeClientCertificates(t *testing.T) {
+	got := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got <- req.Header
+	}))
+	defer upstream.Close()
+	ca := newCertAuthority(t, "clients")
+	get := serveTLS(t, ca, TLSConfig{Upstream: upstream.URL, ClientCA: ca.PEM}, func(server *TLSServer) {
+		router, err := NewRouter(upstream.URL, nil, []RouteConfig{{
+			Upstream: upstream.URL,
+			Headers: &HeadersConfig{Request: HeaderRulesConfig{Set: map[string]string{
+				"X-Client-Subject":     "{{ .TLS.ClientSubject }}",
+				"X-Client-Issuer":      "{{ .TLS.ClientIssuer }}",
+				"X-Client-Serial":      "{{ .TLS.ClientSerial }}",
+				"X-Client-Fingerprint": "{{ .TLS.ClientFingerprint }}",
+			}}},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Handler.SetRouter(router)
+	})
+
+	aliceCert, aliceKey := ca.issue(t, "alice", 3, false)
+	if res, err := get(aliceCert, aliceKey); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("got %v %v", res, err)
+	}
+	block, _ := pem.Decode([]byte(aliceCert))
+	sum := sha256.Sum256(block.Bytes)
+	want := map[string]string{
+		"X-Client-Subject":     "CN=alice,O=Example",
+		"X-Client-Issuer":      "CN=clients",
+		"X-Client-Serial":      "3",
+		"X-Client-Fingerprint": hex.EncodeToString(sum[:]),
+	}
+	header := <-got
+	for name, value := range want {
+		if header.Get(name) != value {
+			t.Errorf("upstream got %s %q, want %q", name, header.Get(name), value)
+		}
+	}
+
+	if res, err := get("", ""); err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("got %v %v", res, err)
+	}
+	header = <-got
+	for name := range want {
+		if len(header.Get(name)) > 0 {
+			t.Errorf("upstream got %s %q without a client certificate", name, header.Get(name))
+		}
+	}
+}
+
+func TestLoadClientCAs(t *testing.T) {
+	if pool, err := LoadClientCAs(TLSConfig{}); pool != nil || err != nil {
+		t.Errorf("no client CA got %v, %v", pool, err)
+	}
+	if _, err := LoadClientCAs(TLSConfig{ClientCA: "-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----\n"}); err == nil {
+		t.Error("loaded a client CA without certificates")
+	}
+	ca := newCertAuthority(t, "clients")
+	if pool, err := LoadClientCAs(TLSConfig{ClientCA: ca.PEM}); err != nil || pool == nil {
+		t.Errorf("got %v, %v", pool, err)
+	}
+}
+
+func TestValidateClientCAs(t *testing.T) {
+	ca := newCertAuthority(t, "clients")
+	cert, key := ca.issue(t, "proxy", 2, true)
+	disabled := false
+	cases := []struct {
+		name string
+		cfg  Config
+		want string
+	}{
+		{"mtls key without tls", Config{
+			TLS:       TLSConfig{Enabled: &disabled},
+			HTTP:      HTTPConfig{Enabled: true, Upstream: "http://localhost:8080"},
+			RateLimit: RateLimitConfig{Requests: 1, Key: RateLimitKeyMTLS},
+		}, "rateLimit.key: mtls needs tls.clientCA or tls.clientCAFile"},
+		{"mtls key without a client CA", Config{
+			TLS:    TLSConfig{Upstream: "http://localhost:8080", Cert: cert, Key: key},
+			Routes: []RouteConfig{{Path: "/", Upstream: "http://localhost:8080", RateLimit: &RateLimitConfig{Requests: 1, Key: RateLimitKeyMTLS}}},
+		}, "routes[0].rateLimit.key: mtls needs"},
+		{"client CA without certificates", Config{
+			TLS: TLSConfig{Upstream: "http://localhost:8080", Cert: cert, Key: key, ClientCA: "-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----\n"},
+		}, "tls.clientCA: loading client CA: no certificates found"},
+		{"missing client CA file", Config{
+			TLS: TLSConfig{Upstream: "http://localhost:8080", Cert: cert, Key: key, ClientCAFile: "/nonexistent/ca.pem"},
+		}, "tls.clientCAFile: stat /nonexistent/ca.pem"},
+		{"mtls key with a client CA", Config{
+			TLS:       TLSConfig{Upstream: "http://localhost:8080", Cert: cert, Key: key, ClientCA: ca.PEM},
+			RateLimit: RateLimitConfig{Requests: 1, Key: RateLimitKeyMTLS},
+		}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validate(c.cfg, nil)
+			if len(c.want) == 0 {
+				if err != nil {
+					t.Errorf("got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Errorf("got %v, want %q", err, c.want)
+			}
+		})
+	}
+}
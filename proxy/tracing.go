@@ -0,0 +1,380 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Samplers, named after their OTEL_TRACES_SAMPLER equivalents.
+const (
+	SamplerAlwaysOn                = "always_on"
+	SamplerAlwaysOff               = "always_off"
+	SamplerTraceIDRatio            = "traceidratio"
+	SamplerParentBasedAlwaysOn     = "parentbased_always_on"
+	SamplerParentBasedAlwaysOff    = "parentbased_always_off"
+	SamplerParentBasedTraceIDRatio = "parentbased_traceidratio"
+)
+
+const (
+	PropagatorTraceContext = "tracecontext"
+	PropagatorB3           = "b3"
+)
+
+type TracingConfig struct {
+	Enabled       bool              `yaml:"enabled"`
+	Endpoint      string            `yaml:"endpoint"`
+	Headers       map[string]string `yaml:"headers" secret:"true"`
+	ServiceName   string            `yaml:"serviceName"`
+	Sampler       string            `yaml:"sampler"`
+	SamplerRatio  float64           `yaml:"samplerRatio"`
+	Propagators   []string          `yaml:"propagators"`
+	BatchSize     int               `yaml:"batchSize"`
+	QueueSize     int               `yaml:"queueSize"`
+	FlushInterval Duration          `yaml:"flushInterval"`
+	Timeout       Duration          `yaml:"timeout"`
+}
+
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id TraceID) IsValid() bool  { return id != TraceID{} }
+
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) IsValid() bool  { return id != SpanID{} }
+
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Sampled    bool
+	TraceState string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+const (
+	SpanKindServer = 2
+	SpanKindClient = 3
+)
+
+const (
+	SpanStatusUnset = 0
+	SpanStatusOK    = 1
+	SpanStatusError = 2
+)
+
+// Spans that are not sampled still propagate their ids but are never exported.
+type Span struct {
+	Name         string
+	Kind         int
+	Context      SpanContext
+	Parent       SpanID
+	Start        time.Time
+	End          time.Time
+	StatusCode   int
+	StatusDetail string
+
+	tracer     *Tracer
+	lock       sync.Mutex
+	attributes []spanAttribute
+	ended      bool
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || !s.Context.Sampled {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attributes = append(s.attributes, spanAttribute{key, value})
+}
+
+func (s *Span) SetStatus(code int, detail string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.StatusCode, s.StatusDetail = code, detail
+}
+
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.lock.Unlock()
+	if s.Context.Sampled && s.tracer.exporter != nil {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+type spanKey struct{}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+type Tracer struct {
+	Config   TracingConfig
+	exporter *OTLPExporter
+}
+
+func NewTracer(cfg TracingConfig) *Tracer {
+	t := &Tracer{Config: cfg}
+	if len(cfg.Endpoint) > 0 {
+		t.exporter = NewOTLPExporter(cfg)
+	}
+	return t
+}
+
+func (t *Tracer) Close(ctx context.Context) error {
+	if t.exporter == nil {
+		return nil
+	}
+	return t.exporter.Close(ctx)
+}
+
+func (t *Tracer) StartSpan(name string, kind int, parent SpanContext) *Span {
+	span := &Span{
+		Name:   name,
+		Kind:   kind,
+		Start:  time.Now(),
+		tracer: t,
+	}
+	span.Context.SpanID = newSpanID()
+	if parent.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.Context.TraceState = parent.TraceState
+		span.Parent = parent.SpanID
+		span.Context.Sampled = t.sample(parent.TraceID, &parent)
+	} else {
+		span.Context.TraceID = newTraceID()
+		span.Context.Sampled = t.sample(span.Context.TraceID, nil)
+	}
+	return span
+}
+
+func (t *Tracer) sample(id TraceID, parent *SpanContext) bool {
+	ratio := func() bool {
+		if t.Config.SamplerRatio >= 1 {
+			return true
+		}
+		if t.Config.SamplerRatio <= 0 {
+			return false
+		}
+		// the low 8 bytes of a trace id are random, so comparing them to the
+		// ratio of the id space samples consistently across services
+		return binary.BigEndian.Uint64(id[8:]) < uint64(t.Config.SamplerRatio*math.MaxUint64)
+	}
+	switch t.Config.Sampler {
+	case SamplerAlwaysOn:
+		return true
+	case SamplerAlwaysOff:
+		return false
+	case SamplerTraceIDRatio:
+		return ratio()
+	case SamplerParentBasedAlwaysOff:
+		return parent != nil && parent.Sampled
+	case SamplerParentBasedTraceIDRatio:
+		if parent != nil {
+			return parent.Sampled
+		}
+		return ratio()
+	default:
+		if parent != nil {
+			return parent.Sampled
+		}
+		return true
+	}
+}
+
+func (t *Tracer) propagates(name string) bool {
+	for _, propagator := range t.Config.Propagators {
+		if propagator == name {
+			return true
+		}
+	}
+	return false
+}
+
+// traceparent is preferred over b3
+func (t *Tracer) Extract(header http.Header) SpanContext {
+	if t.propagates(PropagatorTraceContext) {
+		if sc, ok := ParseTraceparent(header.Get("traceparent")); ok {
+			sc.TraceState = strings.Join(header.Values("tracestate"), ",")
+			return sc
+		}
+	}
+	if t.propagates(PropagatorB3) {
+		if sc, ok := ParseB3(header); ok {
+			return sc
+		}
+	}
+	return SpanContext{}
+}
+
+func (t *Tracer) Inject(sc SpanContext, header http.Header) {
+	if t.propagates(PropagatorTraceContext) {
+		header.Set("traceparent", FormatTraceparent(sc))
+		if len(sc.TraceState) > 0 {
+			header.Set("tracestate", sc.TraceState)
+		} else {
+			header.Del("tracestate")
+		}
+	}
+	if t.propagates(PropagatorB3) {
+		header.Del("b3")
+		header.Set("X-B3-TraceId", sc.TraceID.String())
+		header.Set("X-B3-SpanId", sc.SpanID.String())
+		header.Del("X-B3-ParentSpanId")
+		sampled := "0"
+		if sc.Sampled {
+			sampled = "1"
+		}
+		header.Set("X-B3-Sampled", sampled)
+	}
+}
+
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	// future versions may append fields, version 00 must not
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	if !decodeHex(parts[1], sc.TraceID[:]) || !decodeHex(parts[2], sc.SpanID[:]) || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil || !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags&1 == 1
+	return sc, true
+}
+
+func FormatTraceparent(sc SpanContext) string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// 64 bit b3 trace ids are left padded to 128 bits
+func ParseB3(header http.Header) (SpanContext, bool) {
+	traceID, spanID, sampled := header.Get("X-B3-TraceId"), header.Get("X-B3-SpanId"), header.Get("X-B3-Sampled")
+	if single := header.Get("b3"); len(single) > 0 {
+		parts := strings.Split(single, "-")
+		if len(parts) < 2 {
+			return SpanContext{}, false
+		}
+		traceID, spanID, sampled = parts[0], parts[1], ""
+		if len(parts) > 2 {
+			sampled = parts[2]
+		}
+	}
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	var sc SpanContext
+	if !decodeHex(traceID, sc.TraceID[:]) || !decodeHex(spanID, sc.SpanID[:]) || !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Sampled = sampled == "1" || sampled == "d" || sampled == "true"
+	return sc, true
+}
+
+func decodeHex(value string, into []byte) bool {
+	if len(value) != hex.EncodedLen(len(into)) || strings.ToLower(value) != value {
+		return false
+	}
+	_, err := hex.Decode(into, []byte(value))
+	return err == nil
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	rand.Read(id[:])
+	return id
+}
+
+func (t *Tracer) Handler(server string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req, info := withRequestInfo(req, server)
+		span := t.StartSpan(req.Method, SpanKindServer, t.Extract(req.Header))
+		span.SetAttribute("http.request.method", req.Method)
+		span.SetAttribute("url.path", req.URL.Path)
+		span.SetAttribute("url.scheme", schemeOf(req))
+		span.SetAttribute("server.address", info.Host)
+		span.SetAttribute("client.address", req.RemoteAddr)
+		span.SetAttribute("network.protocol.version", strings.TrimPrefix(req.Proto, "HTTP/"))
+		span.SetAttribute("user_agent.original", req.UserAgent())
+		span.SetAttribute("proxy.server", server)
+		if len(info.RequestID) > 0 {
+			span.SetAttribute("proxy.request_id", info.RequestID)
+		}
+
+		rec := &responseRecorder{ResponseWriter: rw}
+		next.ServeHTTP(rec, req.WithContext(ContextWithSpan(req.Context(), span)))
+
+		status := rec.Status()
+		if len(info.Route) > 0 {
+			span.Name = req.Method + " " + info.Route
+			span.SetAttribute("http.route", info.Route)
+		}
+		if len(info.Upstream) > 0 {
+			span.SetAttribute("proxy.upstream", info.Upstream)
+		}
+		span.SetAttribute("http.response.status_code", status)
+		if status >= 500 {
+			span.SetStatus(SpanStatusError, http.StatusText(status))
+		}
+		span.Finish()
+	})
+}
+
+func schemeOf(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
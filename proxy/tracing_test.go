@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+// newTracedProxy proxies /api to an upstream that records the traceparent it
+// was sent, all within the tracer's server spans.
+func newTracedProxy(t *testing.T, tracer *Tracer) (http.Handler, func() string) {
+	t.Helper()
+	var lock sync.Mutex
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		received = req.Header.Get("traceparent")
+		lock.Unlock()
+	}))
+	t.Cleanup(upstream.Close)
+
+	handler, err := NewProxyHandler(logger.None(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter("", []UpstreamConfig{{Name: "api", Targets: []string{upstream.URL}}}, []RouteConfig{{Name: "api", Path: "/api", Upstream: "api"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.SetRouter(router)
+	return tracer.Handler("tls", handler), func() string {
+		lock.Lock()
+		defer lock.Unlock()
+		return received
+	}
+}
+
+func tracerExportingTo(t *testing.T, endpoint, sampler string) *Tracer {
+	t.Helper()
+	cfg := ConfigOrDefault(Config{Tracing: TracingConfig{Enabled: true, Endpoint: endpoint, Sampler: sampler}}).Tracing
+	tracer := NewTracer(cfg)
+	t.Cleanup(func() { tracer.Close(context.Background()) })
+	return tracer
+}
+
+func TestTracingExportsSpans(t *testing.T) {
+	posted := make(chan otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("exported to %s as %s", req.URL.Path, req.Header.Get("Content-Type"))
+		}
+		var body otlpRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		posted <- body
+	}))
+	defer collector.Close()
+	tracer := tracerExportingTo(t, collector.URL+"/v1/traces", SamplerParentBasedAlwaysOn)
+	handler, received := newTracedProxy(t, tracer)
+
+	incoming := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	req := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+	req.Header.Set("traceparent", incoming)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if err := tracer.exporter.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, ok := ParseTraceparent(received())
+	if !ok {
+		t.Fatalf("upstream got traceparent %q", received())
+	}
+	if sent.TraceID.String() != "0af7651916cd43dd8448eb211c80319c" || !sent.Sampled {
+		t.Errorf("upstream got traceparent %q, want the incoming trace sampled", received())
+	}
+
+	body := <-posted
+	if len(body.ResourceSpans) != 1 || len(body.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("exported %+v, want one resource and scope", body)
+	}
+	resource := body.ResourceSpans[0]
+	if len(resource.Resource.Attributes) == 0 || resource.Resource.Attributes[0].Value["stringValue"] != "tls-proxy" {
+		t.Errorf("exported resource %+v, want the default service name", resource.Resource)
+	}
+	spans := resource.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want a client and a server span", len(spans))
+	}
+	client, server := spans[0], spans[1]
+	if server.Kind != SpanKindServer || client.Kind != SpanKindClient {
+		t.Fatalf("exported kinds %d and %d", client.Kind, server.Kind)
+	}
+	if server.Name != "GET api" || server.TraceID != sent.TraceID.String() || server.ParentSpanID != "b7ad6b7169203331" {
+		t.Errorf("server span %+v does not continue the incoming trace", server)
+	}
+	if client.SpanID != sent.SpanID.String() || client.ParentSpanID != server.SpanID || client.TraceID != server.TraceID {
+		t.Errorf("client span %+v is not the child of %s sent upstream", client, server.SpanID)
+	}
+	attrs := map[string]map[string]interface{}{}
+	for _, attr := range server.Attributes {
+		attrs[attr.Key] = attr.Value
+	}
+	if attrs["http.route"]["stringValue"] != "api" || attrs["http.response.status_code"]["intValue"] != "200" {
+		t.Errorf("server span attributes %v", attrs)
+	}
+}
+
+func TestTracingDropsSpansWhenTheCollectorIsDown(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+	tracer := tracerExportingTo(t, collector.URL+"/v1/traces", SamplerAlwaysOn)
+	handler, _ := newTracedProxy(t, tracer)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("request got %d with the collector down", rec.Code)
+	}
+	if err := tracer.exporter.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dropped := atomic.LoadUint64(&tracer.exporter.Dropped); dropped != 2 {
+		t.Errorf("dropped %d spans, want both", dropped)
+	}
+}
+
+func TestTracingSampling(t *testing.T) {
+	unsampled := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"
+	cases := []struct {
+		name        string
+		sampler     string
+		traceparent string
+		exported    int32
+		sampled     bool
+	}{
+		{"parent sampled out", SamplerParentBasedAlwaysOn, unsampled, 0, false},
+		{"new trace", SamplerParentBasedAlwaysOn, "", 2, true},
+		{"always off", SamplerAlwaysOff, "", 0, false},
+		{"parent based off", SamplerParentBasedAlwaysOff, "", 0, false},
+		{"always on overrides parent", SamplerAlwaysOn, unsampled, 2, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var exported int32
+			collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				var body otlpRequest
+				json.NewDecoder(req.Body).Decode(&body)
+				for _, rs := range body.ResourceSpans {
+					for _, ss := range rs.ScopeSpans {
+						atomic.AddInt32(&exported, int32(len(ss.Spans)))
+					}
+				}
+			}))
+			defer collector.Close()
+			tracer := tracerExportingTo(t, collector.URL+"/v1/traces", c.sampler)
+			handler, received := newTracedProxy(t, tracer)
+
+			req := httptest.NewRequest(http.MethodGet, "/api", nil)
+			if len(c.traceparent) > 0 {
+				req.Header.Set("traceparent", c.traceparent)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if err := tracer.exporter.Flush(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			sent, ok := ParseTraceparent(received())
+			if !ok {
+				t.Fatalf("upstream got traceparent %q", received())
+			}
+			if sent.Sampled != c.sampled {
+				t.Errorf("upstream got sampled %v, want %v", sent.Sampled, c.sampled)
+			}
+			if got := atomic.LoadInt32(&exported); got != c.exported {
+				t.Errorf("exported %d spans, want %d", got, c.exported)
+			}
+		})
+	}
+}
+
+func TestTraceIDRatioSampler(t *testing.T) {
+	tracer := NewTracer(TracingConfig{Sampler: SamplerTraceIDRatio, SamplerRatio: .25})
+	var low, high TraceID
+	binary.BigEndian.PutUint64(low[8:], 1<<60)
+	binary.BigEndian.PutUint64(high[8:], 1<<63)
+	if !tracer.sample(low, nil) {
+		t.Error("a trace id below the ratio was not sampled")
+	}
+	if tracer.sample(high, nil) {
+		t.Error("a trace id above the ratio was sampled")
+	}
+	// the ratio sampler ignores the parent, the parent based one does not
+	parent := &SpanContext{TraceID: high, SpanID: SpanID{1}, Sampled: true}
+	if tracer.sample(high, parent) {
+		t.Error("traceidratio followed the parent")
+	}
+	tracer.Config.Sampler = SamplerParentBasedTraceIDRatio
+	if !tracer.sample(high, parent) {
+		t.Error("parentbased_traceidratio did not follow the parent")
+	}
+}
+
+func TestB3Propagation(t *testing.T) {
+	tracer := NewTracer(TracingConfig{Propagators: []string{PropagatorB3}})
+	header := http.Header{}
+	header.Set("b3", "80f198ee56343ba8-e457b5a2e4d86bd1-1")
+	sc := tracer.Extract(header)
+	if sc.TraceID.String() != "000000000000000080f198ee56343ba8" || sc.SpanID.String() != "e457b5a2e4d86bd1" || !sc.Sampled {
+		t.Fatalf("extracted %+v", sc)
+	}
+	out := http.Header{}
+	tracer.Inject(sc, out)
+	if out.Get("X-B3-TraceId") != sc.TraceID.String() || out.Get("X-B3-SpanId") != "e457b5a2e4d86bd1" || out.Get("X-B3-Sampled") != "1" {
+		t.Errorf("injected %v", out)
+	}
+	if len(out.Get("traceparent")) > 0 {
+		t.Errorf("injected traceparent without the tracecontext propagator")
+	}
+}
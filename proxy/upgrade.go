@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	EnvReadyFD = "PROXY_READY_FD"
+
+	DefaultUpgradeTimeout = 30 * time.Second
+)
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// The caller remains responsible for draining and stopping this process.
+func (p *Proxy) Upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	names := make([]string, 0, len(p.Listeners))
+	for name := range p.Listeners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]*os.File, 0, len(names)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range names {
+		f, ok := p.Listeners[name].(filer)
+		if !ok {
+			p.lock.Unlock()
+			return fmt.Errorf("listener %q cannot be handed off", name)
+		}
+		file, err := f.File()
+		if err != nil {
+			p.lock.Unlock()
+			return err
+		}
+		files = append(files, file)
+	}
+	p.lock.Unlock()
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	env := []string{}
+	for _, kv := range os.Environ() {
+		switch strings.SplitN(kv, "=", 2)[0] {
+		case EnvListenPID, EnvListenFDs, EnvListenFDNames, EnvReadyFD:
+			continue
+		}
+		env = append(env, kv)
+	}
+	env = append(env,
+		fmt.Sprintf("%s=%d", EnvListenFDs, len(names)),
+		fmt.Sprintf("%s=%s", EnvListenFDNames, strings.Join(names, ":")),
+		fmt.Sprintf("%s=%d", EnvReadyFD, ListenFdsStart+len(names)),
+	)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.Log.Infof("Started upgraded process %d, waiting for it to become ready", cmd.Process.Pid)
+
+	// the child holds its own copies now, and must be the only writer so a
+	// crash shows up as EOF
+	readyW.Close()
+
+	timeout := p.UpgradeTimeout
+	if timeout == 0 {
+		timeout = DefaultUpgradeTimeout
+	}
+	result := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := io.ReadFull(ready, buf)
+		result <- err
+	}()
+
+	select {
+	case err = <-result:
+	case <-time.After(timeout):
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("upgraded process %d did not become ready: %w", cmd.Process.Pid, err)
+	}
+	p.Log.Infof("Upgraded process %d is ready", cmd.Process.Pid)
+	return cmd.Process.Release()
+}
+
+func (p *Proxy) notifyReady() {
+	if raw := os.Getenv(EnvReadyFD); len(raw) > 0 {
+		os.Unsetenv(EnvReadyFD)
+		fd, err := strconv.Atoi(raw)
+		if err != nil {
+			p.Log.Errorf("invalid %s %q", EnvReadyFD, raw)
+		} else {
+			f := os.NewFile(uintptr(fd), "ready")
+			if _, err := f.Write([]byte{1}); err != nil {
+				p.Log.Errorf("failed to notify parent of readiness: %v", err)
+			}
+			f.Close()
+		}
+	}
+	if err := SdNotify(fmt.Sprintf("MAINPID=%d\nREADY=1", os.Getpid())); err != nil {
+		p.Log.Errorf("failed to notify systemd of readiness: %v", err)
+	}
+}
+
+func (p *Proxy) handleUpgrades(done <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+				p.Log.Infof("Received upgrade signal")
+				if err := p.Upgrade(); err != nil {
+					p.Log.Errorf("Upgrade failed, continuing to serve: %v", err)
+					continue
+				}
+				go p.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func SdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if len(socket) == 0 {
+		return nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+const (
+	envUpgradeChild  = "TLS_PROXY_TEST_UPGRADE_CHILD"
+	envUpgradeAddr   = "TLS_PROXY_TEST_UPGRADE_ADDR"
+	envUpgradeMarker = "TLS_PROXY_TEST_UPGRADE_MARKER"
+)
+
+type stopFunc func()
+
+func (f stopFunc) Start() error { return nil }
+
+func (f stopFunc) Stop() error {
+	f()
+	return nil
+}
+
+// upgradingProxy is a running proxy holding l, whose servers stopping closes
+// the returned channel.
+func upgradingProxy(t *testing.T, l net.Listener) (*Proxy, chan struct{}) {
+	t.Helper()
+	stopped := make(chan struct{})
+	p := &Proxy{
+		Log:            logger.None(),
+		Listeners:      map[string]net.Listener{"tls": l},
+		UpgradeTimeout: 10 * time.Second,
+		running:        true,
+		stopped:        stopped,
+	}
+	p.TLSServer = stopFunc(func() { close(stopped) })
+	return p, stopped
+}
+
+// runAsUpgradeChild makes Upgrade start a copy of the test binary running only
+// this test, in the given child role.
+func runAsUpgradeChild(t *testing.T, role string) {
+	t.Helper()
+	args := os.Args
+	os.Args = []string{args[0], "-test.run=^" + t.Name() + "$"}
+	t.Cleanup(func() { os.Args = args })
+	t.Setenv(envUpgradeChild, role)
+}
+
+// TestUpgradeHandsOffListeners signals the upgrade as an operator would and
+// checks the parent keeps serving until the child is ready, which then
+// answers on the handed off listener.
+func TestUpgradeHandsOffListeners(t *testing.T) {
+	if os.Getenv(envUpgradeChild) == "serve" {
+		upgradeChildServe(t)
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	marker := filepath.Join(t.TempDir(), "ready")
+	runAsUpgradeChild(t, "serve")
+	t.Setenv(envUpgradeAddr, l.Addr().String())
+	t.Setenv(envUpgradeMarker, marker)
+
+	p, stopped := upgradingProxy(t, l)
+	done := make(chan struct{})
+	defer close(done)
+	p.handleUpgrades(done)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-stopped:
+		t.Fatal("stopped before the upgraded process was ready")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if err := os.WriteFile(marker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("did not stop once the upgraded process was ready")
+	}
+
+	l.Close()
+	res, err := http.Get("http://" + os.Getenv(envUpgradeAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != "upgraded" {
+		t.Errorf("handed off listener answered %q", body)
+	}
+}
+
+func upgradeChildServe(t *testing.T) {
+	listeners, err := InheritedListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, ok := listeners["tls"]
+	if !ok || l.Addr().String() != os.Getenv(envUpgradeAddr) {
+		t.Fatalf("inherited %v, want tls on %s", listeners, os.Getenv(envUpgradeAddr))
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(os.Getenv(envUpgradeMarker)); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("parent never allowed readiness")
+		}
+	}
+
+	served := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("upgraded"))
+		close(served)
+	})}
+	go server.Serve(l)
+	(&Proxy{Log: logger.None()}).notifyReady()
+	select {
+	case <-served:
+	case <-time.After(10 * time.Second):
+	}
+	server.Close()
+}
+
+func TestUpgradeChildNotReady(t *testing.T) {
+	if os.Getenv(envUpgradeChild) == "fail" {
+		os.Exit(1)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	runAsUpgradeChild(t, "fail")
+
+	p, stopped := upgradingProxy(t, l)
+	err = p.Upgrade()
+	if err == nil || !strings.Contains(err.Error(), "did not become ready") {
+		t.Fatalf("got %v, want the child reported not ready", err)
+	}
+	select {
+	case <-stopped:
+		t.Fatal("stopped after a failed upgrade")
+	default:
+	}
+}
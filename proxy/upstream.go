@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+type UpstreamConfig struct {
+	Name    string   `yaml:"name"`
+	Targets []string `yaml:"targets"`
+	// Retries is how many other targets an idempotent request without a body
+	// is retried on when a target cannot be reached
+	Retries int `yaml:"retries"`
+	// ResponseHeaderTimeout bounds how long a target gets to start answering
+	// once the request is sent, defaulting to 1m
+	ResponseHeaderTimeout Duration `yaml:"responseHeaderTimeout"`
+}
+
+// Target health is passive, following whether the last request sent to it
+// got a response.
+type Target struct {
+	URL          *url.URL
+	ReverseProxy *httputil.ReverseProxy
+	Forwarding   *Forwarding
+	Log          logger.Log
+	upstream     string
+	upstreamPort uint16
+	unhealthy    int32
+}
+
+func NewTarget(raw string) (*Target, error) {
+	target, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	up := uint16(0)
+	parsed, err := strconv.ParseUint(target.Port(), 10, 16)
+	if err == nil {
+		up = uint16(parsed)
+	}
+	t := &Target{
+		URL:          target,
+		ReverseProxy: &httputil.ReverseProxy{},
+		upstreamPort: up,
+	}
+	t.ReverseProxy.Rewrite = t.rewrite
+	t.ReverseProxy.ModifyResponse = func(res *http.Response) error {
+		if info := GetRequestInfo(res.Request.Context()); info != nil {
+			info.UpstreamLatency = time.Since(info.UpstreamStart)
+		}
+		if match := getRouteMatch(res.Request.Context()); match != nil {
+			match.Route.Rewrite.RewriteResponse(res, t.URL, match)
+		}
+		return nil
+	}
+	t.ReverseProxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		requestID := "-"
+		if info := GetRequestInfo(req.Context()); info != nil {
+			info.UpstreamLatency = time.Since(info.UpstreamStart)
+			if len(info.RequestID) > 0 {
+				requestID = info.RequestID
+			}
+		}
+		logger.MaybeErrorfContext(req.Context(), t.Log, "Upstream %s target %s failed request %s: %v", t.upstream, t.URL.Host, requestID, err)
+		rw.WriteHeader(upstreamErrorStatus(err))
+	}
+	return t, nil
+}
+
+func (t *Target) Healthy() bool {
+	return atomic.LoadInt32(&t.unhealthy) == 0
+}
+
+func (t *Target) setHealthy(healthy bool) {
+	value := int32(1)
+	if healthy {
+		value = 0
+	}
+	atomic.StoreInt32(&t.unhealthy, value)
+}
+
+func (t *Target) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if info := GetRequestInfo(req.Context()); info != nil {
+		info.UpstreamStart = time.Now()
+	}
+	t.ReverseProxy.ServeHTTP(rw, req)
+}
+
+func (t *Target) rewrite(pr *httputil.ProxyRequest) {
+	if match := getRouteMatch(pr.In.Context()); match != nil {
+		match.Route.Rewrite.Apply(pr.Out.URL, match.Prefix)
+	}
+	pr.SetURL(t.URL)
+	pr.Out.Host = pr.In.Host
+	if t.upstreamPort != 0 && !t.Forwarding.PreserveHost() {
+		if host, err := replacePort(pr.In.Host, t.upstreamPort); err == nil {
+			pr.Out.Host = host
+		}
+	}
+	if t.Forwarding != nil {
+		t.Forwarding.SetHeaders(pr)
+	} else {
+		pr.SetXForwarded()
+	}
+}
+
+type UpstreamPool struct {
+	Name    string
+	Targets []*Target
+	Retries int
+	Drains  *Drains
+
+	next uint32
+}
+
+func NewUpstreamPool(cfg UpstreamConfig) (*UpstreamPool, error) {
+	if len(cfg.Targets) == 0 {
+		return nil, fmt.Errorf("upstream %q has no targets", cfg.Name)
+	}
+	pool := &UpstreamPool{Name: cfg.Name, Retries: cfg.Retries}
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.ResponseHeaderTimeout = cfg.ResponseHeaderTimeout.Duration()
+	if base.ResponseHeaderTimeout == 0 {
+		base.ResponseHeaderTimeout = DefaultResponseHeaderTimeout
+	}
+	for _, raw := range cfg.Targets {
+		target, err := NewTarget(raw)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", cfg.Name, err)
+		}
+		target.upstream = cfg.Name
+		target.ReverseProxy.Transport = &upstreamTransport{
+			Pool:   pool,
+			Target: target,
+			Base:   base,
+		}
+		pool.Targets = append(pool.Targets, target)
+	}
+	return pool, nil
+}
+
+// Pick returns nil when the whole pool is drained.
+func (up *UpstreamPool) Pick() *Target {
+	for range up.Targets {
+		n := atomic.AddUint32(&up.next, 1)
+		target := up.Targets[int(n-1)%len(up.Targets)]
+		if !up.Drains.Drained(up.Name, target.URL.Host) {
+			return target
+		}
+	}
+	return nil
+}
+
+func (up *UpstreamPool) Healthy() bool {
+	for _, target := range up.Targets {
+		if target.Healthy() && !up.Drains.Drained(up.Name, target.URL.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (up *UpstreamPool) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	target := up.Pick()
+	if target == nil {
+		http.Error(rw, "upstream drained", http.StatusServiceUnavailable)
+		return
+	}
+	target.ServeHTTP(rw, req)
+}
+
+// Drains are kept by name so they outlive the pools rebuilt on reload.
+type Drains struct {
+	lock    sync.RWMutex
+	drained map[string]bool
+}
+
+func NewDrains() *Drains {
+	return &Drains{drained: map[string]bool{}}
+}
+
+func drainKey(upstream, target string) string {
+	if len(target) == 0 {
+		return upstream
+	}
+	return upstream + " " + target
+}
+
+// Drain takes the whole upstream out of rotation when target is empty.
+func (d *Drains) Drain(upstream, target string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.drained[drainKey(upstream, target)] = true
+}
+
+func (d *Drains) Undrain(upstream, target string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.drained, drainKey(upstream, target))
+}
+
+func (d *Drains) Drained(upstream, target string) bool {
+	if d == nil {
+		return false
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.drained[upstream] || d.drained[drainKey(upstream, target)]
+}
+
+// upstreamTransport retries unreachable targets on the others in the pool,
+// which only changes the scheme and host of the request.
+type upstreamTransport struct {
+	Pool   *UpstreamPool
+	Target *Target
+	Base   http.RoundTripper
+}
+
+func (ut *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	retryable := ut.Pool.Retries > 0 && (req.Body == nil || req.Body == http.NoBody)
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+	default:
+		retryable = false
+	}
+
+	target := ut.Target
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			req = req.Clone(ctx)
+			req.URL.Scheme, req.URL.Host = target.URL.Scheme, target.URL.Host
+			if info := GetRequestInfo(ctx); info != nil {
+				info.Target = target.URL.Host
+			}
+		}
+		res, err := ut.attempt(req, attempt)
+		if err == nil {
+			target.setHealthy(true)
+			return res, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		target.setHealthy(false)
+		if !retryable || attempt >= ut.Pool.Retries || len(ut.Pool.Targets) < 2 {
+			return nil, err
+		}
+		next := ut.Pool.Pick()
+		for i := 0; i < len(ut.Pool.Targets) && next == target; i++ {
+			next = ut.Pool.Pick()
+		}
+		if next == nil || next == target {
+			return nil, err
+		}
+		target = next
+	}
+}
+
+func (ut *upstreamTransport) attempt(req *http.Request, attempt int) (*http.Response, error) {
+	parent := SpanFromContext(req.Context())
+	if parent == nil {
+		return ut.Base.RoundTrip(req)
+	}
+	span := parent.tracer.StartSpan(req.Method, SpanKindClient, parent.Context)
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("server.address", req.URL.Hostname())
+	span.SetAttribute("url.full", req.URL.String())
+	if attempt > 0 {
+		span.SetAttribute("http.request.resend_count", attempt)
+	}
+	parent.tracer.Inject(span.Context, req.Header)
+
+	res, err := ut.Base.RoundTrip(req)
+	if err != nil {
+		span.SetStatus(SpanStatusError, err.Error())
+	} else {
+		span.SetAttribute("http.response.status_code", res.StatusCode)
+		if res.StatusCode >= 500 {
+			span.SetStatus(SpanStatusError, http.StatusText(res.StatusCode))
+		}
+	}
+	span.Finish()
+	return res, err
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blend/go-sdk/logger"
+)
+
+func TestUpstreamErrorsAreLogged(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	output := &bytes.Buffer{}
+	log := logger.MustNew(logger.OptOutput(output), logger.OptText(logger.OptTextNoColor()))
+	router, err := NewRouter("api", []UpstreamConfig{{Name: "api", Targets: []string{"http://" + down}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.SetLog(log)
+
+	req, info := withRequestInfo(httptest.NewRequest(http.MethodGet, "/", nil), "tls")
+	info.RequestID = "req-1234"
+	rec := httptest.NewRecorder()
+	router.Default.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("got %d, want 502", rec.Code)
+	}
+	log.Drain()
+	for _, want := range []string{"api", down, "req-1234", "connection refused"} {
+		if !strings.Contains(output.String(), want) {
+			t.Errorf("logged %q, missing %q", output.String(), want)
+		}
+	}
+}
@@ -0,0 +1,829 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type ValidationError struct {
+	File    string
+	Line    int
+	Field   string
+	Message string
+}
+
+func (ve ValidationError) Error() string {
+	msg := ve.Message
+	if len(ve.Field) > 0 {
+		msg = ve.Field + ": " + msg
+	}
+	if loc := (location{File: ve.File, Line: ve.Line}).String(); len(loc) > 0 {
+		return loc + ": " + msg
+	}
+	return msg
+}
+
+type location struct {
+	File string
+	Line int
+}
+
+func (l location) String() string {
+	switch {
+	case len(l.File) > 0 && l.Line > 0:
+		return fmt.Sprintf("%s:%d", l.File, l.Line)
+	case len(l.File) > 0:
+		return l.File
+	case l.Line > 0:
+		return fmt.Sprintf("line %d", l.Line)
+	default:
+		return ""
+	}
+}
+
+// some formats only locate list items, so fall back to the closest parent
+func locate(lines map[string]location, field string) location {
+	for len(field) > 0 {
+		if loc, ok := lines[field]; ok {
+			return loc
+		}
+		cut := strings.LastIndexAny(field, ".[")
+		if cut < 0 {
+			break
+		}
+		field = field[:cut]
+	}
+	return location{}
+}
+
+type ValidationErrors []ValidationError
+
+func (ves ValidationErrors) Error() string {
+	lines := make([]string, 0, len(ves))
+	for _, ve := range ves {
+		lines = append(lines, ve.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (ves ValidationErrors) orNil() error {
+	if len(ves) == 0 {
+		return nil
+	}
+	sort.SliceStable(ves, func(i, j int) bool {
+		if ves[i].File != ves[j].File {
+			return ves[i].File < ves[j].File
+		}
+		if ves[i].Line == 0 || ves[j].Line == 0 {
+			return ves[i].Line != 0
+		}
+		return ves[i].Line < ves[j].Line
+	})
+	return ves
+}
+
+func Validate(cfg Config) error {
+	return validate(cfg, nil)
+}
+
+type validator struct {
+	lines map[string]location
+	errs  ValidationErrors
+	// whether clients can present certificates to key rate limits by
+	clientCAs bool
+}
+
+func (v *validator) add(field, format string, args ...interface{}) {
+	loc := locate(v.lines, field)
+	v.errs = append(v.errs, ValidationError{
+		File:    loc.File,
+		Line:    loc.Line,
+		Field:   field,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func validate(cfg Config, lines map[string]location, errs ...ValidationError) error {
+	v := &validator{lines: lines, errs: errs}
+	cfg = ConfigOrDefault(cfg)
+	v.clientCAs = cfg.TLS.IsEnabled() && (len(cfg.TLS.ClientCA) > 0 || len(cfg.TLS.ClientCAFile) > 0)
+
+	// with routes, requests matching none of them get a 404 when there is no
+	// default upstream
+	routed := len(cfg.Routes) > 0
+	if cfg.TLS.IsEnabled() && (!routed || len(cfg.TLS.Upstream) > 0) {
+		v.upstream("tls.upstream", cfg.TLS.Upstream)
+	}
+	if cfg.TLS.IsEnabled() {
+		certOK := v.pem("tls.cert", cfg.TLS.Cert, "tls.certFile", cfg.TLS.CertFile)
+		keyOK := v.pem("tls.key", cfg.TLS.Key, "tls.keyFile", cfg.TLS.KeyFile)
+		if certOK && keyOK {
+			if _, err := LoadCertificate(cfg.TLS); err != nil {
+				field := "tls.certFile"
+				if len(cfg.TLS.Cert) > 0 {
+					field = "tls.cert"
+				}
+				v.add(field, "%v", err)
+			}
+		}
+		if len(cfg.TLS.ClientCA) > 0 || len(cfg.TLS.ClientCAFile) > 0 {
+			if v.pem("tls.clientCA", cfg.TLS.ClientCA, "tls.clientCAFile", cfg.TLS.ClientCAFile) {
+				if _, err := LoadClientCAs(cfg.TLS); err != nil {
+					field := "tls.clientCAFile"
+					if len(cfg.TLS.ClientCA) > 0 {
+						field = "tls.clientCA"
+					}
+					v.add(field, "%v", err)
+				}
+			}
+		}
+	}
+	if cfg.HTTP.Enabled && (!routed || len(cfg.HTTP.Upstream) > 0) {
+		v.upstream("http.upstream", cfg.HTTP.Upstream)
+	}
+	v.routing(cfg.Upstreams, cfg.Routes, cfg.GeoIP)
+	if len(cfg.GeoIP.Database) > 0 {
+		if _, err := OpenMaxMindDB(cfg.GeoIP.Database); err != nil {
+			v.add("geoIP.database", "%v", err)
+		}
+	}
+	v.access("access", cfg.Access, cfg.GeoIP)
+
+	type bound struct {
+		section  string
+		port     uint16
+		listener string
+		limits   ServerLimitsConfig
+	}
+	servers := []bound{}
+	if cfg.TLS.IsEnabled() {
+		servers = append(servers, bound{"tls", cfg.TLS.Port, cfg.TLS.Listener, cfg.TLS.Limits})
+	}
+	if cfg.HTTP.Enabled {
+		servers = append(servers, bound{"http", cfg.HTTP.Port, cfg.HTTP.Listener, cfg.HTTP.Limits})
+	}
+	if cfg.Redirect.Enabled {
+		servers = append(servers, bound{"redirect", cfg.Redirect.Port, cfg.Redirect.Listener, cfg.Redirect.Limits})
+	}
+	if cfg.Metrics.Enabled {
+		servers = append(servers, bound{"metrics", cfg.Metrics.Port, cfg.Metrics.Listener, cfg.Metrics.Limits})
+	}
+	if cfg.Admin.Enabled {
+		port, _ := adminPort(cfg.Admin)
+		servers = append(servers, bound{"admin", port, cfg.Admin.Listener, cfg.Admin.Limits})
+	}
+	for i, a := range servers {
+		v.limits(a.section, a.limits)
+		for _, b := range servers[:i] {
+			if a.port == b.port {
+				v.add(a.section+".port", "collides with %s.port %d", b.section, b.port)
+			}
+			if a.listener == b.listener {
+				v.add(a.section+".listener", "collides with %s.listener %q", b.section, b.listener)
+			}
+		}
+	}
+	if cfg.Admin.Enabled {
+		v.admin(cfg.Admin)
+	}
+	v.rateLimit("rateLimit", cfg.RateLimit)
+	switch cfg.RateLimit.OnError {
+	case "", RateLimitOnErrorLocal, RateLimitOnErrorOpen, RateLimitOnErrorClosed:
+	default:
+		v.add("rateLimit.onError", "must be %s, %s or %s, got %q", RateLimitOnErrorLocal, RateLimitOnErrorOpen, RateLimitOnErrorClosed, cfg.RateLimit.OnError)
+	}
+	if redis := cfg.RateLimit.Redis; len(redis.Address) > 0 {
+		if _, _, err := net.SplitHostPort(redis.Address); err != nil {
+			v.add("rateLimit.redis.address", "must be host:port, got %q", redis.Address)
+		}
+		if redis.DB < 0 {
+			v.add("rateLimit.redis.db", "must not be negative")
+		}
+		if redis.Timeout < 0 {
+			v.add("rateLimit.redis.timeout", "must not be negative")
+		}
+		if redis.MaxIdle < 0 {
+			v.add("rateLimit.redis.maxIdle", "must not be negative")
+		}
+	}
+	if cfg.Shutdown.DrainPeriod < 0 {
+		v.add("shutdown.drainPeriod", "must not be negative")
+	}
+	if cfg.Shutdown.Timeout < 0 {
+		v.add("shutdown.timeout", "must not be negative")
+	}
+	if len(cfg.Health.LivenessPath) > 0 && !strings.HasPrefix(cfg.Health.LivenessPath, "/") {
+		v.add("health.livenessPath", "must start with /")
+	}
+	if len(cfg.Health.ReadinessPath) > 0 && !strings.HasPrefix(cfg.Health.ReadinessPath, "/") {
+		v.add("health.readinessPath", "must start with /")
+	}
+	if len(cfg.Health.LivenessPath) > 0 && cfg.Health.LivenessPath == cfg.Health.ReadinessPath {
+		v.add("health.livenessPath", "collides with health.readinessPath")
+	}
+	if !strings.HasPrefix(cfg.Metrics.Path, "/") {
+		v.add("metrics.path", "must start with /")
+	}
+	if cfg.AccessLog.IsEnabled() {
+		switch cfg.AccessLog.Format {
+		case AccessLogCommon, AccessLogCombined, AccessLogJSON:
+		case AccessLogTemplate:
+			if _, err := ParseAccessLogTemplate(cfg.AccessLog.Template); err != nil {
+				v.add("accessLog.template", "%v", err)
+			}
+		default:
+			v.add("accessLog.format", "must be common, combined, json or template, got %q", cfg.AccessLog.Format)
+		}
+		if cfg.AccessLog.MaxSize < 0 {
+			v.add("accessLog.maxSize", "must not be negative")
+		}
+		if cfg.AccessLog.MaxBackups < 0 {
+			v.add("accessLog.maxBackups", "must not be negative")
+		}
+	}
+	if cfg.Tracing.Enabled {
+		if len(cfg.Tracing.Endpoint) > 0 {
+			v.upstream("tracing.endpoint", cfg.Tracing.Endpoint)
+		}
+		switch cfg.Tracing.Sampler {
+		case SamplerAlwaysOn, SamplerAlwaysOff, SamplerParentBasedAlwaysOn, SamplerParentBasedAlwaysOff:
+		case SamplerTraceIDRatio, SamplerParentBasedTraceIDRatio:
+			if cfg.Tracing.SamplerRatio < 0 || cfg.Tracing.SamplerRatio > 1 {
+				v.add("tracing.samplerRatio", "must be between 0 and 1")
+			}
+		default:
+			v.add("tracing.sampler", "unknown sampler %q", cfg.Tracing.Sampler)
+		}
+		for i, propagator := range cfg.Tracing.Propagators {
+			if propagator != PropagatorTraceContext && propagator != PropagatorB3 {
+				v.add(fmt.Sprintf("tracing.propagators[%d]", i), "must be %s or %s", PropagatorTraceContext, PropagatorB3)
+			}
+		}
+		if cfg.Tracing.BatchSize < 0 {
+			v.add("tracing.batchSize", "must not be negative")
+		}
+		if cfg.Tracing.QueueSize < 0 {
+			v.add("tracing.queueSize", "must not be negative")
+		}
+		if cfg.Tracing.FlushInterval < 0 {
+			v.add("tracing.flushInterval", "must not be negative")
+		}
+	}
+	if cfg.RequestID.Enabled {
+		if !validHeaderName(cfg.RequestID.Header) {
+			v.add("requestID.header", "%q is not a valid header name", cfg.RequestID.Header)
+		}
+		v.cidrs("requestID.trusted", cfg.RequestID.Trusted)
+	}
+	v.forwarded(cfg.Forwarded)
+	if cfg.Reload.Watch && cfg.Reload.Interval <= 0 {
+		v.add("reload.interval", "must be positive when watching")
+	}
+	return v.errs.orNil()
+}
+
+func (v *validator) routing(upstreams []UpstreamConfig, routes []RouteConfig, geoIP GeoIPConfig) {
+	names := map[string]int{}
+	for i, up := range upstreams {
+		field := fmt.Sprintf("upstreams[%d]", i)
+		if len(up.Name) == 0 {
+			v.add(field+".name", "is required")
+		} else if first, ok := names[up.Name]; ok {
+			v.add(field+".name", "upstream %q is already defined at %s", up.Name, v.declared(fmt.Sprintf("upstreams[%d]", first)))
+		} else {
+			names[up.Name] = i
+		}
+		if len(up.Targets) == 0 {
+			v.add(field+".targets", "needs at least one target")
+		}
+		if up.Retries < 0 {
+			v.add(field+".retries", "must not be negative")
+		}
+		if up.ResponseHeaderTimeout < 0 {
+			v.add(field+".responseHeaderTimeout", "must not be negative")
+		}
+		for j, target := range up.Targets {
+			v.upstream(fmt.Sprintf("%s.targets[%d]", field, j), target)
+		}
+	}
+
+	routeNames := map[string]int{}
+	claimed := map[string]int{}
+	for i, route := range routes {
+		field := fmt.Sprintf("routes[%d]", i)
+		if len(route.Name) > 0 {
+			if first, ok := routeNames[route.Name]; ok {
+				v.add(field+".name", "route %q is already defined at %s", route.Name, v.declared(fmt.Sprintf("routes[%d]", first)))
+			} else {
+				routeNames[route.Name] = i
+			}
+		}
+		if route.RateLimit != nil {
+			v.rateLimit(field+".rateLimit", *route.RateLimit)
+		}
+		if route.Access != nil {
+			v.access(field+".access", *route.Access, geoIP)
+		}
+		if route.Auth != nil {
+			v.auth(field+".auth", *route.Auth)
+		}
+		if route.Rewrite != nil {
+			v.rewrite(field+".rewrite", *route.Rewrite)
+		}
+		if route.Timeout < 0 {
+			v.add(field+".timeout", "must not be negative")
+		}
+		if route.Headers != nil {
+			v.headerRules(field+".headers.request", route.Headers.Request)
+			v.headerRules(field+".headers.response", route.Headers.Response)
+		}
+		if strings.Contains(strings.TrimPrefix(route.Host, "*."), "*") {
+			v.add(field+".host", "wildcards are only allowed as a leading *.")
+		} else if strings.Contains(route.Host, ":") {
+			v.add(field+".host", "must not include a port")
+		}
+		path := route.Path
+		if len(path) == 0 {
+			path = "/"
+		} else if !strings.HasPrefix(path, "/") {
+			v.add(field+".path", "must start with /")
+		}
+		v.pathParams(field+".path", path)
+		claim := strings.ToLower(route.Host) + path
+		if first, ok := claimed[claim]; ok {
+			v.add(field, "host %q and path %q are already routed at %s", route.Host, path, v.declared(fmt.Sprintf("routes[%d]", first)))
+		} else {
+			claimed[claim] = i
+		}
+		switch {
+		case len(route.Upstream) == 0:
+			v.add(field+".upstream", "is required")
+		case strings.Contains(route.Upstream, "://"):
+			v.upstream(field+".upstream", route.Upstream)
+		default:
+			if _, ok := names[route.Upstream]; !ok {
+				v.add(field+".upstream", "unknown upstream %q", route.Upstream)
+			}
+		}
+	}
+}
+
+func (v *validator) limits(section string, cfg ServerLimitsConfig) {
+	field := section + ".limits"
+	if cfg.ReadHeaderTimeout < 0 {
+		v.add(field+".readHeaderTimeout", "must not be negative")
+	}
+	if cfg.WriteTimeout < 0 {
+		v.add(field+".writeTimeout", "must not be negative")
+	}
+	if cfg.IdleTimeout < 0 {
+		v.add(field+".idleTimeout", "must not be negative")
+	}
+	if cfg.MaxHeaderBytes < 0 {
+		v.add(field+".maxHeaderBytes", "must not be negative")
+	}
+	if section != "tls" && section != "http" {
+		if cfg.MaxBodyBytes != 0 {
+			v.add(field+".maxBodyBytes", "only applies to the tls and http servers")
+		}
+		if cfg.RequestTimeout != 0 {
+			v.add(field+".requestTimeout", "only applies to the tls and http servers")
+		}
+	}
+}
+
+func (v *validator) declared(field string) string {
+	if loc := locate(v.lines, field); len(loc.String()) > 0 {
+		return loc.String()
+	}
+	return field
+}
+
+func (v *validator) upstream(field, raw string) {
+	if len(raw) == 0 {
+		v.add(field, "is required")
+		return
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		v.add(field, "%v", err)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		v.add(field, "scheme must be http or https, got %q", u.Scheme)
+	}
+	if len(u.Host) == 0 {
+		v.add(field, "is missing a host")
+	}
+}
+
+func (v *validator) rateLimit(field string, cfg RateLimitConfig) {
+	if cfg.Requests < 0 {
+		v.add(field+".requests", "must not be negative")
+	}
+	if cfg.Period < 0 {
+		v.add(field+".period", "must not be negative")
+	}
+	if cfg.Burst < 0 {
+		v.add(field+".burst", "must not be negative")
+	}
+	if cfg.MaxKeys < 0 {
+		v.add(field+".maxKeys", "must not be negative")
+	}
+	if len(cfg.Key) > 0 && !validRateLimitKey(cfg.Key) {
+		v.add(field+".key", "must be %s, %s or %s<name>, got %q", RateLimitKeyIP, RateLimitKeyMTLS, RateLimitKeyHeader, cfg.Key)
+	}
+	if cfg.Key == RateLimitKeyMTLS && !v.clientCAs {
+		v.add(field+".key", "%s needs tls.clientCA or tls.clientCAFile to verify client certificates", RateLimitKeyMTLS)
+	}
+}
+
+func (v *validator) access(field string, cfg AccessConfig, geoIP GeoIPConfig) {
+	v.cidrs(field+".allow", cfg.Allow)
+	v.cidrs(field+".deny", cfg.Deny)
+	for i, country := range cfg.AllowCountries {
+		if !validCountryCode.MatchString(country) {
+			v.add(fmt.Sprintf("%s.allowCountries[%d]", field, i), "must be a two letter ISO 3166 country code, got %q", country)
+		}
+	}
+	for i, country := range cfg.DenyCountries {
+		if !validCountryCode.MatchString(country) {
+			v.add(fmt.Sprintf("%s.denyCountries[%d]", field, i), "must be a two letter ISO 3166 country code, got %q", country)
+		}
+	}
+	if cfg.UsesCountries() && len(geoIP.Database) == 0 {
+		v.add(field, "country rules need geoIP.database")
+	}
+	if cfg.Status != 0 && (cfg.Status < 100 || cfg.Status > 599) {
+		v.add(field+".status", "must be an http status code, got %d", cfg.Status)
+	}
+}
+
+var validParamName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func (v *validator) pathParams(field, path string) {
+	if !strings.Contains(path, "{") {
+		return
+	}
+	seen := map[string]bool{}
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		name, ok := pathParam(segment)
+		if !ok {
+			if strings.ContainsAny(segment, "{}") {
+				v.add(field, "param segment %q must be a whole segment of {name}", segment)
+			}
+			continue
+		}
+		if !validParamName.MatchString(name) {
+			v.add(field, "invalid param name %q", name)
+		} else if seen[name] {
+			v.add(field, "param %q is used twice", name)
+		}
+		seen[name] = true
+	}
+}
+
+func (v *validator) rewrite(field string, cfg RewriteConfig) {
+	if len(cfg.Prefix) > 0 && !strings.HasPrefix(cfg.Prefix, "/") {
+		v.add(field+".prefix", "must start with /")
+	}
+	if len(cfg.Regex) > 0 {
+		if _, err := regexp.Compile(cfg.Regex); err != nil {
+			v.add(field+".regex", "%v", err)
+		}
+	} else if len(cfg.Replacement) > 0 {
+		v.add(field+".replacement", "needs a regex")
+	}
+	if len(cfg.Prefix) == 0 && len(cfg.Regex) == 0 {
+		v.add(field, "needs a prefix or a regex")
+	}
+}
+
+func (v *validator) headerRules(field string, cfg HeaderRulesConfig) {
+	check := func(field, name string) {
+		if !validHeaderName(name) {
+			v.add(field, "invalid header name %q", name)
+		} else if strings.EqualFold(name, "Host") {
+			v.add(field, "the Host header cannot be changed by header rules")
+		}
+	}
+	for i, name := range cfg.Remove {
+		check(fmt.Sprintf("%s.remove[%d]", field, i), name)
+	}
+	for _, from := range sortedKeys(cfg.Rename) {
+		check(field+".rename."+from, from)
+		check(field+".rename."+from, cfg.Rename[from])
+	}
+	for _, name := range sortedKeys(cfg.Set) {
+		check(field+".set."+name, name)
+		if _, err := ParseHeaderTemplate(name, cfg.Set[name]); err != nil {
+			v.add(field+".set."+name, "%v", err)
+		}
+	}
+	for _, name := range sortedKeys(cfg.Add) {
+		check(field+".add."+name, name)
+		if _, err := ParseHeaderTemplate(name, cfg.Add[name]); err != nil {
+			v.add(field+".add."+name, "%v", err)
+		}
+	}
+}
+
+func (v *validator) forwarded(cfg ForwardedConfig) {
+	v.cidrs("forwarded.trustedProxies", cfg.TrustedProxies)
+	switch cfg.Mode {
+	case "", ForwardedModeAppend, ForwardedModeOverwrite:
+	default:
+		v.add("forwarded.mode", "must be %s or %s, got %q", ForwardedModeAppend, ForwardedModeOverwrite, cfg.Mode)
+	}
+	for i, header := range cfg.Headers {
+		known := false
+		for _, h := range ForwardingHeaders {
+			known = known || strings.EqualFold(h, header)
+		}
+		if !known {
+			v.add(fmt.Sprintf("forwarded.headers[%d]", i), "must be one of %s, got %q", strings.Join(ForwardingHeaders, ", "), header)
+		}
+	}
+}
+
+func (v *validator) auth(field string, cfg AuthConfig) {
+	modes := 0
+	if cfg.Basic != nil {
+		modes++
+		if len(cfg.Basic.HtpasswdFile) == 0 {
+			v.add(field+".basic.htpasswdFile", "is required")
+		} else if _, err := ReadHtpasswd(cfg.Basic.HtpasswdFile); err != nil {
+			v.add(field+".basic.htpasswdFile", "%v", err)
+		}
+	}
+	if cfg.JWT != nil {
+		modes++
+		jwt := *cfg.JWT
+		if len(jwt.JWKSURL) == 0 && len(jwt.KeyFiles) == 0 && len(jwt.Secret) == 0 {
+			v.add(field+".jwt", "needs a jwksURL, keyFiles or a secret")
+		}
+		if len(jwt.JWKSURL) > 0 {
+			v.upstream(field+".jwt.jwksURL", jwt.JWKSURL)
+		}
+		for i, file := range jwt.KeyFiles {
+			if _, err := readPublicKey(file); err != nil {
+				v.add(fmt.Sprintf("%s.jwt.keyFiles[%d]", field, i), "%v", err)
+			}
+		}
+		for _, claim := range sortedKeys(jwt.ForwardClaims) {
+			if !validHeaderName(jwt.ForwardClaims[claim]) {
+				v.add(field+".jwt.forwardClaims."+claim, "invalid header name %q", jwt.ForwardClaims[claim])
+			}
+		}
+		if jwt.ClockSkew < 0 {
+			v.add(field+".jwt.clockSkew", "must not be negative")
+		}
+		if jwt.JWKSRefresh < 0 {
+			v.add(field+".jwt.jwksRefresh", "must not be negative")
+		}
+	}
+	if cfg.Forward != nil {
+		modes++
+		v.upstream(field+".forward.url", cfg.Forward.URL)
+		for i, header := range cfg.Forward.RequestHeaders {
+			if !validHeaderName(header) {
+				v.add(fmt.Sprintf("%s.forward.requestHeaders[%d]", field, i), "invalid header name %q", header)
+			}
+		}
+		for i, header := range cfg.Forward.ResponseHeaders {
+			if !validHeaderName(header) {
+				v.add(fmt.Sprintf("%s.forward.responseHeaders[%d]", field, i), "invalid header name %q", header)
+			}
+		}
+		if cfg.Forward.Timeout < 0 {
+			v.add(field+".forward.timeout", "must not be negative")
+		}
+	}
+	if cfg.OIDC != nil {
+		modes++
+		oidc := *cfg.OIDC
+		v.upstream(field+".oidc.issuer", oidc.Issuer)
+		if len(oidc.ClientID) == 0 {
+			v.add(field+".oidc.clientID", "is required")
+		}
+		if len(oidc.CookieSecret) < 32 {
+			v.add(field+".oidc.cookieSecret", "must be at least 32 characters")
+		}
+		if len(oidc.CallbackPath) > 0 && !strings.HasPrefix(oidc.CallbackPath, "/") {
+			v.add(field+".oidc.callbackPath", "must start with /")
+		}
+		if len(oidc.LogoutPath) > 0 && !strings.HasPrefix(oidc.LogoutPath, "/") {
+			v.add(field+".oidc.logoutPath", "must start with /")
+		}
+		if len(oidc.CallbackPath) > 0 && oidc.CallbackPath == oidc.LogoutPath {
+			v.add(field+".oidc.logoutPath", "must differ from callbackPath")
+		}
+		if oidc.SessionTTL < 0 {
+			v.add(field+".oidc.sessionTTL", "must not be negative")
+		}
+	}
+	if modes != 1 {
+		v.add(field, "needs exactly one of basic, jwt, forward or oidc")
+	}
+}
+
+var validCountryCode = regexp.MustCompile(`^[A-Za-z]{2}$`)
+
+func (v *validator) admin(cfg AdminConfig) {
+	if cfg.IsUnix() {
+		if len(strings.TrimPrefix(cfg.Address, AdminUnixPrefix)) == 0 {
+			v.add("admin.address", "is missing the socket path")
+		}
+		return
+	}
+	host, _, err := net.SplitHostPort(cfg.Address)
+	if err != nil {
+		v.add("admin.address", "must be host:port or %s/path, got %q", AdminUnixPrefix, cfg.Address)
+		return
+	}
+	if _, err := adminPort(cfg); err != nil {
+		v.add("admin.address", "%v", err)
+		return
+	}
+	ip := net.ParseIP(host)
+	loopback := host == "localhost" || (ip != nil && ip.IsLoopback())
+	if !loopback && len(cfg.Token) == 0 {
+		v.add("admin.token", "is required when admin.address %q is not a loopback address", cfg.Address)
+	}
+}
+
+func adminPort(cfg AdminConfig) (uint16, error) {
+	if cfg.IsUnix() {
+		return 0, nil
+	}
+	_, port, err := net.SplitHostPort(cfg.Address)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid port %q", port)
+	}
+	return uint16(n), nil
+}
+
+func (v *validator) cidrs(field string, values []string) {
+	for i, value := range values {
+		if _, err := ParseCIDRs([]string{value}); err != nil {
+			v.add(fmt.Sprintf("%s[%d]", field, i), "%v", err)
+		}
+	}
+}
+
+func validHeaderName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, c := range name {
+		if c > 0x7e || c <= 0x20 || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *validator) file(field, path string) {
+	if len(path) == 0 {
+		v.add(field, "is required")
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		v.add(field, "%v", err)
+		return
+	}
+	if info.IsDir() {
+		v.add(field, "%s is a directory", path)
+	}
+}
+
+func (v *validator) pem(inlineField, inline, fileField, file string) bool {
+	if len(inline) > 0 {
+		if !strings.Contains(inline, "-----BEGIN ") {
+			v.add(inlineField, "is not a PEM block")
+			return false
+		}
+		return true
+	}
+	if len(file) == 0 {
+		v.add(fileField, "or %s is required", inlineField)
+		return false
+	}
+	before := len(v.errs)
+	v.file(fileField, file)
+	return len(v.errs) == before
+}
+
+var yamlErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// type and unknown key problems are returned as validation errors so they
+// are reported together with the rest
+func decodeStrict(data []byte, cfg *Config) (ValidationErrors, error) {
+	err := yaml.UnmarshalStrict(data, cfg)
+	if err == nil {
+		return nil, nil
+	}
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return nil, err
+	}
+	errs := ValidationErrors{}
+	for _, msg := range typeErr.Errors {
+		ve := ValidationError{Message: msg}
+		if match := yamlErrorLine.FindStringSubmatch(msg); match != nil {
+			ve.Line, _ = strconv.Atoi(match[1])
+			ve.Message = match[2]
+		}
+		errs = append(errs, ve)
+	}
+	return errs, nil
+}
+
+var yamlKeyLine = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#:][^:#]*?)\s*:(\s|$)`)
+
+func fileLines(file string, lines map[string]int) map[string]location {
+	located := make(map[string]location, len(lines))
+	for key, line := range lines {
+		located[key] = location{File: file, Line: line}
+	}
+	return located
+}
+
+// yamlLines maps dotted key paths, list items as key[index], to their lines.
+func yamlLines(data []byte) map[string]int {
+	type entry struct {
+		indent int
+		key    string
+		item   bool
+	}
+	lines := map[string]int{}
+	counters := map[string]int{}
+	stack := []entry{}
+	path := func() string {
+		var sb strings.Builder
+		for _, e := range stack {
+			if sb.Len() > 0 && !e.item {
+				sb.WriteString(".")
+			}
+			sb.WriteString(e.key)
+		}
+		return sb.String()
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		content := strings.TrimLeft(line, " ")
+		indent := len(line) - len(content)
+		content = strings.TrimRight(content, " \r\t")
+		if len(content) == 0 || content[0] == '#' || content == "---" {
+			continue
+		}
+
+		if content == "-" || strings.HasPrefix(content, "- ") {
+			for len(stack) > 0 {
+				top := stack[len(stack)-1]
+				if top.indent > indent || (top.indent == indent && top.item) {
+					stack = stack[:len(stack)-1]
+					continue
+				}
+				break
+			}
+			parent := path()
+			stack = append(stack, entry{indent: indent, key: fmt.Sprintf("[%d]", counters[parent]), item: true})
+			counters[parent]++
+			lines[path()] = i + 1
+			content = strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+			indent = len(line) - len(strings.TrimLeft(strings.TrimLeft(strings.TrimLeft(line, " "), "-"), " "))
+			if len(content) == 0 {
+				continue
+			}
+		} else {
+			for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+				stack = stack[:len(stack)-1]
+			}
+		}
+
+		match := yamlKeyLine.FindStringSubmatch(content)
+		if match == nil {
+			continue
+		}
+		key := strings.Trim(match[1], `"'`)
+		stack = append(stack, entry{indent: indent, key: key})
+		if _, ok := lines[path()]; !ok {
+			lines[path()] = i + 1
+		}
+	}
+	return lines
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestYAMLLines(t *testing.T) {
+	cases := []struct {
+		name string
+		doc  string
+		want map[string]int
+	}{
+		{
+			name: "nested maps",
+			doc: `tls:
+  port: 443
+  limits:
+    readTimeout: 1m
+
+# a comment
+redirect:
+  port: 80
+`,
+			want: map[string]int{"tls": 1, "tls.port": 2, "tls.limits": 3, "tls.limits.readTimeout": 4, "redirect": 7, "redirect.port": 8},
+		},
+		{
+			name: "list items",
+			doc: `log:
+  flags:
+    - info
+    - error
+routes:
+  - name: api
+    path: /api
+  -
+    name: web
+`,
+			want: map[string]int{"log": 1, "log.flags": 2, "log.flags[0]": 3, "log.flags[1]": 4, "routes": 5, "routes[0]": 6, "routes[0].name": 6, "routes[0].path": 7, "routes[1]": 8, "routes[1].name": 9},
+		},
+		{
+			name: "quoted keys and values with colons",
+			doc: `"tls":
+  'upstream': "http://localhost:8080"
+  certFile: /etc/cert.pem # trailing
+`,
+			want: map[string]int{"tls": 1, "tls.upstream": 2, "tls.certFile": 3},
+		},
+		{
+			name: "duplicate keys keep the first line",
+			doc: `tls:
+  port: 1
+tls:
+  port: 2
+`,
+			want: map[string]int{"tls": 1, "tls.port": 2},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := yamlLines([]byte(c.doc)); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("got %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	cases := []struct {
+		name string
+		doc  string
+		line int
+		want string
+	}{
+		{"unknown field", "tls:\n  port: 443\n  upstreem: http://localhost\n", 3, "field upstreem not found"},
+		{"unknown section", "redirect:\n  port: 80\ntsl:\n  port: 443\n", 3, "field tsl not found"},
+		{"wrong type", "tls:\n  port: https\n", 2, "cannot unmarshal !!str `https`"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var cfg Config
+			errs, err := decodeStrict([]byte(c.doc), &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(errs) != 1 {
+				t.Fatalf("got %v, want one error", errs)
+			}
+			if errs[0].Line != c.line || !strings.Contains(errs[0].Message, c.want) {
+				t.Errorf("got line %d: %s, want line %d: %s", errs[0].Line, errs[0].Message, c.line, c.want)
+			}
+		})
+	}
+
+	var cfg Config
+	if errs, err := decodeStrict([]byte("tls: [\n"), &cfg); err == nil || errs != nil {
+		t.Errorf("malformed yaml got %v and %v, want a plain error", errs, err)
+	}
+	if errs, err := decodeStrict([]byte("tls:\n  port: 443\n"), &cfg); err != nil || errs != nil || cfg.TLS.Port != 443 {
+		t.Errorf("valid yaml got %v and %v", errs, err)
+	}
+}